@@ -1,37 +1,75 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/exler/fileigloo/server"
 	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
 	"github.com/urfave/cli/v2"
 )
 
 var Cmd = &cli.App{
 	Name:     "fileigloo",
 	Usage:    "Small and simple online file sharing & pastebin",
-	Commands: []*cli.Command{versionCmd, serverCmd, filesCmd},
+	Commands: []*cli.Command{versionCmd, serverCmd, filesCmd, s3Cmd},
 }
 
+// GetStorage returns the storage of commands that exit once done, which cannot use memory storage
 func GetStorage(cCtx *cli.Context) (chosenStorage storage.Storage, err error) {
-	switch storageProvider := cCtx.String("storage"); storageProvider {
+	return getStorageByProvider(cCtx, cCtx.String("storage"), false)
+}
+
+// getStorageByProvider returns the storage of the provider. Files kept in memory are lost when
+// the command exits, so only commands that keep running, i.e. runserver, should allow memory storage.
+func getStorageByProvider(cCtx *cli.Context, storageProvider string, allowMemory bool) (chosenStorage storage.Storage, err error) {
+	switch storageProvider {
 	case "local":
 		udir := cCtx.String("upload-directory")
 		if udir == "" {
 			return nil, errors.New("no upload directory specified")
 		}
 
-		chosenStorage, err = storage.NewLocalStorage(udir)
+		options := []storage.LocalOptionFn{
+			storage.ShardDepth(cCtx.Int("local-shard-depth")),
+			storage.MinFreeSpace(uint64(cCtx.Int64("local-min-free-space")) * 1024 * 1024), //#nosec
+		}
+		if cCtx.Bool("local-sweep-on-low-space") {
+			options = append(options, storage.SweepOnLowSpace(func(deletedCount int, err error) {
+				if err != nil {
+					log.Printf("Failed to delete expired files on low disk space: %v", err)
+				}
+				if deletedCount > 0 || err == nil {
+					log.Printf("Deleted expired files on low disk space [count=%d]", deletedCount)
+				}
+			}))
+		}
+		chosenStorage, err = storage.NewLocalStorage(udir, options...)
 	case "s3":
-		bucket := cCtx.String("aws-s3-bucket")
-		region := cCtx.String("aws-s3-region")
-		accessKey := cCtx.String("aws-s3-access-key")
-		secretKey := cCtx.String("aws-s3-secret-key")
-		sessionToken := cCtx.String("aws-s3-session-token")
-		endpointUrl := cCtx.String("aws-s3-endpoint-url")
-
-		chosenStorage, err = storage.NewS3Storage(accessKey, secretKey, sessionToken, endpointUrl, region, bucket)
+		chosenStorage, err = getS3Storage(cCtx)
+	case "webdav":
+		chosenStorage, err = storage.NewWebDAVStorage(cCtx.Context, storage.WebDAVConfig{
+			URL:      cCtx.String("webdav-url"),
+			Username: cCtx.String("webdav-username"),
+			Password: cCtx.String("webdav-password"),
+		})
+	case "sftp":
+		chosenStorage, err = getSFTPStorage(cCtx)
+	case "memory":
+		if !allowMemory {
+			return nil, errors.New("memory storage can only be used by runserver")
+		}
+		chosenStorage, err = storage.NewMemoryStorage(cCtx.Int64("memory-max-size") * 1024 * 1024)
+	case "mirror":
+		chosenStorage, err = getMirrorStorage(cCtx, allowMemory)
 	default:
 		return nil, errors.New("wrong storage provider")
 	}
@@ -39,6 +77,163 @@ func GetStorage(cCtx *cli.Context) (chosenStorage storage.Storage, err error) {
 	return
 }
 
+func getMirrorStorage(cCtx *cli.Context, allowMemory bool) (*storage.MirrorStorage, error) {
+	var replicas []storage.Storage
+	for _, provider := range cCtx.StringSlice("mirror-storages") {
+		if provider == "mirror" {
+			return nil, errors.New("mirror storage cannot mirror itself")
+		}
+
+		replica, err := getStorageByProvider(cCtx, provider, allowMemory)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+
+	return storage.NewMirrorStorage(replicas,
+		storage.MirrorWritePolicy(storage.WritePolicy(cCtx.String("mirror-write-policy"))),
+		storage.OnReplicaError(func(filename string, err error) {
+			log.Printf("Failed to write file to replica, run files resync to repair it [fileId=%s]: %s", filename, err)
+		}),
+	)
+}
+
+// waitForStorage blocks until writes the storage makes in the background have finished
+func waitForStorage(s storage.Storage) {
+	if mirror, ok := s.(*storage.MirrorStorage); ok {
+		mirror.Wait()
+	}
+}
+
+func getS3Storage(cCtx *cli.Context) (*storage.S3Storage, error) {
+	return storage.NewS3Storage(cCtx.Context, storage.S3Config{
+		Bucket:       cCtx.String("aws-s3-bucket"),
+		Region:       cCtx.String("aws-s3-region"),
+		EndpointURL:  cCtx.String("aws-s3-endpoint-url"),
+		AccessKey:    cCtx.String("aws-s3-access-key"),
+		SecretKey:    cCtx.String("aws-s3-secret-key"),
+		SessionToken: cCtx.String("aws-s3-session-token"),
+		Profile:      cCtx.String("aws-s3-profile"),
+		UsePathStyle: cCtx.Bool("aws-s3-force-path-style"),
+	})
+}
+
+func getSFTPStorage(cCtx *cli.Context) (*storage.SFTPStorage, error) {
+	config := storage.SFTPConfig{
+		Address:              cCtx.String("sftp-address"),
+		Username:             cCtx.String("sftp-username"),
+		Password:             cCtx.String("sftp-password"),
+		PrivateKeyPassphrase: cCtx.String("sftp-private-key-passphrase"),
+		KnownHostsPath:       cCtx.String("sftp-known-hosts"),
+		Directory:            cCtx.String("sftp-directory"),
+		PoolSize:             cCtx.Int("sftp-pool-size"),
+	}
+
+	if rest, ok := strings.CutPrefix(config.KnownHostsPath, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		config.KnownHostsPath = filepath.Join(home, rest)
+	}
+
+	if keyPath := cCtx.String("sftp-private-key"); keyPath != "" {
+		key, err := os.ReadFile(keyPath) //#nosec
+		if err != nil {
+			return nil, err
+		}
+		config.PrivateKey = key
+	}
+
+	return storage.NewSFTPStorage(cCtx.Context, config)
+}
+
+// getUploadProcessors builds the chain of upload processors in the order they are given
+func getUploadProcessors(cCtx *cli.Context) ([]server.UploadProcessor, error) {
+	names := cCtx.StringSlice("upload-processors")
+	allowedTypes := cCtx.StringSlice("upload-allowed-types")
+	if len(allowedTypes) > 0 && !slices.Contains(names, "sniff-type") {
+		return nil, errors.New("upload-allowed-types requires the sniff-type upload processor")
+	}
+	if cCtx.IsSet("clamd-address") && !slices.Contains(names, "clamd") {
+		return nil, errors.New("clamd-address requires the clamd upload processor")
+	}
+	// Presigned uploads go directly to the storage, so they would not be scanned or checked
+	if cCtx.Duration("presigned-upload-expiry") > 0 {
+		if slices.Contains(names, "clamd") {
+			return nil, errors.New("clamd upload processor cannot be used with presigned uploads")
+		} else if len(allowedTypes) > 0 {
+			return nil, errors.New("upload-allowed-types cannot be used with presigned uploads")
+		}
+	}
+
+	var processors []server.UploadProcessor
+	for _, name := range names {
+		switch name {
+		case "sniff-type":
+			processors = append(processors, server.SniffContentType(allowedTypes))
+		case "strip-exif":
+			processors = append(processors, server.StripEXIF())
+		case "clamd":
+			scanner, err := server.ScanWithClamd(server.ClamdConfig{
+				Address:    cCtx.String("clamd-address"),
+				Timeout:    cCtx.Duration("clamd-timeout"),
+				Quarantine: cCtx.Bool("clamd-quarantine"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			processors = append(processors, scanner)
+		default:
+			return nil, fmt.Errorf("unknown upload processor %s", name)
+		}
+	}
+	return processors, nil
+}
+
+// getWebhooks returns nil if no webhook URLs are configured
+func getWebhooks(cCtx *cli.Context) (*webhooks.Webhooks, error) {
+	urls := cCtx.StringSlice("webhook-url")
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	var events []webhooks.EventType
+	for _, event := range cCtx.StringSlice("webhook-events") {
+		events = append(events, webhooks.EventType(event))
+	}
+
+	return webhooks.NewWebhooks(webhooks.Config{
+		URLs:            urls,
+		Secret:          cCtx.String("webhook-secret"),
+		Events:          events,
+		OutboxDirectory: cCtx.String("webhook-outbox"),
+		MaxAttempts:     cCtx.Int("webhook-max-attempts"),
+	})
+}
+
+func emit(hooks *webhooks.Webhooks, eventType webhooks.EventType, fileId string, metadata storage.Metadata) {
+	if hooks != nil {
+		hooks.Emit(webhooks.NewEvent(eventType, fileId, "", metadata))
+	}
+}
+
+// webhookFlushTimeout bounds how long commands wait for webhooks before they exit
+const webhookFlushTimeout = 30 * time.Second
+
+// flushWebhooks sends the events emitted by a command before it exits. Events that could not be
+// delivered stay in the outbox, to be retried by a server sharing it.
+func flushWebhooks(ctx context.Context, hooks *webhooks.Webhooks) {
+	if hooks == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookFlushTimeout)
+	defer cancel()
+	hooks.Flush(ctx)
+}
+
 func Run() error {
 	return Cmd.Run(os.Args)
 }
@@ -3,7 +3,13 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
 	colors "github.com/logrusorgru/aurora/v4"
 	"github.com/urfave/cli/v2"
 )
@@ -16,8 +22,92 @@ func truncateText(text string, length int) string {
 	return text
 }
 
+// parseLabels parses label filters given as key=value
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(values))
+	for _, label := range values {
+		key, value, found := strings.Cut(label, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("label filter %q must be given as key=value", label)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
 var (
-	flags = []cli.Flag{
+	s3Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "aws-s3-bucket",
+			EnvVars: []string{"AWS_S3_BUCKET"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-region",
+			EnvVars: []string{"AWS_S3_REGION"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-access-key",
+			EnvVars: []string{"AWS_S3_ACCESS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-secret-key",
+			EnvVars: []string{"AWS_S3_SECRET_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-session-token",
+			EnvVars: []string{"AWS_S3_SESSION_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-endpoint-url",
+			EnvVars: []string{"AWS_S3_ENDPOINT_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "aws-s3-profile",
+			Usage:   "Shared AWS config profile to use when no access key is given",
+			EnvVars: []string{"AWS_S3_PROFILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "aws-s3-force-path-style",
+			Usage:   "Use path-style bucket addressing (e.g. for MinIO)",
+			EnvVars: []string{"AWS_S3_FORCE_PATH_STYLE"},
+		},
+	}
+
+	webhookFlags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "webhook-url",
+			Usage:   "URLs to send events about files to (repeatable)",
+			EnvVars: []string{"WEBHOOK_URLS"},
+		},
+		&cli.StringFlag{
+			Name:    "webhook-secret",
+			Usage:   "Secret to sign webhook requests with",
+			EnvVars: []string{"WEBHOOK_SECRET"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "webhook-events",
+			Usage:   "Events to send: file.uploaded, file.downloaded, file.deleted or file.expired (default: all)",
+			EnvVars: []string{"WEBHOOK_EVENTS"},
+		},
+		&cli.StringFlag{
+			Name:    "webhook-outbox",
+			Usage:   "Directory events are kept in until they are delivered",
+			Value:   "webhook-outbox/",
+			EnvVars: []string{"WEBHOOK_OUTBOX"},
+		},
+		&cli.IntFlag{
+			Name:    "webhook-max-attempts",
+			Usage:   "Number of times an event is sent before it is dropped",
+			Value:   10,
+			EnvVars: []string{"WEBHOOK_MAX_ATTEMPTS"},
+		},
+	}
+
+	flags = append([]cli.Flag{
 		&cli.StringFlag{
 			Name:    "storage",
 			Value:   "local",
@@ -28,31 +118,80 @@ var (
 			Value:   "uploads/",
 			EnvVars: []string{"UPLOAD_DIRECTORY"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "mirror-storages",
+			Usage:   "Storage providers mirror storage writes files to, the first one is the primary (e.g. local,s3)",
+			EnvVars: []string{"MIRROR_STORAGES"},
+		},
 		&cli.StringFlag{
-			Name:    "s3-bucket",
-			EnvVars: []string{"S3_BUCKET"},
+			Name:    "mirror-write-policy",
+			Usage:   "When writes to mirror storage succeed: all, quorum or primary (other replicas are written in the background)",
+			Value:   string(storage.WriteAll),
+			EnvVars: []string{"MIRROR_WRITE_POLICY"},
+		},
+		&cli.IntFlag{
+			Name:    "local-shard-depth",
+			Usage:   "Number of nested directory levels to spread local files across (0 to keep all files in the upload directory)",
+			EnvVars: []string{"LOCAL_SHARD_DEPTH"},
+		},
+		&cli.Int64Flag{
+			Name:    "local-min-free-space",
+			Usage:   "Reject uploads to local storage that would leave less free disk space in megabytes (0 to disable)",
+			EnvVars: []string{"LOCAL_MIN_FREE_SPACE"},
 		},
 		&cli.StringFlag{
-			Name:    "s3-region",
-			EnvVars: []string{"S3_REGION"},
+			Name:    "webdav-url",
+			Usage:   "URL of the WebDAV collection to store files in",
+			EnvVars: []string{"WEBDAV_URL"},
 		},
 		&cli.StringFlag{
-			Name:    "aws-access-key",
-			EnvVars: []string{"AWS_ACCESS_KEY"},
+			Name:    "webdav-username",
+			EnvVars: []string{"WEBDAV_USERNAME"},
 		},
 		&cli.StringFlag{
-			Name:    "aws-secret-key",
-			EnvVars: []string{"AWS_SECRET_KEY"},
+			Name:    "webdav-password",
+			EnvVars: []string{"WEBDAV_PASSWORD"},
 		},
 		&cli.StringFlag{
-			Name:    "aws-session-token",
-			EnvVars: []string{"AWS_SESSION_TOKEN"},
+			Name:    "sftp-address",
+			Usage:   "Address of the SSH server to store files on as host:port",
+			EnvVars: []string{"SFTP_ADDRESS"},
 		},
 		&cli.StringFlag{
-			Name:    "aws-endpoint-url",
-			EnvVars: []string{"AWS_ENDPOINT_URL"},
+			Name:    "sftp-username",
+			EnvVars: []string{"SFTP_USERNAME"},
 		},
-	}
+		&cli.StringFlag{
+			Name:    "sftp-password",
+			EnvVars: []string{"SFTP_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-private-key",
+			Usage:   "Path to the private key used to authenticate to the SSH server",
+			EnvVars: []string{"SFTP_PRIVATE_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-private-key-passphrase",
+			EnvVars: []string{"SFTP_PRIVATE_KEY_PASSPHRASE"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-known-hosts",
+			Usage:   "Path to the known_hosts file the SSH server's host key is verified against",
+			Value:   "~/.ssh/known_hosts",
+			EnvVars: []string{"SFTP_KNOWN_HOSTS"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-directory",
+			Usage:   "Directory on the SSH server to store files in",
+			EnvVars: []string{"SFTP_DIRECTORY"},
+		},
+		&cli.IntFlag{
+			Name:    "sftp-pool-size",
+			Usage:   "Maximum number of connections to the SSH server",
+			Value:   4,
+			EnvVars: []string{"SFTP_POOL_SIZE"},
+		},
+	}, s3Flags...)
 
 	filesCmd = &cli.Command{
 		Name:  "files",
@@ -61,44 +200,124 @@ var (
 			{
 				Name:  "list",
 				Usage: "List files in storage",
-				Flags: flags,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "List only files with IDs starting with the prefix",
+					},
+					&cli.BoolFlag{
+						Name:  "expired",
+						Usage: "List only expired files",
+					},
+					&cli.DurationFlag{
+						Name:  "older-than",
+						Usage: "List only files stored longer ago than the given duration",
+					},
+					&cli.StringSliceFlag{
+						Name:  "label",
+						Usage: "List only files with the label given as key=value (repeatable, all must match)",
+					},
+					&cli.BoolFlag{
+						Name:  "quarantined",
+						Usage: "List only files quarantined because malware was found in them",
+					},
+				}, flags...),
 				Action: func(cCtx *cli.Context) error {
-					s, err := GetStorage(cCtx)
+					labels, err := parseLabels(cCtx.StringSlice("label"))
 					if err != nil {
 						return err
 					}
 
-					files, metadata, err := s.List(cCtx.Context)
+					s, err := GetStorage(cCtx)
 					if err != nil {
 						return err
 					}
 
+					options := storage.ListOptions{
+						Prefix:          cCtx.String("prefix"),
+						ExpiredOnly:     cCtx.Bool("expired"),
+						Labels:          labels,
+						QuarantinedOnly: cCtx.Bool("quarantined"),
+					}
+					if olderThan := cCtx.Duration("older-than"); olderThan > 0 {
+						options.OlderThan = time.Now().Add(-olderThan)
+					}
+
 					fmt.Println(colors.Blue("File ID | Size (bytes) | Filename"))
-					for i, file := range files {
-						fmt.Println(file, metadata[i].ContentLength, truncateText(metadata[i].Filename, 32))
+					for object, err := range s.Iterate(cCtx.Context, options) {
+						if err != nil {
+							return err
+						}
+						fmt.Println(object.Filename, object.Metadata.ContentLength, truncateText(object.Metadata.Filename, 32))
 					}
 					return nil
 				},
 			},
 			{
-				Name:  "delete",
-				Usage: "Delete given file from storage",
-				Flags: flags,
+				Name:      "delete",
+				Usage:     "Delete given file from storage, or all files with the given labels",
+				ArgsUsage: "[fileId]",
+				Flags: append(append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "label",
+						Usage: "Delete all files with the label given as key=value (repeatable, all must match)",
+					},
+				}, flags...), webhookFlags...),
 				Action: func(cCtx *cli.Context) error {
-					s, err := GetStorage(cCtx)
+					labels, err := parseLabels(cCtx.StringSlice("label"))
 					if err != nil {
 						return err
 					}
 
 					fileID := cCtx.Args().First()
-					if fileID == "" {
-						return errors.New("no file id provided")
+					if fileID == "" && labels == nil {
+						return errors.New("no file id or labels provided")
+					} else if fileID != "" && labels != nil {
+						return errors.New("either a file id or labels can be provided, not both")
+					}
+
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					hooks, err := getWebhooks(cCtx)
+					if err != nil {
+						return err
+					}
+					defer flushWebhooks(cCtx.Context, hooks)
+
+					if labels != nil {
+						deletedCount := 0
+						for object, err := range s.Iterate(cCtx.Context, storage.ListOptions{Labels: labels}) {
+							if err != nil {
+								return err
+							}
+							if err := s.Delete(cCtx.Context, object.Filename); err != nil {
+								return err
+							}
+							emit(hooks, webhooks.EventFileDeleted, object.Filename, object.Metadata)
+							deletedCount++
+						}
+
+						if deletedCount == 0 {
+							fmt.Println(colors.Green("No files with the labels found"))
+						} else {
+							fmt.Println(colors.Blue(fmt.Sprintf("Deleted %d files", deletedCount)))
+						}
+						return nil
+					}
+
+					metadata, err := s.GetOnlyMetadata(cCtx.Context, fileID)
+					if err != nil {
+						return err
 					}
 
 					err = s.Delete(cCtx.Context, fileID)
 					if err != nil {
 						return err
 					}
+					emit(hooks, webhooks.EventFileDeleted, fileID, metadata)
 					fmt.Println(colors.Blue(fmt.Sprintf("File deleted [fileId=%s]", fileID)))
 					return nil
 				},
@@ -106,23 +325,331 @@ var (
 			{
 				Name:  "cleanup",
 				Usage: "Delete expired files from storage",
-				Flags: flags,
+				Flags: append(slices.Clone(flags), webhookFlags...),
 				Action: func(cCtx *cli.Context) error {
 					s, err := GetStorage(cCtx)
 					if err != nil {
 						return err
 					}
 
-					deletedCount, err := s.DeleteExpired(cCtx.Context)
+					hooks, err := getWebhooks(cCtx)
 					if err != nil {
 						return err
 					}
+					defer flushWebhooks(cCtx.Context, hooks)
+
+					deletedCount, err := storage.DeleteExpiredWith(cCtx.Context, s, func(object storage.Object) {
+						emit(hooks, webhooks.EventFileExpired, object.Filename, object.Metadata)
+					})
 
-					if deletedCount == 0 {
+					// Some files may have been deleted even if others failed
+					if deletedCount == 0 && err == nil {
 						fmt.Println(colors.Green("No expired files found"))
-					} else {
+					} else if deletedCount > 0 {
 						fmt.Println(colors.Blue(fmt.Sprintf("Deleted %d expired files", deletedCount)))
 					}
+					return err
+				},
+			},
+			{
+				Name:  "fsck",
+				Usage: "Remove leftovers of interrupted writes from local, SFTP or WebDAV storage",
+				Flags: append([]cli.Flag{
+					&cli.DurationFlag{
+						Name:  "grace-period",
+						Usage: "Keep leftovers modified more recently than this, they may belong to writes in progress",
+						Value: storage.DefaultFsckGracePeriod,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only list the files that would be removed",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					fscker, ok := s.(storage.Fscker)
+					if !ok {
+						return errors.New("fsck is only supported by local, SFTP and WebDAV storage")
+					}
+
+					removed, err := fscker.Fsck(cCtx.Context, storage.FsckOptions{
+						GracePeriod: cCtx.Duration("grace-period"),
+						DryRun:      cCtx.Bool("dry-run"),
+					})
+					if err != nil {
+						return err
+					}
+
+					for _, name := range removed {
+						fmt.Println(name)
+					}
+					if len(removed) == 0 {
+						fmt.Println(colors.Green("No leftover files found"))
+					} else if cCtx.Bool("dry-run") {
+						fmt.Println(colors.Blue(fmt.Sprintf("Would remove %d leftover files", len(removed))))
+					} else {
+						fmt.Println(colors.Blue(fmt.Sprintf("Removed %d leftover files", len(removed))))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "reshard",
+				Usage: "Move local files into the layout given by --local-shard-depth",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					local, ok := s.(*storage.LocalStorage)
+					if !ok {
+						return errors.New("resharding is only supported by local storage")
+					}
+
+					movedCount, err := local.Reshard(cCtx.Context)
+					if err != nil {
+						return err
+					}
+
+					if movedCount == 0 {
+						fmt.Println(colors.Green("All files are already in place"))
+					} else {
+						fmt.Println(colors.Blue(fmt.Sprintf("Moved %d files", movedCount)))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Verify file contents against their checksums",
+				ArgsUsage: "[fileId...]",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					files, metadata, err := s.List(cCtx.Context)
+					if err != nil {
+						return err
+					}
+
+					var verifiedCount, unverifiedCount, corruptedCount int
+					for i, file := range files {
+						if cCtx.NArg() > 0 && !slices.Contains(cCtx.Args().Slice(), file) {
+							continue
+						}
+
+						if metadata[i].Checksum == "" {
+							unverifiedCount++
+							continue
+						}
+
+						if err := storage.VerifyChecksum(cCtx.Context, s, file); errors.Is(err, storage.ErrChecksumMismatch) {
+							fmt.Println(colors.Red(fmt.Sprintf("File is corrupted [fileId=%s]", file)))
+							corruptedCount++
+						} else if err != nil {
+							return err
+						} else {
+							verifiedCount++
+						}
+					}
+
+					fmt.Println(colors.Blue(fmt.Sprintf("Verified %d files, %d without checksum, %d corrupted", verifiedCount, unverifiedCount, corruptedCount)))
+					if corruptedCount > 0 {
+						return errors.New("some files do not match their checksums")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "resync",
+				Usage: "Copy files missing or differing on some mirror storage replicas from the others",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					mirror, ok := s.(*storage.MirrorStorage)
+					if !ok {
+						return errors.New("resync is only supported by mirror storage")
+					}
+
+					result, err := mirror.Resync(cCtx.Context, storage.ResyncOptions{
+						OnFile: func(filename string, status storage.MigrateStatus, err error) {
+							switch status {
+							case storage.MigrateCopied:
+								fmt.Printf("Repaired file [fileId=%s]\n", filename)
+							case storage.MigrateFailed:
+								fmt.Println(colors.Red(fmt.Sprintf("Failed to repair file [fileId=%s]: %s", filename, err)))
+							}
+						},
+					})
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(colors.Blue(fmt.Sprintf("Repaired %d files, %d already in sync, failed %d", result.Copied, result.Skipped, result.Failed)))
+					if result.Failed > 0 {
+						return errors.New("some files could not be repaired, run the resync again to retry")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Copy all files from one storage to another",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "from",
+						Usage:    "Storage provider to copy files from",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "Storage provider to copy files to",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Usage: "Number of files copied in parallel",
+						Value: 4,
+					},
+					&cli.BoolFlag{
+						Name:  "skip-expired",
+						Usage: "Do not copy expired files",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.String("from") == cCtx.String("to") {
+						return errors.New("source and destination storage must differ")
+					}
+
+					from, err := getStorageByProvider(cCtx, cCtx.String("from"), false)
+					if err != nil {
+						return err
+					}
+					to, err := getStorageByProvider(cCtx, cCtx.String("to"), false)
+					if err != nil {
+						return err
+					}
+
+					result, err := storage.Migrate(cCtx.Context, from, to, storage.MigrateOptions{
+						Concurrency: cCtx.Int("concurrency"),
+						SkipExpired: cCtx.Bool("skip-expired"),
+						OnFile: func(filename string, status storage.MigrateStatus, err error) {
+							if status == storage.MigrateFailed {
+								fmt.Println(colors.Red(fmt.Sprintf("Failed to copy file [fileId=%s]: %s", filename, err)))
+							}
+						},
+					})
+					waitForStorage(to)
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(colors.Blue(fmt.Sprintf("Copied %d files, skipped %d, failed %d", result.Copied, result.Skipped, result.Failed)))
+					if result.Failed > 0 {
+						return errors.New("some files could not be copied, run the migration again to retry")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "export",
+				Usage: "Export files with their metadata into an archive",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Path of the archive to create",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:  "file-id",
+						Usage: "Export only the given file, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-expired",
+						Usage: "Do not export expired files",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					file, err := os.OpenFile(cCtx.String("output"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+
+					exportedCount, err := storage.Export(cCtx.Context, s, file, storage.ExportOptions{
+						SkipExpired: cCtx.Bool("skip-expired"),
+						FileIds:     cCtx.StringSlice("file-id"),
+					})
+					if err != nil {
+						file.Close()
+						os.Remove(file.Name()) //#nosec
+						return err
+					}
+
+					fmt.Println(colors.Blue(fmt.Sprintf("Exported %d files to %s", exportedCount, file.Name())))
+					return file.Close()
+				},
+			},
+			{
+				Name:  "import",
+				Usage: "Import files with their metadata from an archive",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "input",
+						Aliases:  []string{"i"},
+						Usage:    "Path of the archive to import",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "skip-expired",
+						Usage: "Do not import expired files",
+					},
+					&cli.BoolFlag{
+						Name:  "overwrite",
+						Usage: "Replace files that already exist in storage",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					s, err := GetStorage(cCtx)
+					if err != nil {
+						return err
+					}
+
+					file, err := os.Open(cCtx.String("input"))
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+
+					importedCount, skippedCount, err := storage.Import(cCtx.Context, s, file, storage.ImportOptions{
+						SkipExpired: cCtx.Bool("skip-expired"),
+						Overwrite:   cCtx.Bool("overwrite"),
+					})
+					waitForStorage(s)
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(colors.Blue(fmt.Sprintf("Imported %d files, skipped %d", importedCount, skippedCount)))
 					return nil
 				},
 			},
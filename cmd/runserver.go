@@ -2,15 +2,17 @@ package cmd
 
 import (
 	"log"
+	"time"
 
 	"github.com/exler/fileigloo/server"
+	"github.com/exler/fileigloo/storage"
 	"github.com/urfave/cli/v2"
 )
 
 var serverCmd = &cli.Command{
 	Name:  "runserver",
 	Usage: "Run web server",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.IntFlag{
 			Name:    "port",
 			Aliases: []string{"p"},
@@ -28,6 +30,33 @@ var serverCmd = &cli.Command{
 			Value:   100,
 			EnvVars: []string{"RATE_LIMIT"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "upload-processors",
+			EnvVars: []string{"UPLOAD_PROCESSORS"},
+			Usage:   "Processors to run uploads through before they are stored, in order: sniff-type, strip-exif, clamd",
+		},
+		&cli.StringSliceFlag{
+			Name:    "upload-allowed-types",
+			EnvVars: []string{"UPLOAD_ALLOWED_TYPES"},
+			Usage:   "Content types detected by sniff-type that are accepted, types ending with a slash match all subtypes (default: all)",
+		},
+		&cli.StringFlag{
+			Name:    "clamd-address",
+			Value:   "localhost:3310",
+			EnvVars: []string{"CLAMD_ADDRESS"},
+			Usage:   "Address of clamd used by the clamd upload processor, host:port or the path of a unix socket",
+		},
+		&cli.DurationFlag{
+			Name:    "clamd-timeout",
+			Value:   time.Minute,
+			EnvVars: []string{"CLAMD_TIMEOUT"},
+			Usage:   "Timeout of connecting to clamd and of every read and write of a scan",
+		},
+		&cli.BoolFlag{
+			Name:    "clamd-quarantine",
+			EnvVars: []string{"CLAMD_QUARANTINE"},
+			Usage:   "Store infected uploads as quarantined files, which are never served, instead of rejecting them",
+		},
 		&cli.StringFlag{
 			Name:    "storage",
 			Value:   "local",
@@ -38,11 +67,100 @@ var serverCmd = &cli.Command{
 			Usage:   "Password to protect the site with",
 			EnvVars: []string{"SITE_PASSWORD"},
 		},
+		&cli.StringFlag{
+			Name:    "ip-hash-key",
+			Usage:   "Secret key uploader IP addresses are hashed with before they are stored (random if not set)",
+			EnvVars: []string{"IP_HASH_KEY"},
+		},
 		&cli.StringFlag{
 			Name:    "upload-directory",
 			Value:   "uploads/",
 			EnvVars: []string{"UPLOAD_DIRECTORY"},
 		},
+		&cli.Int64Flag{
+			Name:    "memory-max-size",
+			Usage:   "Maximum size of files kept by memory storage in megabytes (0 for unlimited)",
+			Value:   256,
+			EnvVars: []string{"MEMORY_MAX_SIZE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "mirror-storages",
+			Usage:   "Storage providers mirror storage writes files to, the first one is the primary (e.g. local,s3)",
+			EnvVars: []string{"MIRROR_STORAGES"},
+		},
+		&cli.StringFlag{
+			Name:    "mirror-write-policy",
+			Usage:   "When writes to mirror storage succeed: all, quorum or primary (other replicas are written in the background)",
+			Value:   string(storage.WriteAll),
+			EnvVars: []string{"MIRROR_WRITE_POLICY"},
+		},
+		&cli.IntFlag{
+			Name:    "local-shard-depth",
+			Usage:   "Number of nested directory levels to spread local files across (0 to keep all files in the upload directory)",
+			EnvVars: []string{"LOCAL_SHARD_DEPTH"},
+		},
+		&cli.Int64Flag{
+			Name:    "local-min-free-space",
+			Usage:   "Reject uploads to local storage that would leave less free disk space in megabytes (0 to disable)",
+			EnvVars: []string{"LOCAL_MIN_FREE_SPACE"},
+		},
+		&cli.BoolFlag{
+			Name:    "local-sweep-on-low-space",
+			Usage:   "Delete expired files right away when an upload is rejected for lack of disk space",
+			EnvVars: []string{"LOCAL_SWEEP_ON_LOW_SPACE"},
+		},
+		&cli.StringFlag{
+			Name:    "webdav-url",
+			Usage:   "URL of the WebDAV collection to store files in",
+			EnvVars: []string{"WEBDAV_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "webdav-username",
+			EnvVars: []string{"WEBDAV_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "webdav-password",
+			EnvVars: []string{"WEBDAV_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-address",
+			Usage:   "Address of the SSH server to store files on as host:port",
+			EnvVars: []string{"SFTP_ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-username",
+			EnvVars: []string{"SFTP_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-password",
+			EnvVars: []string{"SFTP_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-private-key",
+			Usage:   "Path to the private key used to authenticate to the SSH server",
+			EnvVars: []string{"SFTP_PRIVATE_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-private-key-passphrase",
+			EnvVars: []string{"SFTP_PRIVATE_KEY_PASSPHRASE"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-known-hosts",
+			Usage:   "Path to the known_hosts file the SSH server's host key is verified against",
+			Value:   "~/.ssh/known_hosts",
+			EnvVars: []string{"SFTP_KNOWN_HOSTS"},
+		},
+		&cli.StringFlag{
+			Name:    "sftp-directory",
+			Usage:   "Directory on the SSH server to store files in",
+			EnvVars: []string{"SFTP_DIRECTORY"},
+		},
+		&cli.IntFlag{
+			Name:    "sftp-pool-size",
+			Usage:   "Maximum number of connections to the SSH server",
+			Value:   4,
+			EnvVars: []string{"SFTP_POOL_SIZE"},
+		},
 		&cli.StringFlag{
 			Name:    "aws-s3-bucket",
 			EnvVars: []string{"AWS_S3_BUCKET"},
@@ -67,6 +185,60 @@ var serverCmd = &cli.Command{
 			Name:    "aws-s3-endpoint-url",
 			EnvVars: []string{"AWS_S3_ENDPOINT_URL"},
 		},
+		&cli.StringFlag{
+			Name:    "aws-s3-profile",
+			Usage:   "Shared AWS config profile to use when no access key is given",
+			EnvVars: []string{"AWS_S3_PROFILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "aws-s3-force-path-style",
+			Usage:   "Use path-style bucket addressing (e.g. for MinIO)",
+			EnvVars: []string{"AWS_S3_FORCE_PATH_STYLE"},
+		},
+		&cli.DurationFlag{
+			Name:    "presigned-download-expiry",
+			Value:   0,
+			EnvVars: []string{"PRESIGNED_DOWNLOAD_EXPIRY"},
+			Usage:   "Redirect downloads to presigned storage URLs valid for the given duration (0 to serve downloads through the server)",
+		},
+		&cli.DurationFlag{
+			Name:    "presigned-upload-expiry",
+			Value:   0,
+			EnvVars: []string{"PRESIGNED_UPLOAD_EXPIRY"},
+			Usage:   "Allow uploads directly to the storage through presigned URLs valid for the given duration (0 to disable)",
+		},
+		&cli.StringFlag{
+			Name:    "cache-directory",
+			EnvVars: []string{"CACHE_DIRECTORY"},
+			Usage:   "Keep recently downloaded files in the directory to serve them without reaching the storage (disables presigned URLs)",
+		},
+		&cli.Int64Flag{
+			Name:    "cache-max-size",
+			Value:   1024,
+			EnvVars: []string{"CACHE_MAX_SIZE"},
+			Usage:   "Maximum size of the download cache in megabytes",
+		},
+		&cli.BoolFlag{
+			Name:    "compress",
+			EnvVars: []string{"COMPRESS"},
+			Usage:   "Store text files compressed with zstd and send them compressed to clients that accept it (disables presigned URLs)",
+		},
+		&cli.StringSliceFlag{
+			Name:    "compress-types",
+			EnvVars: []string{"COMPRESS_TYPES"},
+			Usage:   "Content types to compress, types ending with a slash match all subtypes (default: text/ and common text-based formats)",
+		},
+		&cli.Int64Flag{
+			Name:    "ready-min-free-space",
+			Value:   100,
+			EnvVars: []string{"READY_MIN_FREE_SPACE"},
+			Usage:   "Report the server as not ready on /readyz while local storage has less free space in megabytes (0 to disable)",
+		},
+		&cli.DurationFlag{
+			Name:    "cleanup-interval",
+			EnvVars: []string{"CLEANUP_INTERVAL"},
+			Usage:   "Delete expired files from the storage this often (0 to leave them for files cleanup)",
+		},
 		&cli.StringFlag{
 			Name:    "sentry-dsn",
 			EnvVars: []string{"SENTRY_DSN"},
@@ -81,7 +253,7 @@ var serverCmd = &cli.Command{
 			Value:   0,
 			EnvVars: []string{"SENTRY_TRACES_SAMPLE_RATE"},
 		},
-	},
+	}, webhookFlags...),
 	Action: func(cCtx *cli.Context) error {
 		serverOptions := []server.OptionFn{
 			server.Port(cCtx.Int("port")),
@@ -89,17 +261,79 @@ var serverCmd = &cli.Command{
 			server.MaxRequests(cCtx.Int("rate-limit")),
 			server.Sentry(cCtx.String("sentry-dsn"), cCtx.String("sentry-environment"), cCtx.Float64("sentry-traces-sample-rate")),
 			server.SitePassword(cCtx.String("site-password")),
+			server.IPHashKey(cCtx.String("ip-hash-key")),
+			server.PresignedDownloads(cCtx.Duration("presigned-download-expiry")),
+			server.PresignedUploads(cCtx.Duration("presigned-upload-expiry")),
+			server.ReadyMinFreeSpace(cCtx.Int64("ready-min-free-space")),
+			server.CleanupInterval(cCtx.Duration("cleanup-interval")),
 		}
 
-		storage, err := GetStorage(cCtx)
+		processors, err := getUploadProcessors(cCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(processors) > 0 {
+			serverOptions = append(serverOptions, server.UploadProcessors(processors...))
+		}
+
+		hooks, err := getWebhooks(cCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if hooks != nil {
+			serverOptions = append(serverOptions, server.UseWebhooks(hooks))
+		}
+
+		s, err := getStorageByProvider(cCtx, cCtx.String("storage"), true)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		serverOptions = append(serverOptions, server.UseStorage(storage))
+
+		storages := []storage.Storage{s}
+		if mirror, ok := s.(*storage.MirrorStorage); ok {
+			storages = mirror.Replicas()
+		}
+
+		// Clean up after a previous crash before serving any files
+		for _, replica := range storages {
+			if fscker, ok := replica.(storage.Fscker); ok {
+				removed, err := fscker.Fsck(cCtx.Context, storage.FsckOptions{GracePeriod: storage.DefaultFsckGracePeriod})
+				if err != nil {
+					log.Fatalln(err)
+				} else if len(removed) > 0 {
+					log.Printf("Removed %d leftover files from %s storage", len(removed), replica.Type())
+				}
+			}
+		}
+
+		served := s
+		var cache *storage.CachedStorage
+		if directory := cCtx.String("cache-directory"); directory != "" {
+			cache, err = storage.NewCachedStorage(cCtx.Context, served, directory, cCtx.Int64("cache-max-size")*1024*1024)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			served = cache
+		}
+		// Compressed above the cache, so that it keeps files compressed
+		if cCtx.Bool("compress") {
+			var options []storage.CompressedOptionFn
+			if types := cCtx.StringSlice("compress-types"); len(types) > 0 {
+				options = append(options, storage.CompressTypes(types))
+			}
+			served = storage.NewCompressedStorage(served, options...)
+		}
+		serverOptions = append(serverOptions, server.UseStorage(served))
 
 		srv := server.New(serverOptions...)
 		srv.Run()
 
+		waitForStorage(s)
+		if cache != nil {
+			stats := cache.Stats()
+			log.Printf("Download cache served %d hits and %d misses, evicted %d files", stats.Hits, stats.Misses, stats.Evictions)
+		}
+
 		return nil
 	},
 }
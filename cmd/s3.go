@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/exler/fileigloo/storage"
+	colors "github.com/logrusorgru/aurora/v4"
+	"github.com/urfave/cli/v2"
+)
+
+var s3Cmd = &cli.Command{
+	Name:  "s3",
+	Usage: "Manage S3 bucket configuration",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "setup-lifecycle",
+			Usage: "Install bucket lifecycle rules that expire tagged files",
+			Flags: s3Flags,
+			Action: func(cCtx *cli.Context) error {
+				s, err := getS3Storage(cCtx)
+				if err != nil {
+					return err
+				}
+
+				if err := s.SetupLifecycle(cCtx.Context); err != nil {
+					return err
+				}
+
+				fmt.Println(colors.Blue(fmt.Sprintf("Lifecycle rules installed [expiryDays=%v]", storage.S3ExpiryDays)))
+				return nil
+			},
+		},
+	},
+}
@@ -4,16 +4,11 @@ import (
 	"time"
 )
 
-// IsExpired checks if a file has expired based on its expiration timestamp
-func IsExpired(expiresAtStr string) bool {
-	if expiresAtStr == "" {
+// IsExpired checks if a file has expired based on its expiration time
+func IsExpired(expiresAt time.Time) bool {
+	if expiresAt.IsZero() {
 		return false // No expiration set
 	}
 
-	expiresAt, err := time.Parse(time.RFC3339, expiresAtStr)
-	if err != nil {
-		return false // Invalid timestamp, treat as not expired
-	}
-
 	return time.Now().After(expiresAt)
 }
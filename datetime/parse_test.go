@@ -2,34 +2,27 @@ package datetime_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/exler/fileigloo/datetime"
 )
 
-func TestStringExpired(t *testing.T) {
-	str := "2023-10-01T00:00:00Z"
-	if !datetime.IsExpired(str) {
-		t.Errorf("Expected %s to be expired", str)
+func TestTimeExpired(t *testing.T) {
+	expiresAt := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	if !datetime.IsExpired(expiresAt) {
+		t.Errorf("Expected %s to be expired", expiresAt)
 	}
 }
 
-func TestStringNotExpired(t *testing.T) {
-	str := "2099-10-01T12:00:00Z"
-	if datetime.IsExpired(str) {
-		t.Errorf("Expected %s to not be expired", str)
+func TestTimeNotExpired(t *testing.T) {
+	expiresAt := time.Date(2099, 10, 1, 12, 0, 0, 0, time.UTC)
+	if datetime.IsExpired(expiresAt) {
+		t.Errorf("Expected %s to not be expired", expiresAt)
 	}
 }
 
-func TestStringEmpty(t *testing.T) {
-	str := ""
-	if datetime.IsExpired(str) {
-		t.Errorf("Expected empty string to not be expired")
-	}
-}
-
-func TestStringInvalid(t *testing.T) {
-	str := "invalid-date"
-	if datetime.IsExpired(str) {
-		t.Errorf("Expected invalid date string to not be expired")
+func TestTimeZero(t *testing.T) {
+	if datetime.IsExpired(time.Time{}) {
+		t.Errorf("Expected zero time to not be expired")
 	}
 }
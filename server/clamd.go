@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/exler/fileigloo/logger"
+	"github.com/exler/fileigloo/storage"
+)
+
+type ClamdConfig struct {
+	// Address of clamd, either host:port or the path of a unix socket, optionally prefixed with tcp:// or unix://
+	Address string
+	// Timeout bounds connecting to clamd and every read and write of a scan. Defaults to 1 minute.
+	Timeout time.Duration
+	// Quarantine stores infected files, marked as quarantined, instead of rejecting them.
+	// Quarantined files are never served, they are kept to be reviewed.
+	Quarantine bool
+}
+
+type clamdScanner struct {
+	logger     *logger.Logger
+	network    string
+	address    string
+	timeout    time.Duration
+	quarantine bool
+}
+
+const (
+	defaultClamdTimeout = time.Minute
+
+	// clamdChunkSize is how much of the content is sent to clamd at once, clamd's default StreamMaxLength
+	// limits the whole stream and not the chunks
+	clamdChunkSize = 64 << 10
+)
+
+// errClamdSizeLimit is returned for content exceeding clamd's StreamMaxLength
+var errClamdSizeLimit = errors.New("clamd: INSTREAM size limit exceeded")
+
+// ScanWithClamd scans uploads for malware with clamd, using its INSTREAM command. Infected uploads are
+// rejected, or quarantined if configured, and uploads that cannot be scanned are rejected too.
+// The result is recorded in the metadata of stored files.
+func ScanWithClamd(config ClamdConfig) (UploadProcessor, error) {
+	network, address, err := parseClamdAddress(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &clamdScanner{
+		logger:     logger.NewLogger(),
+		network:    network,
+		address:    address,
+		timeout:    config.Timeout,
+		quarantine: config.Quarantine,
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultClamdTimeout
+	}
+	return p, nil
+}
+
+func parseClamdAddress(address string) (network, addr string, err error) {
+	switch {
+	case address == "":
+		return "", "", errors.New("clamd address is required")
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		addr = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	default:
+		addr = address
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid clamd address %s: %w", address, err)
+	}
+	return "tcp", addr, nil
+}
+
+func (p *clamdScanner) Process(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+	// The result is stored in the metadata, which some storages send before the content, so uploads are
+	// scanned as a whole first. Content that cannot be read again is spooled to a temporary file.
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := p.scan(ctx, content, io.Discard)
+		if err != nil {
+			return nil, p.scanFailed(err)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := p.record(signature, metadata); err != nil {
+			return nil, err
+		}
+		return content, nil
+	}
+
+	spool, err := os.CreateTemp("", "fileigloo-scan-")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.scan(ctx, content, spool)
+	if err != nil {
+		CleanTempFile(spool)
+		return nil, p.scanFailed(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		CleanTempFile(spool)
+		return nil, err
+	}
+	if err := p.record(signature, metadata); err != nil {
+		CleanTempFile(spool)
+		return nil, err
+	}
+	return &tempFileReader{spool}, nil
+}
+
+// record stores the result of the scan in the metadata, rejecting infected uploads unless they are quarantined
+func (p *clamdScanner) record(signature string, metadata *storage.Metadata) error {
+	if signature != "" && !p.quarantine {
+		return RejectUpload(http.StatusUnprocessableEntity, fmt.Sprintf("File is infected with %s", signature))
+	}
+
+	metadata.ScannedAt = time.Now().UTC()
+	if signature != "" {
+		metadata.ScanStatus = storage.ScanInfected
+		metadata.ScanSignature = signature
+	} else {
+		metadata.ScanStatus = storage.ScanClean
+	}
+	return nil
+}
+
+func (p *clamdScanner) scanFailed(err error) error {
+	var readErr *contentReadError
+	if errors.As(err, &readErr) {
+		// E.g. rejected by an earlier processor
+		return readErr.err
+	} else if errors.Is(err, errClamdSizeLimit) {
+		return RejectUpload(http.StatusRequestEntityTooLarge, "File is too big to be scanned for viruses")
+	}
+
+	p.logger.Error(fmt.Errorf("virus scan failed: %w", err))
+	return RejectUpload(http.StatusServiceUnavailable, "File could not be scanned for viruses, try again later")
+}
+
+// scan streams the content to clamd, copying it to w, and returns the name of the malware found, empty if none was
+func (p *clamdScanner) scan(ctx context.Context, content io.Reader, w io.Writer) (string, error) {
+	dialer := net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, p.network, p.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// Cancelling the upload interrupts the scan
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now()) //#nosec
+	})
+	defer stop()
+
+	if err := p.writeWithDeadline(conn, []byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := content.Read(chunk[4:])
+		if n > 0 {
+			if _, err := w.Write(chunk[4 : 4+n]); err != nil {
+				return "", err
+			}
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n)) //#nosec
+			if err := p.writeWithDeadline(conn, chunk[:4+n]); err != nil {
+				// clamd closes the connection once the stream exceeds its limit, replying why first
+				if reply, replyErr := p.readReply(conn); replyErr == nil {
+					return parseClamdReply(reply)
+				}
+				return "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return "", &contentReadError{readErr}
+		}
+	}
+
+	// A chunk of zero length ends the stream
+	if err := p.writeWithDeadline(conn, []byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	reply, err := p.readReply(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	return parseClamdReply(reply)
+}
+
+func (p *clamdScanner) writeWithDeadline(conn net.Conn, data []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(p.timeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// readReply reads the null-terminated reply of a command sent with the z prefix
+func (p *clamdScanner) readReply(conn net.Conn) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// parseClamdReply parses replies like "stream: OK" and "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.Contains(result, "size limit exceeded"):
+		return "", errClamdSizeLimit
+	default:
+		return "", fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// contentReadError is an error reading the content being scanned, rather than one of clamd
+type contentReadError struct {
+	err error
+}
+
+func (e *contentReadError) Error() string {
+	return e.err.Error()
+}
+
+// tempFileReader reads a temporary file, which is removed once it is closed
+type tempFileReader struct {
+	file *os.File
+}
+
+func (r *tempFileReader) Read(p []byte) (int, error) {
+	return r.file.Read(p)
+}
+
+func (r *tempFileReader) Close() error {
+	CleanTempFile(r.file)
+	return nil
+}
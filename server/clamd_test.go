@@ -0,0 +1,290 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/exler/fileigloo/server"
+	"github.com/exler/fileigloo/storage"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd speaks the INSTREAM command of clamd, finding the EICAR test string
+type fakeClamd struct {
+	listener net.Listener
+	// maxLength is the StreamMaxLength of clamd, unlimited if zero
+	maxLength int
+
+	mu      sync.Mutex
+	scanned [][]byte
+}
+
+func newFakeClamd(t *testing.T, network string, maxLength int) *fakeClamd {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		// Unix socket paths are limited to about 100 characters, which test directories can exceed
+		dir, err := os.MkdirTemp("", "clamd")
+		if err != nil {
+			t.Fatalf("Failed to create socket directory: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		address = filepath.Join(dir, "clamd.sock")
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{listener: listener, maxLength: maxLength}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.handle(conn)
+		}
+	}()
+	return clamd
+}
+
+func (c *fakeClamd) address() string {
+	if c.listener.Addr().Network() == "unix" {
+		return "unix://" + c.listener.Addr().String()
+	}
+	return c.listener.Addr().String()
+}
+
+func (c *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream []byte
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length == 0 {
+			break
+		}
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return
+		}
+		stream = append(stream, chunk...)
+		if c.maxLength > 0 && len(stream) > c.maxLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.scanned = append(c.scanned, stream)
+	c.mu.Unlock()
+
+	if bytes.Contains(stream, []byte(eicar)) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+func (c *fakeClamd) scans() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.scanned...)
+}
+
+func newClamdScanner(t *testing.T, config server.ClamdConfig) server.UploadProcessor {
+	t.Helper()
+
+	scanner, err := server.ScanWithClamd(config)
+	if err != nil {
+		t.Fatalf("Failed to create clamd scanner: %v", err)
+	}
+	return scanner
+}
+
+func TestScanWithClamd(t *testing.T) {
+	t.Run("stores clean files with the scan result", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 0)
+		ts, memoryStorage := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: clamd.address()}))
+
+		resp, fileId := uploadFile(t, ts, "text/plain", []byte("Hello, World!"), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		content, metadata := getStored(t, memoryStorage, fileId)
+		if string(content) != "Hello, World!" {
+			t.Errorf("Expected uploaded content, got %q", content)
+		}
+		if metadata.ScanStatus != storage.ScanClean || metadata.ScannedAt.IsZero() {
+			t.Errorf("Expected clean scan result, got %q at %s", metadata.ScanStatus, metadata.ScannedAt)
+		}
+		if scans := clamd.scans(); len(scans) != 1 || string(scans[0]) != "Hello, World!" {
+			t.Errorf("Expected content to be scanned, got %q", scans)
+		}
+	})
+
+	t.Run("rejects infected files", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 0)
+		ts, memoryStorage := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: clamd.address()}))
+
+		resp := postForm(t, ts, map[string]string{"text": eicar})
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected status 422, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(string(body), "Eicar-Test-Signature") {
+			t.Errorf("Expected the malware found in the response, got %q", body)
+		}
+		if files := collectFiles(t, memoryStorage, storage.ListOptions{}); len(files) != 0 {
+			t.Errorf("Expected no stored files, got %v", files)
+		}
+	})
+
+	t.Run("quarantines infected files", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 0)
+		ts, memoryStorage := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: clamd.address(), Quarantine: true}))
+
+		resp, _ := uploadFile(t, ts, "text/plain", []byte(eicar), nil)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected status 422, got %d", resp.StatusCode)
+		}
+
+		files := collectFiles(t, memoryStorage, storage.ListOptions{QuarantinedOnly: true})
+		if len(files) != 1 {
+			t.Fatalf("Expected 1 quarantined file, got %v", files)
+		}
+		_, metadata := getStored(t, memoryStorage, files[0])
+		if metadata.ScanStatus != storage.ScanInfected || metadata.ScanSignature != "Eicar-Test-Signature" {
+			t.Errorf("Expected infected scan result, got %q (%s)", metadata.ScanStatus, metadata.ScanSignature)
+		}
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + files[0])
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		body, _ := io.ReadAll(downloadResp.Body)
+		downloadResp.Body.Close()
+		if downloadResp.StatusCode != http.StatusForbidden || strings.Contains(string(body), "EICAR") {
+			t.Errorf("Expected quarantined file not to be served, got %d: %q", downloadResp.StatusCode, body)
+		}
+	})
+
+	t.Run("does not read quarantined files into the download cache", func(t *testing.T) {
+		memoryStorage, _ := storage.NewMemoryStorage(0)
+		cachedStorage, err := storage.NewCachedStorage(context.Background(), memoryStorage, t.TempDir(), 1024)
+		if err != nil {
+			t.Fatalf("Failed to create cached storage: %v", err)
+		}
+		metadata := storage.Metadata{Filename: "eicar.txt", ScanStatus: storage.ScanInfected, ScanSignature: "Eicar-Test-Signature"}
+		if err := memoryStorage.Put(context.Background(), "infected", strings.NewReader(eicar), metadata); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		ts := httptest.NewServer(server.New(server.UseStorage(cachedStorage), server.MaxRequests(100)).GetRouter())
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + "/download/infected")
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", resp.StatusCode)
+		}
+		if stats := cachedStorage.Stats(); stats.Files != 0 || stats.Misses != 0 {
+			t.Errorf("Expected quarantined file not to be read, got %+v", stats)
+		}
+	})
+
+	t.Run("scans content processed by earlier processors", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 0)
+		ts, memoryStorage := setupProcessingServer(t, server.SniffContentType(nil), newClamdScanner(t, server.ClamdConfig{Address: clamd.address()}))
+
+		// Larger than a chunk sent to clamd
+		large := bytes.Repeat([]byte("fileigloo "), 20000)
+		resp, fileId := uploadFile(t, ts, "", large, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		content, metadata := getStored(t, memoryStorage, fileId)
+		if !bytes.Equal(content, large) {
+			t.Errorf("Expected uploaded content of %d bytes, got %d bytes", len(large), len(content))
+		}
+		if metadata.ScanStatus != storage.ScanClean {
+			t.Errorf("Expected clean scan result, got %q", metadata.ScanStatus)
+		}
+		if scans := clamd.scans(); len(scans) != 1 || !bytes.Equal(scans[0], large) {
+			t.Errorf("Expected whole content to be scanned")
+		}
+	})
+
+	t.Run("connects over unix sockets", func(t *testing.T) {
+		clamd := newFakeClamd(t, "unix", 0)
+		ts, _ := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: clamd.address()}))
+
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte(eicar), nil); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("rejects files too big to be scanned", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 1024)
+		ts, memoryStorage := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: clamd.address()}))
+
+		if resp, _ := uploadFile(t, ts, "text/plain", bytes.Repeat([]byte("a"), 200000), nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+		if files := collectFiles(t, memoryStorage, storage.ListOptions{}); len(files) != 0 {
+			t.Errorf("Expected no stored files, got %v", files)
+		}
+	})
+
+	t.Run("rejects files when clamd is unavailable", func(t *testing.T) {
+		clamd := newFakeClamd(t, "tcp", 0)
+		address := clamd.address()
+		clamd.listener.Close()
+		ts, memoryStorage := setupProcessingServer(t, newClamdScanner(t, server.ClamdConfig{Address: address}))
+
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte("Hello, World!"), nil); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", resp.StatusCode)
+		}
+		if files := collectFiles(t, memoryStorage, storage.ListOptions{}); len(files) != 0 {
+			t.Errorf("Expected no stored files, got %v", files)
+		}
+	})
+
+	t.Run("rejects invalid addresses", func(t *testing.T) {
+		for _, address := range []string{"", "localhost", "tcp://localhost"} {
+			if _, err := server.ScanWithClamd(server.ClamdConfig{Address: address}); err == nil {
+				t.Errorf("Expected error for address %q", address)
+			}
+		}
+	})
+}
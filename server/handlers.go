@@ -2,7 +2,9 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -13,22 +15,55 @@ import (
 	"strings"
 	"time"
 
-	"github.com/exler/fileigloo/datetime"
 	"github.com/exler/fileigloo/random"
 	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type FileUploadResponse struct {
-	FileId  string `json:"fileId"`
-	FileUrl string `json:"fileUrl"`
+	FileId  string            `json:"fileId"`
+	FileUrl string            `json:"fileUrl"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type PresignedUploadPart struct {
+	PartNumber int    `json:"partNumber"`
+	Url        string `json:"url"`
+	Size       int64  `json:"size"`
+}
+
+type PresignedUploadResponse struct {
+	FileId string `json:"fileId"`
+	// UploadUrl is set for uploads with a single PUT request, Parts for multipart uploads
+	UploadUrl string `json:"uploadUrl,omitempty"`
+	// UploadHeaders must be sent with the request to UploadUrl
+	UploadHeaders map[string]string     `json:"uploadHeaders,omitempty"`
+	Parts         []PresignedUploadPart `json:"parts,omitempty"`
+	CompleteUrl   string                `json:"completeUrl"`
+	ExpiresAt     string                `json:"expiresAt"`
 }
 
 func generateFileId() string {
 	return random.String(12)
 }
 
+// newFileId returns a random ID that is neither used by a stored file nor reserved for a presigned upload
+func (s *Server) newFileId(ctx context.Context) (string, error) {
+	for {
+		fileId := generateFileId()
+		_, err := s.storage.GetOnlyMetadata(ctx, fileId)
+		if err == nil || s.pendingUploads.has(fileId) {
+			continue
+		} else if !s.storage.FileNotExists(err) {
+			return "", err
+		}
+		return fileId, nil
+	}
+}
+
 func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/file", http.StatusTemporaryRedirect)
 }
@@ -156,12 +191,25 @@ func (s *Server) fileUploadHandler(w http.ResponseWriter, r *http.Request) {
 	expirationHours := ParseExpirationHours(r.FormValue("expiration"))
 	expirationTime := CalculateExpirationTime(expirationHours)
 
-	var fileId string
-	for {
-		fileId = generateFileId()
-		if _, err = s.storage.Get(r.Context(), fileId); s.storage.FileNotExists(err) {
-			break
-		}
+	// Get optional expected checksum
+	checksum, err := ParseChecksum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get optional labels
+	labels, err := ParseLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileId, err := s.newFileId(r.Context())
+	if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	// Hash password if provided
@@ -173,26 +221,30 @@ func (s *Server) fileUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	metadata := storage.Metadata{
-		Filename:      fileName,
-		ContentType:   contentType,
-		ContentLength: strconv.FormatInt(contentLength, 10),
-		PasswordHash:  passwordHash,
-		ExpiresAt:     expirationTime,
+		Filename:       fileName,
+		ContentType:    contentType,
+		ContentLength:  contentLength,
+		PasswordHash:   passwordHash,
+		ExpiresAt:      expirationTime,
+		Checksum:       checksum,
+		CreatedAt:      time.Now().UTC(),
+		UploaderIPHash: HashIP(r.RemoteAddr, s.ipHashKey),
+		Labels:         labels,
 	}
-	if err = s.storage.Put(r.Context(), fileId, file, metadata); err != nil {
-		s.logger.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if err := s.storeUpload(r.Context(), fileId, file, &metadata); err != nil {
+		s.writeUploadError(w, err)
 		return
 	}
 
 	var fileUrl *url.URL
-	if ShowInline(contentType) {
+	if ShowInline(metadata.ContentType) {
 		fileUrl = BuildURL(r, "view", fileId)
 	} else {
 		fileUrl = BuildURL(r, "download", fileId)
 	}
 
 	s.logger.Info(fmt.Sprintf("New file uploaded [url=%s]", fileUrl))
+	s.emit(webhooks.EventFileUploaded, fileId, fileUrl, metadata)
 
 	// Check if client wants JSON response
 	acceptHeader := r.Header.Get("Accept")
@@ -200,6 +252,7 @@ func (s *Server) fileUploadHandler(w http.ResponseWriter, r *http.Request) {
 		response := FileUploadResponse{
 			FileId:  fileId,
 			FileUrl: fileUrl.String(),
+			Labels:  labels,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -244,12 +297,25 @@ func (s *Server) pastebinHandler(w http.ResponseWriter, r *http.Request) {
 	expirationHours := ParseExpirationHours(r.FormValue("expiration"))
 	expirationTime := CalculateExpirationTime(expirationHours)
 
-	var fileId string
-	for {
-		fileId = generateFileId()
-		if _, err := s.storage.Get(r.Context(), fileId); s.storage.FileNotExists(err) {
-			break
-		}
+	// Get optional expected checksum
+	checksum, err := ParseChecksum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get optional labels
+	labels, err := ParseLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileId, err := s.newFileId(r.Context())
+	if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	// Hash password if provided
@@ -261,21 +327,25 @@ func (s *Server) pastebinHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	metadata := storage.Metadata{
-		Filename:      fileName,
-		ContentType:   contentType,
-		ContentLength: strconv.FormatInt(contentLength, 10),
-		PasswordHash:  passwordHash,
-		ExpiresAt:     expirationTime,
+		Filename:       fileName,
+		ContentType:    contentType,
+		ContentLength:  contentLength,
+		PasswordHash:   passwordHash,
+		ExpiresAt:      expirationTime,
+		Checksum:       checksum,
+		CreatedAt:      time.Now().UTC(),
+		UploaderIPHash: HashIP(r.RemoteAddr, s.ipHashKey),
+		Labels:         labels,
 	}
-	if err := s.storage.Put(r.Context(), fileId, file, metadata); err != nil {
-		s.logger.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if err := s.storeUpload(r.Context(), fileId, file, &metadata); err != nil {
+		s.writeUploadError(w, err)
 		return
 	}
 
 	fileUrl := BuildURL(r, "view", fileId)
 
 	s.logger.Info(fmt.Sprintf("New file uploaded [url=%s]", fileUrl))
+	s.emit(webhooks.EventFileUploaded, fileId, fileUrl, metadata)
 
 	// Check if client wants JSON response
 	acceptHeader := r.Header.Get("Accept")
@@ -283,6 +353,7 @@ func (s *Server) pastebinHandler(w http.ResponseWriter, r *http.Request) {
 		response := FileUploadResponse{
 			FileId:  fileId,
 			FileUrl: fileUrl.String(),
+			Labels:  labels,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -301,10 +372,214 @@ func (s *Server) pastebinHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) presignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	presigner := s.storage.(storage.UploadPresigner)
+
+	s.logger.Debug(fmt.Sprintf("Presigned upload request [client_ip=%s]", r.RemoteAddr))
+
+	fileName := r.FormValue("filename")
+	if fileName == "" {
+		http.Error(w, "Must provide filename argument", http.StatusBadRequest)
+		return
+	}
+	fileName = SanitizeFilename(fileName)
+
+	contentLength, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || contentLength <= 0 {
+		http.Error(w, "Must provide file size in bytes", http.StatusBadRequest)
+		return
+	}
+
+	if s.maxUploadSize > 0 && contentLength > s.maxUploadSize {
+		http.Error(w, fmt.Sprintf("File is too big! Max upload size: %dMB", s.maxUploadSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := r.FormValue("contentType")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Get optional password
+	password := r.FormValue("password")
+
+	// Get optional expiration in hours (1-24)
+	expirationHours := ParseExpirationHours(r.FormValue("expiration"))
+	expirationTime := CalculateExpirationTime(expirationHours)
+
+	// The content does not pass through the server, so the storage verifies it against the checksum
+	checksum, err := ParseChecksum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if checksum == "" {
+		http.Error(w, "Must provide the SHA-256 checksum of the file", http.StatusBadRequest)
+		return
+	}
+
+	// Get optional labels
+	labels, err := ParseLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reservations whose URLs expired will never be completed
+	for fileId, pending := range s.pendingUploads.removeExpired() {
+		go presigner.AbortUpload(context.Background(), fileId, pending.uploadID) //#nosec
+	}
+
+	fileId, err := s.newFileId(r.Context())
+	if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Hash password if provided
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	upload, err := presigner.PresignUpload(r.Context(), fileId, storage.PresignUploadOptions{
+		Expiry:   s.presignedUploadExpiry,
+		Size:     contentLength,
+		Checksum: checksum,
+	})
+	if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(s.presignedUploadExpiry)
+	s.pendingUploads.add(fileId, pendingUpload{
+		uploadID: upload.UploadID,
+		metadata: storage.Metadata{
+			Filename:       fileName,
+			ContentType:    contentType,
+			ContentLength:  contentLength,
+			PasswordHash:   passwordHash,
+			ExpiresAt:      expirationTime,
+			Checksum:       checksum,
+			CreatedAt:      time.Now().UTC(),
+			UploaderIPHash: HashIP(r.RemoteAddr, s.ipHashKey),
+			Labels:         labels,
+		},
+		expiresAt: expiresAt,
+	})
+
+	response := PresignedUploadResponse{
+		FileId:        fileId,
+		UploadUrl:     upload.URL,
+		UploadHeaders: upload.Headers,
+		CompleteUrl:   BuildURL(r, "api", "uploads", fileId, "complete").String(),
+		ExpiresAt:     expiresAt.Format(time.RFC3339),
+	}
+	for _, part := range upload.Parts {
+		response.Parts = append(response.Parts, PresignedUploadPart{
+			PartNumber: part.Number,
+			Url:        part.URL,
+			Size:       part.Size,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) completeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	presigner := s.storage.(storage.UploadPresigner)
+	fileId := SanitizeFilename(chi.URLParam(r, "fileId"))
+
+	// The upload stays pending until it is completed, so that failed completions can be retried
+	pending, ok := s.pendingUploads.get(fileId)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// ETags of the uploaded parts in order, not needed for single request uploads
+	etags := r.Form["etag"]
+
+	err := presigner.CompleteUpload(r.Context(), fileId, pending.uploadID, etags, pending.metadata)
+	if errors.Is(err, storage.ErrUploadSizeMismatch) {
+		http.Error(w, "Uploaded file does not match the declared size", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, storage.ErrChecksumMismatch) {
+		http.Error(w, "File does not match the expected checksum", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, storage.ErrMetadataTooLarge) {
+		http.Error(w, "File details are too large for the storage, use fewer or shorter labels", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s.pendingUploads.remove(fileId)
+
+	var fileUrl *url.URL
+	if ShowInline(pending.metadata.ContentType) {
+		fileUrl = BuildURL(r, "view", fileId)
+	} else {
+		fileUrl = BuildURL(r, "download", fileId)
+	}
+
+	s.logger.Info(fmt.Sprintf("New file uploaded [url=%s]", fileUrl))
+	s.emit(webhooks.EventFileUploaded, fileId, fileUrl, pending.metadata)
+
+	response := FileUploadResponse{
+		FileId:  fileId,
+		FileUrl: fileUrl.String(),
+		Labels:  pending.metadata.Labels,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) abortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	presigner := s.storage.(storage.UploadPresigner)
+	fileId := SanitizeFilename(chi.URLParam(r, "fileId"))
+
+	pending, ok := s.pendingUploads.take(fileId)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if err := presigner.AbortUpload(r.Context(), fileId, pending.uploadID); err != nil {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 	fileId := SanitizeFilename(chi.URLParam(r, "fileId"))
 
-	reader, metadata, err := s.storage.GetWithMetadata(r.Context(), fileId)
+	// The metadata is checked before the content is opened, so that files which are not served,
+	// e.g. quarantined ones, are never read, nor copied into the download cache
+	metadata, err := s.storage.GetOnlyMetadata(r.Context(), fileId)
 	if s.storage.FileNotExists(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -313,14 +588,18 @@ func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	defer reader.Close()
 
 	// Check if file has expired
-	if datetime.IsExpired(metadata.ExpiresAt) {
+	if metadata.IsExpired() {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
+	if metadata.IsQuarantined() {
+		http.Error(w, "File was quarantined because malware was found in it", http.StatusForbidden)
+		return
+	}
+
 	// Check if file is password protected
 	if metadata.PasswordHash != "" {
 		// Check if password is provided in form data
@@ -350,6 +629,32 @@ func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Presigned downloads only need the metadata, the content is served by the storage.
+	// Encoded files are served here, as the storage would not send their Content-Encoding.
+	presigner, presign := s.storage.(storage.DownloadPresigner)
+	presign = presign && s.presignedDownloadExpiry > 0 && metadata.ContentEncoding == ""
+
+	var reader io.ReadCloser
+	if !presign {
+		if getter, ok := s.storage.(storage.EncodedGetter); ok {
+			// Compressed files are sent as they are stored to clients that can decompress them
+			reader, metadata, err = getter.GetEncoded(r.Context(), fileId, func(encoding string) bool {
+				return AcceptsEncoding(r.Header, encoding)
+			})
+		} else {
+			reader, metadata, err = s.storage.GetWithMetadata(r.Context(), fileId)
+		}
+		if s.storage.FileNotExists(err) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			s.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+	}
+
 	var fileDisposition string
 	if chi.URLParam(r, "action") == "view" {
 		fileDisposition = "inline"
@@ -360,9 +665,45 @@ func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 		fileDisposition = "attachment"
 	}
 
+	contentDisposition := fmt.Sprintf("%s; filename=%s", fileDisposition, metadata.Filename)
+
+	if presign {
+		presignedURL, err := presigner.PresignDownload(r.Context(), fileId, storage.PresignDownloadOptions{
+			Expiry:             s.presignedDownloadExpiry,
+			ContentType:        metadata.ContentType,
+			ContentDisposition: contentDisposition,
+		})
+		if err != nil {
+			s.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// The URL must not outlive its signature in any cache
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, presignedURL, http.StatusSeeOther)
+		s.emit(webhooks.EventFileDownloaded, fileId, BuildURL(r, chi.URLParam(r, "action"), fileId), metadata)
+		return
+	}
+
 	w.Header().Set("Content-Type", metadata.ContentType)
-	w.Header().Set("Content-Length", metadata.ContentLength)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", fileDisposition, metadata.Filename))
+	w.Header().Set("Content-Disposition", contentDisposition)
+	if metadata.ContentEncoding != "" {
+		// The checksum and size are of the decoded content, so they only identify the encoded one
+		w.Header().Set("Content-Encoding", metadata.ContentEncoding)
+		w.Header().Set("Vary", "Accept-Encoding")
+		if metadata.Checksum != "" {
+			w.Header().Set("ETag", strconv.Quote(metadata.Checksum+"-"+metadata.ContentEncoding))
+		}
+	} else {
+		if metadata.ContentLength > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(metadata.ContentLength, 10))
+		}
+		if metadata.Checksum != "" {
+			w.Header().Set("Digest", DigestHeader(metadata.Checksum))
+			w.Header().Set("ETag", strconv.Quote(metadata.Checksum))
+		}
+	}
 
 	// Obtain FileSeeker
 	file, err := os.CreateTemp("", "fileigloo-get-")
@@ -380,5 +721,49 @@ func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeContent(w, r, metadata.Filename, time.Now(), file)
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	http.ServeContent(ww, r, metadata.Filename, time.Now(), file)
+
+	// Revalidations and range requests, e.g. of a video being played, are not counted as downloads
+	if ww.Status() == http.StatusOK {
+		s.emit(webhooks.EventFileDownloaded, fileId, BuildURL(r, chi.URLParam(r, "action"), fileId), metadata)
+	}
+}
+
+// readinessTimeout bounds how long the readiness probe waits for the storage
+const readinessTimeout = 5 * time.Second
+
+// livenessHandler reports that the server is running, regardless of the storage
+func (s *Server) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readinessHandler reports whether the server can handle uploads and downloads: the storage
+// has to pass its health check and, if it is kept on a local disk, have enough free space
+func (s *Server) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := storage.CheckHealth(ctx, s.storage); err != nil {
+		s.logger.Error(fmt.Errorf("storage health check failed: %w", err))
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.readyMinFreeSpace > 0 {
+		free, err := storage.FreeSpace(s.storage)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			s.logger.Error(fmt.Errorf("storage free space check failed: %w", err))
+			http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+			return
+		} else if err == nil && free < s.readyMinFreeSpace {
+			http.Error(w, "insufficient free space", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "ok")
 }
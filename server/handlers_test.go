@@ -2,21 +2,35 @@ package server_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
+	"maps"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/exler/fileigloo/server"
 	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/storage/storagetest"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/klauspost/compress/zstd"
 )
 
-func setupTestServer(t *testing.T, maxUploadSizeMB ...int64) (*httptest.Server, *storage.LocalStorage) {
+func setupTestServer(t *testing.T, maxUploadSizeMB ...int64) (*httptest.Server, *storage.MemoryStorage) {
 	t.Helper()
 
 	// Default max upload size is 10MB
@@ -25,22 +39,14 @@ func setupTestServer(t *testing.T, maxUploadSizeMB ...int64) (*httptest.Server,
 		maxUploadSize = maxUploadSizeMB[0]
 	}
 
-	// Create temporary directory for test storage
-	tmpDir, err := os.MkdirTemp("", "fileigloo-test-*")
+	memoryStorage, err := storage.NewMemoryStorage(0)
 	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	t.Cleanup(func() { os.RemoveAll(tmpDir) })
-
-	// Create local storage
-	localStorage, err := storage.NewLocalStorage(tmpDir)
-	if err != nil {
-		t.Fatalf("Failed to create local storage: %v", err)
+		t.Fatalf("Failed to create memory storage: %v", err)
 	}
 
 	// Create server instance
 	srv := server.New(
-		server.UseStorage(localStorage),
+		server.UseStorage(memoryStorage),
 		server.MaxUploadSize(maxUploadSize),
 		server.MaxRequests(100),
 		server.Port(0), // Use random port
@@ -50,7 +56,7 @@ func setupTestServer(t *testing.T, maxUploadSizeMB ...int64) (*httptest.Server,
 	testServer := httptest.NewServer(srv.GetRouter())
 	t.Cleanup(testServer.Close)
 
-	return testServer, localStorage
+	return testServer, memoryStorage
 }
 
 func TestFileUploadHandler(t *testing.T) {
@@ -160,6 +166,50 @@ func TestFileUploadHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("records upload metadata", func(t *testing.T) {
+		ts, memoryStorage := setupTestServer(t)
+
+		formData := url.Values{}
+		formData.Set("text", "Hello, World!")
+		formData.Set("expiration", "12")
+
+		req, err := http.NewRequest("POST", ts.URL+"/", strings.NewReader(formData.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+
+		before := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var uploadResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+
+		metadata, err := memoryStorage.GetOnlyMetadata(context.Background(), uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.ContentLength != 13 {
+			t.Errorf("Expected content length 13, got %d", metadata.ContentLength)
+		}
+		if expected := before.Add(12 * time.Hour); metadata.ExpiresAt.Before(expected.Add(-time.Minute)) || metadata.ExpiresAt.After(expected.Add(time.Minute)) {
+			t.Errorf("Expected expiration in 12 hours, got %s", metadata.ExpiresAt)
+		}
+		if metadata.CreatedAt.Before(before.Add(-time.Minute)) {
+			t.Errorf("Expected creation time to be recorded, got %s", metadata.CreatedAt)
+		}
+		if metadata.UploaderIPHash == "" || strings.Contains(metadata.UploaderIPHash, "127.0.0.1") {
+			t.Errorf("Expected hashed uploader IP, got %q", metadata.UploaderIPHash)
+		}
+	})
+
 	t.Run("reject both file and text", func(t *testing.T) {
 		ts, _ := setupTestServer(t)
 
@@ -360,6 +410,50 @@ func TestFileUploadHandler(t *testing.T) {
 			t.Error("Last 1KB of downloaded content doesn't match uploaded content")
 		}
 	})
+
+	t.Run("file too big for storage", func(t *testing.T) {
+		memoryStorage, _ := storage.NewMemoryStorage(5)
+		ts := httptest.NewServer(server.New(server.UseStorage(memoryStorage), server.MaxRequests(100)).GetRouter())
+		defer ts.Close()
+
+		formData := url.Values{}
+		formData.Set("text", "More than five bytes")
+
+		resp, err := http.PostForm(ts.URL+"/", formData)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("storage out of disk space", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("Free space is not supported on this platform")
+		}
+		localStorage, err := storage.NewLocalStorage(t.TempDir(), storage.MinFreeSpace(math.MaxUint64))
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+		ts := httptest.NewServer(server.New(server.UseStorage(localStorage), server.MaxRequests(100)).GetRouter())
+		defer ts.Close()
+
+		formData := url.Values{}
+		formData.Set("text", "Hello, World!")
+
+		resp, err := http.PostForm(ts.URL+"/", formData)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInsufficientStorage {
+			t.Errorf("Expected status 507, got %d", resp.StatusCode)
+		}
+	})
 }
 
 func TestDownloadHandler(t *testing.T) {
@@ -658,3 +752,915 @@ func TestDownloadHandler(t *testing.T) {
 		}
 	})
 }
+
+func setupS3TestServer(t *testing.T, options ...server.OptionFn) *httptest.Server {
+	t.Helper()
+
+	return setupTestServerWith(t, newS3TestStorage(t), options...)
+}
+
+// newS3TestStorage creates an S3 storage backed by a fake S3 server, wrapped in the middleware if given
+func newS3TestStorage(t *testing.T, middleware ...func(http.Handler) http.Handler) *storage.S3Storage {
+	t.Helper()
+
+	backend := s3mem.New()
+	if err := backend.CreateBucket("fileigloo-test"); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	handler := storagetest.S3Checksums(gofakes3.New(backend).Server())
+	for _, m := range middleware {
+		handler = m(handler)
+	}
+	s3Server := httptest.NewServer(handler)
+	t.Cleanup(s3Server.Close)
+
+	s3Storage, err := storage.NewS3Storage(context.Background(), storage.S3Config{
+		Bucket:       "fileigloo-test",
+		Region:       "us-east-1",
+		EndpointURL:  s3Server.URL,
+		AccessKey:    "access-key",
+		SecretKey:    "secret-key",
+		UsePathStyle: true,
+		// The minimum part size allowed by S3
+		PresignedPartSize: 5 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create S3 storage: %v", err)
+	}
+	return s3Storage
+}
+
+func setupTestServerWith(t *testing.T, s storage.Storage, options ...server.OptionFn) *httptest.Server {
+	t.Helper()
+
+	srv := server.New(append([]server.OptionFn{
+		server.UseStorage(s),
+		server.MaxRequests(100),
+	}, options...)...)
+
+	testServer := httptest.NewServer(srv.GetRouter())
+	t.Cleanup(testServer.Close)
+
+	return testServer
+}
+
+func TestPresignedDownloads(t *testing.T) {
+	noRedirectClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	uploadFile := func(t *testing.T, ts *httptest.Server, password string) server.FileUploadResponse {
+		t.Helper()
+
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		fileField, err := writer.CreateFormFile("file", "test.txt")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		fileField.Write([]byte("Presigned content"))
+		if password != "" {
+			writer.WriteField("password", password)
+		}
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/", &buf)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var uploadResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+		return uploadResp
+	}
+
+	t.Run("redirects download to presigned URL", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedDownloads(5*time.Minute))
+		uploadResp := uploadFile(t, ts, "")
+
+		downloadURL := strings.Replace(uploadResp.FileUrl, "/view/", "/download/", 1)
+		resp, err := noRedirectClient.Get(downloadURL)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("Expected status 303, got %d", resp.StatusCode)
+		}
+
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatalf("Failed to parse Location: %v", err)
+		}
+		query := location.Query()
+		if query.Get("X-Amz-Signature") == "" {
+			t.Errorf("Expected signed URL, got %s", location)
+		}
+		if disposition := query.Get("response-content-disposition"); disposition != "attachment; filename=test.txt" {
+			t.Errorf("Expected attachment disposition override, got '%s'", disposition)
+		}
+		if query.Get("X-Amz-Expires") != "300" {
+			t.Errorf("Expected URL to expire in 300 seconds, got '%s'", query.Get("X-Amz-Expires"))
+		}
+
+		// The presigned URL serves the content straight from the bucket
+		contentResp, err := http.Get(location.String())
+		if err != nil {
+			t.Fatalf("Failed to fetch presigned URL: %v", err)
+		}
+		defer contentResp.Body.Close()
+
+		content, _ := io.ReadAll(contentResp.Body)
+		if string(content) != "Presigned content" {
+			t.Errorf("Expected content 'Presigned content', got '%s'", string(content))
+		}
+	})
+
+	t.Run("serves encoded files without redirecting", func(t *testing.T) {
+		s3Storage := newS3TestStorage(t)
+		// Stored compressed, e.g. while compression was enabled
+		compressed := storage.NewCompressedStorage(s3Storage)
+		if err := compressed.Put(context.Background(), "encoded", strings.NewReader("Presigned content"), storage.Metadata{
+			Filename:    "test.txt",
+			ContentType: "text/plain",
+		}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		ts := setupTestServerWith(t, s3Storage, server.PresignedDownloads(5*time.Minute))
+		resp, err := noRedirectClient.Get(ts.URL + "/download/encoded")
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != storage.EncodingZstd {
+			t.Errorf("Expected Content-Encoding %s, got '%s'", storage.EncodingZstd, encoding)
+		}
+	})
+
+	t.Run("requires password before redirecting", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedDownloads(5*time.Minute))
+		uploadResp := uploadFile(t, ts, "secret123")
+
+		resp, err := noRedirectClient.Get(uploadResp.FileUrl)
+		if err != nil {
+			t.Fatalf("Failed to make view request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 (password form), got %d", resp.StatusCode)
+		}
+
+		formData := url.Values{}
+		formData.Set("password", "secret123")
+		resp, err = noRedirectClient.PostForm(uploadResp.FileUrl, formData)
+		if err != nil {
+			t.Fatalf("Failed to make POST request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("Expected status 303, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestPresignedUploads(t *testing.T) {
+	reserveUpload := func(t *testing.T, ts *httptest.Server, size int, content []byte) server.PresignedUploadResponse {
+		t.Helper()
+
+		checksum := sha256.Sum256(content)
+		formData := url.Values{}
+		formData.Set("filename", "direct.bin")
+		formData.Set("size", strconv.Itoa(size))
+		formData.Set("password", "secret123")
+		formData.Set("checksum", hex.EncodeToString(checksum[:]))
+
+		resp, err := http.PostForm(ts.URL+"/api/uploads", formData)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		var uploadResp server.PresignedUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+		return uploadResp
+	}
+
+	putContent := func(t *testing.T, uploadURL string, headers map[string]string, content []byte) string {
+		t.Helper()
+
+		req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to upload content: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected upload status 200, got %d", resp.StatusCode)
+		}
+		return resp.Header.Get("ETag")
+	}
+
+	completeUpload := func(t *testing.T, completeURL string, etags ...string) *http.Response {
+		t.Helper()
+
+		resp, err := http.PostForm(completeURL, url.Values{"etag": etags})
+		if err != nil {
+			t.Fatalf("Failed to complete upload: %v", err)
+		}
+		return resp
+	}
+
+	downloadContent := func(t *testing.T, fileUrl string) []byte {
+		t.Helper()
+
+		formData := url.Values{}
+		formData.Set("password", "secret123")
+		resp, err := http.PostForm(fileUrl, formData)
+		if err != nil {
+			t.Fatalf("Failed to download file: %v", err)
+		}
+		defer resp.Body.Close()
+
+		content, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read downloaded content: %v", err)
+		}
+		return content
+	}
+
+	t.Run("single request upload", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+		content := []byte("Uploaded directly to the bucket")
+
+		uploadResp := reserveUpload(t, ts, len(content), content)
+		if uploadResp.UploadUrl == "" || len(uploadResp.Parts) != 0 {
+			t.Fatalf("Expected single request upload, got %+v", uploadResp)
+		}
+
+		putContent(t, uploadResp.UploadUrl, uploadResp.UploadHeaders, content)
+
+		resp := completeUpload(t, uploadResp.CompleteUrl)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		var fileResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+		if fileResp.FileId != uploadResp.FileId {
+			t.Errorf("Expected file ID %s, got %s", uploadResp.FileId, fileResp.FileId)
+		}
+
+		if downloaded := downloadContent(t, fileResp.FileUrl); !bytes.Equal(downloaded, content) {
+			t.Errorf("Expected content '%s', got '%s'", content, downloaded)
+		}
+	})
+
+	t.Run("multipart upload", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+		content := bytes.Repeat([]byte("0123456789"), 600*1024) // 6000KB, two parts
+
+		uploadResp := reserveUpload(t, ts, len(content), content)
+		if len(uploadResp.Parts) != 2 {
+			t.Fatalf("Expected 2 parts, got %+v", uploadResp.Parts)
+		}
+
+		var etags []string
+		offset := int64(0)
+		for _, part := range uploadResp.Parts {
+			etags = append(etags, putContent(t, part.Url, nil, content[offset:offset+part.Size]))
+			offset += part.Size
+		}
+
+		resp := completeUpload(t, uploadResp.CompleteUrl, etags...)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, body)
+		}
+
+		var fileResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+
+		if downloaded := downloadContent(t, fileResp.FileUrl); !bytes.Equal(downloaded, content) {
+			t.Errorf("Downloaded content doesn't match uploaded content")
+		}
+	})
+
+	t.Run("rejects size mismatch", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+
+		content := []byte("more than declared")
+		uploadResp := reserveUpload(t, ts, 5, content)
+		putContent(t, uploadResp.UploadUrl, uploadResp.UploadHeaders, content)
+
+		resp := completeUpload(t, uploadResp.CompleteUrl)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		downloadResp.Body.Close()
+		if downloadResp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected rejected upload to be removed, got status %d", downloadResp.StatusCode)
+		}
+	})
+
+	t.Run("does not serve uploads before they are completed", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+		content := []byte("Not completed yet")
+
+		uploadResp := reserveUpload(t, ts, len(content), content)
+		putContent(t, uploadResp.UploadUrl, uploadResp.UploadHeaders, content)
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		downloadResp.Body.Close()
+		if downloadResp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected uncompleted upload not to be served, got status %d", downloadResp.StatusCode)
+		}
+
+		resp := completeUpload(t, uploadResp.CompleteUrl)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if downloaded := downloadContent(t, ts.URL+"/download/"+uploadResp.FileId); !bytes.Equal(downloaded, content) {
+			t.Errorf("Expected content '%s', got '%s'", content, downloaded)
+		}
+	})
+
+	t.Run("rejects uploads not matching the checksum", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+		content := bytes.Repeat([]byte("0123456789"), 600*1024)
+
+		uploadResp := reserveUpload(t, ts, len(content), []byte("other content"))
+		var etags []string
+		offset := int64(0)
+		for _, part := range uploadResp.Parts {
+			etags = append(etags, putContent(t, part.Url, nil, content[offset:offset+part.Size]))
+			offset += part.Size
+		}
+
+		resp := completeUpload(t, uploadResp.CompleteUrl, etags...)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		downloadResp.Body.Close()
+		if downloadResp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected rejected upload to be removed, got status %d", downloadResp.StatusCode)
+		}
+	})
+
+	t.Run("requires a checksum", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+
+		resp, err := http.PostForm(ts.URL+"/api/uploads", url.Values{"filename": {"direct.bin"}, "size": {"13"}})
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("rejects files over max upload size", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute), server.MaxUploadSize(1))
+
+		formData := url.Values{}
+		formData.Set("filename", "large.bin")
+		formData.Set("size", strconv.Itoa(2*1024*1024))
+
+		resp, err := http.PostForm(ts.URL+"/api/uploads", formData)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("retries failed completions", func(t *testing.T) {
+		var failed atomic.Bool
+		failOnce := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "fileigloo-staging/") && failed.CompareAndSwap(false, true) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		ts := setupTestServerWith(t, newS3TestStorage(t, failOnce), server.PresignedUploads(5*time.Minute))
+		content := []byte("Completed on the second try")
+
+		uploadResp := reserveUpload(t, ts, len(content), content)
+		putContent(t, uploadResp.UploadUrl, uploadResp.UploadHeaders, content)
+
+		resp := completeUpload(t, uploadResp.CompleteUrl)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("Expected status 500, got %d", resp.StatusCode)
+		}
+
+		resp = completeUpload(t, uploadResp.CompleteUrl)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if downloaded := downloadContent(t, ts.URL+"/download/"+uploadResp.FileId); !bytes.Equal(downloaded, content) {
+			t.Errorf("Expected content '%s', got '%s'", content, downloaded)
+		}
+
+		// Completed uploads are not pending anymore
+		resp = completeUpload(t, uploadResp.CompleteUrl)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("rejects unknown uploads", func(t *testing.T) {
+		ts := setupS3TestServer(t, server.PresignedUploads(5*time.Minute))
+
+		resp := completeUpload(t, ts.URL+"/api/uploads/unknown/complete")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// unreachableStorage fails to read metadata, like a storage that cannot be reached
+type unreachableStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s *unreachableStorage) GetOnlyMetadata(ctx context.Context, filename string) (storage.Metadata, error) {
+	return storage.Metadata{}, errors.New("storage unreachable")
+}
+
+func TestUploadStorageErrors(t *testing.T) {
+	memoryStorage, _ := storage.NewMemoryStorage(0)
+	ts := setupTestServerWith(t, &unreachableStorage{memoryStorage})
+
+	// IDs cannot be checked for collisions, which must not retry forever
+	resp, _ := uploadFile(t, ts, "text/plain", []byte("Hello, World!"), nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", resp.StatusCode)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	const content = "Hello, World!"
+	const checksum = "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"
+
+	upload := func(t *testing.T, ts *httptest.Server, fields map[string]string, headers map[string]string) *http.Response {
+		t.Helper()
+
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		fileField, err := writer.CreateFormFile("file", "test.txt")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		fileField.Write([]byte(content))
+		for name, value := range fields {
+			writer.WriteField(name, value)
+		}
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/", &buf)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("serves checksum headers on download", func(t *testing.T) {
+		ts, _ := setupTestServer(t)
+
+		resp := upload(t, ts, map[string]string{"checksum": strings.ToUpper(checksum)}, nil)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		var uploadResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		downloadResp.Body.Close()
+
+		if digest := downloadResp.Header.Get("Digest"); digest != "sha-256=3/1gIbsr1bCvZ2KQgJ7DpTGR3YHH9wpLKGiKNiGCmG8=" {
+			t.Errorf("Unexpected Digest header: %s", digest)
+		}
+		etag := downloadResp.Header.Get("ETag")
+		if etag != `"`+checksum+`"` {
+			t.Errorf("Unexpected ETag header: %s", etag)
+		}
+
+		req, _ := http.NewRequest("GET", ts.URL+"/download/"+uploadResp.FileId, nil)
+		req.Header.Set("If-None-Match", etag)
+		cachedResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		cachedResp.Body.Close()
+		if cachedResp.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected status 304, got %d", cachedResp.StatusCode)
+		}
+	})
+
+	t.Run("rejects upload not matching Digest header", func(t *testing.T) {
+		ts, s := setupTestServer(t)
+
+		resp := upload(t, ts, nil, map[string]string{"Digest": "sha-256=" + strings.Repeat("A", 43) + "="})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+
+		if filenames, _, _ := s.List(context.Background()); len(filenames) != 0 {
+			t.Errorf("Expected rejected upload not to be stored, got %v", filenames)
+		}
+	})
+
+	t.Run("rejects malformed checksum", func(t *testing.T) {
+		ts, _ := setupTestServer(t)
+
+		resp := upload(t, ts, map[string]string{"checksum": "not-a-checksum"}, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestLabels(t *testing.T) {
+	post := func(t *testing.T, ts *httptest.Server, formData url.Values) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("POST", ts.URL+"/", strings.NewReader(formData.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("stores labels and returns them", func(t *testing.T) {
+		ts, memoryStorage := setupTestServer(t)
+
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		fileField, err := writer.CreateFormFile("file", "test.txt")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		fileField.Write([]byte("Hello, World!"))
+		writer.WriteField("label.project", "foo")
+		writer.WriteField("label.build", "123")
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/", &buf)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		var uploadResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+		expected := map[string]string{"project": "foo", "build": "123"}
+		if !maps.Equal(uploadResp.Labels, expected) {
+			t.Errorf("Expected labels %v in response, got %v", expected, uploadResp.Labels)
+		}
+
+		metadata, err := memoryStorage.GetOnlyMetadata(context.Background(), uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if !maps.Equal(metadata.Labels, expected) {
+			t.Errorf("Expected labels %v to be stored, got %v", expected, metadata.Labels)
+		}
+	})
+
+	t.Run("stores labels of pastes", func(t *testing.T) {
+		ts, memoryStorage := setupTestServer(t)
+
+		resp := post(t, ts, url.Values{"text": {"Hello, World!"}, "label.project": {"foo"}})
+		defer resp.Body.Close()
+
+		var uploadResp server.FileUploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+			t.Fatalf("Failed to decode JSON response: %v", err)
+		}
+
+		filenames := collectFiles(t, memoryStorage, storage.ListOptions{Labels: map[string]string{"project": "foo"}})
+		if len(filenames) != 1 || filenames[0] != uploadResp.FileId {
+			t.Errorf("Expected [%s] to be labeled, got %v", uploadResp.FileId, filenames)
+		}
+	})
+
+	t.Run("rejects invalid labels", func(t *testing.T) {
+		ts, memoryStorage := setupTestServer(t)
+
+		tooMany := url.Values{"text": {"Hello, World!"}}
+		for i := range 17 {
+			tooMany.Set("label.key"+strconv.Itoa(i), "value")
+		}
+		// Multibyte values triple in size once URL-encoded for the storage
+		tooLarge := url.Values{"text": {"Hello, World!"}}
+		for i := range 4 {
+			tooLarge.Set("label.key"+strconv.Itoa(i), strings.Repeat("ż", 125))
+		}
+
+		for name, formData := range map[string]url.Values{
+			"invalid key":       {"text": {"Hello, World!"}, "label.Project": {"foo"}},
+			"empty key":         {"text": {"Hello, World!"}, "label.": {"foo"}},
+			"repeated key":      {"text": {"Hello, World!"}, "label.project": {"foo", "bar"}},
+			"value too long":    {"text": {"Hello, World!"}, "label.project": {strings.Repeat("a", 257)}},
+			"control character": {"text": {"Hello, World!"}, "label.project": {"foo\nbar"}},
+			"too many labels":   tooMany,
+			"too large encoded": tooLarge,
+		} {
+			resp := post(t, ts, formData)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", name, resp.StatusCode)
+			}
+		}
+
+		if filenames, _, _ := memoryStorage.List(context.Background()); len(filenames) != 0 {
+			t.Errorf("Expected rejected uploads not to be stored, got %v", filenames)
+		}
+	})
+}
+
+func collectFiles(t *testing.T, s storage.Storage, options storage.ListOptions) []string {
+	t.Helper()
+
+	var filenames []string
+	for object, err := range s.Iterate(context.Background(), options) {
+		if err != nil {
+			t.Fatalf("Failed to iterate files: %v", err)
+		}
+		filenames = append(filenames, object.Filename)
+	}
+	return filenames
+}
+
+func TestCompressedDownloads(t *testing.T) {
+	const content = "Hello, World! Hello, World! Hello, World!"
+
+	memoryStorage, err := storage.NewMemoryStorage(0)
+	if err != nil {
+		t.Fatalf("Failed to create memory storage: %v", err)
+	}
+	srv := server.New(
+		server.UseStorage(storage.NewCompressedStorage(memoryStorage)),
+		server.MaxRequests(100),
+	)
+	ts := httptest.NewServer(srv.GetRouter())
+	t.Cleanup(ts.Close)
+
+	formData := url.Values{}
+	formData.Set("text", content)
+	req, err := http.NewRequest("POST", ts.URL+"/", strings.NewReader(formData.Encode()))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var uploadResp server.FileUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+		t.Fatalf("Failed to decode JSON response: %v", err)
+	}
+
+	download := func(t *testing.T, acceptEncoding string) (*http.Response, []byte) {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", ts.URL+"/download/"+uploadResp.FileId, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		return resp, body
+	}
+
+	t.Run("serves compressed content to clients accepting it", func(t *testing.T) {
+		resp, body := download(t, "gzip, zstd")
+
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "zstd" {
+			t.Fatalf("Expected zstd Content-Encoding, got %q", encoding)
+		}
+		if resp.Header.Get("Digest") != "" {
+			t.Error("Expected no Digest header for compressed content")
+		}
+
+		decoder, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create decoder: %v", err)
+		}
+		defer decoder.Close()
+		if decompressed, _ := io.ReadAll(decoder); string(decompressed) != content {
+			t.Errorf("Content mismatch after decompressing: %s", decompressed)
+		}
+	})
+
+	t.Run("serves decompressed content to other clients", func(t *testing.T) {
+		for _, acceptEncoding := range []string{"", "gzip", "zstd;q=0"} {
+			resp, body := download(t, acceptEncoding)
+
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+				t.Errorf("Expected no Content-Encoding for %q, got %q", acceptEncoding, encoding)
+			}
+			if string(body) != content {
+				t.Errorf("Content mismatch for %q: %s", acceptEncoding, body)
+			}
+		}
+	})
+}
+
+func TestHealthChecks(t *testing.T) {
+	setupLocalTestServer := func(t *testing.T, directory string, options ...server.OptionFn) *httptest.Server {
+		t.Helper()
+
+		localStorage, err := storage.NewLocalStorage(directory)
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+
+		srv := server.New(append([]server.OptionFn{
+			server.UseStorage(localStorage),
+			server.MaxRequests(1),
+		}, options...)...)
+		ts := httptest.NewServer(srv.GetRouter())
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	get := func(t *testing.T, url string) int {
+		t.Helper()
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("liveness is not rate limited nor password protected", func(t *testing.T) {
+		ts := setupLocalTestServer(t, t.TempDir(), server.SitePassword("secret"))
+
+		for range 3 {
+			if status := get(t, ts.URL+"/healthz"); status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", status)
+			}
+		}
+	})
+
+	t.Run("ready with healthy storage", func(t *testing.T) {
+		ts := setupLocalTestServer(t, t.TempDir(), server.ReadyMinFreeSpace(1))
+
+		if status := get(t, ts.URL+"/readyz"); status != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", status)
+		}
+	})
+
+	t.Run("ready with storage without health checks", func(t *testing.T) {
+		ts, _ := setupTestServer(t)
+
+		if status := get(t, ts.URL+"/readyz"); status != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", status)
+		}
+	})
+
+	t.Run("not ready with unreachable storage", func(t *testing.T) {
+		directory := t.TempDir()
+		ts := setupLocalTestServer(t, directory)
+		os.RemoveAll(directory)
+
+		if status := get(t, ts.URL+"/readyz"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", status)
+		}
+	})
+
+	t.Run("not ready with insufficient free space", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("Free space is not supported on this platform")
+		}
+		ts := setupLocalTestServer(t, t.TempDir(), server.ReadyMinFreeSpace(1<<40))
+
+		if status := get(t, ts.URL+"/readyz"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", status)
+		}
+	})
+}
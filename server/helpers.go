@@ -1,12 +1,16 @@
 package server
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,7 +18,10 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/exler/fileigloo/storage"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -169,11 +176,147 @@ func ParseExpirationHours(expirationStr string) int {
 }
 
 // CalculateExpirationTime calculates expiration time from current time plus hours
-func CalculateExpirationTime(hours int) string {
+func CalculateExpirationTime(hours int) time.Time {
 	if hours <= 0 {
-		return "" // No expiration
+		return time.Time{} // No expiration
 	}
 
-	expirationTime := time.Now().Add(time.Duration(hours) * time.Hour)
-	return expirationTime.Format(time.RFC3339)
+	return time.Now().Add(time.Duration(hours) * time.Hour).UTC()
+}
+
+// HashIP returns a keyed hash of the IP address of remoteAddr (host:port), so that uploads from
+// the same address can be recognized without storing the address itself
+func HashIP(remoteAddr string, key []byte) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// ParseChecksum returns the expected SHA-256 checksum of an upload as lowercase hex, taken from
+// the checksum form value or the Digest header (sha-256=<base64>). Empty if the client sent none.
+func ParseChecksum(r *http.Request) (string, error) {
+	if checksum := r.FormValue("checksum"); checksum != "" {
+		sum, err := hex.DecodeString(checksum)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("checksum must be a hex-encoded SHA-256")
+		}
+		return hex.EncodeToString(sum), nil
+	}
+
+	for _, digest := range strings.Split(r.Header.Get("Digest"), ",") {
+		algorithm, value, found := strings.Cut(strings.TrimSpace(digest), "=")
+		if !found || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("digest must be a base64-encoded SHA-256")
+		}
+		return hex.EncodeToString(sum), nil
+	}
+
+	return "", nil
+}
+
+// Limits of the labels attached to an upload, keeping them within what every storage
+// can store with the rest of the metadata (e.g. 2KB of user-defined metadata in S3).
+// The total size is of the labels as they are encoded in storages like S3.
+const (
+	labelFieldPrefix    = "label."
+	maxLabels           = 16
+	maxLabelKeyLength   = 64
+	maxLabelValueLength = 256
+	maxLabelsSize       = 1024
+)
+
+// ParseLabels returns the labels of an upload, given as label.<key>=<value> form values.
+// Keys may contain lowercase letters, digits, '-', '_' and '.'. Nil if the client sent none.
+func ParseLabels(r *http.Request) (map[string]string, error) {
+	var labels map[string]string
+	for field, values := range r.Form {
+		key, ok := strings.CutPrefix(field, labelFieldPrefix)
+		if !ok {
+			continue
+		}
+
+		if !validLabelKey(key) {
+			return nil, fmt.Errorf("label key %q must be 1-%d lowercase letters, digits, '-', '_' or '.'", key, maxLabelKeyLength)
+		} else if len(values) != 1 {
+			return nil, fmt.Errorf("label %q must be given once", key)
+		}
+
+		value := values[0]
+		if len(value) > maxLabelValueLength || !utf8.ValidString(value) || strings.ContainsFunc(value, unicode.IsControl) {
+			return nil, fmt.Errorf("label %q must have a value of at most %d bytes of printable text", key, maxLabelValueLength)
+		}
+
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = value
+	}
+
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxLabels)
+	} else if len(storage.EncodeLabels(labels)) > maxLabelsSize {
+		return nil, fmt.Errorf("labels must not exceed %d bytes in total once URL-encoded", maxLabelsSize)
+	}
+	return labels, nil
+}
+
+func validLabelKey(key string) bool {
+	if key == "" || len(key) > maxLabelKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// DigestHeader formats a hex-encoded SHA-256 checksum as a Digest header value
+func DigestHeader(checksum string) string {
+	sum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// AcceptsEncoding reports whether the Accept-Encoding header of the request allows the content encoding
+func AcceptsEncoding(h http.Header, encoding string) bool {
+	var explicit, wildcard *bool
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			name = strings.TrimSpace(name)
+
+			// Encodings with zero quality are explicitly refused
+			accepted := true
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if quality, err := strconv.ParseFloat(q, 64); err == nil && quality == 0 {
+					accepted = false
+				}
+			}
+
+			if strings.EqualFold(name, encoding) {
+				explicit = &accepted
+			} else if name == "*" {
+				wildcard = &accepted
+			}
+		}
+	}
+
+	if explicit != nil {
+		return *explicit
+	}
+	return wildcard != nil && *wildcard
 }
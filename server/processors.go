@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+// UploadProcessor inspects an upload after it is received and before it is stored. It can change
+// the metadata, replace the content or reject the upload by returning an UploadRejectedError.
+//
+// Processors that replace the content must update metadata.ContentLength, or set it to zero if the
+// new length is unknown. Content that can only be judged as a whole can be rejected by failing the
+// returned reader, e.g. at its end, in which case nothing is stored. Returned readers that are
+// io.Closers, other than the content passed in, are closed once the upload is stored or has failed.
+//
+// Processors do not run for presigned uploads, which go directly to the storage.
+type UploadProcessor interface {
+	Process(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error)
+}
+
+// UploadProcessorFunc adapts a function to the UploadProcessor interface
+type UploadProcessorFunc func(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error)
+
+func (f UploadProcessorFunc) Process(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+	return f(ctx, content, metadata)
+}
+
+// UploadRejectedError rejects an upload, responding with the status code and reason
+type UploadRejectedError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *UploadRejectedError) Error() string {
+	return e.Reason
+}
+
+func RejectUpload(statusCode int, reason string) error {
+	return &UploadRejectedError{StatusCode: statusCode, Reason: reason}
+}
+
+// storeUpload runs the upload processors and stores the processed content. The metadata is
+// updated with the changes made by the processors.
+func (s *Server) storeUpload(ctx context.Context, fileId string, content io.Reader, metadata *storage.Metadata) error {
+	if len(s.uploadProcessors) > 0 {
+		// The client's checksum is of the content as uploaded, the storage records the one of the processed content
+		if metadata.Checksum != "" {
+			content = &checksumVerifier{reader: content, hash: sha256.New(), expected: metadata.Checksum}
+			metadata.Checksum = ""
+		}
+
+		for _, processor := range s.uploadProcessors {
+			processed, err := processor.Process(ctx, content, metadata)
+			if err != nil {
+				return err
+			}
+			if closer, ok := processed.(io.Closer); ok && processed != content {
+				defer closer.Close() //#nosec
+			}
+			content = processed
+		}
+	}
+
+	recorder := &errorRecorder{reader: content}
+	err := s.storage.Put(ctx, fileId, recorder, *metadata)
+	if err != nil && recorder.err != nil {
+		// Not every storage wraps the errors of the content, which would hide rejections
+		return recorder.err
+	} else if err != nil {
+		return err
+	}
+
+	if metadata.IsQuarantined() {
+		s.logger.Info(fmt.Sprintf("Infected file quarantined [fileId=%s, signature=%s]", fileId, metadata.ScanSignature))
+		return RejectUpload(http.StatusUnprocessableEntity, fmt.Sprintf("File is infected with %s and was quarantined", metadata.ScanSignature))
+	}
+	return nil
+}
+
+// writeUploadError responds to an upload that could not be stored
+func (s *Server) writeUploadError(w http.ResponseWriter, err error) {
+	var rejected *UploadRejectedError
+	if errors.As(err, &rejected) {
+		http.Error(w, rejected.Reason, rejected.StatusCode)
+	} else if errors.Is(err, storage.ErrChecksumMismatch) {
+		http.Error(w, "File does not match the expected checksum", http.StatusBadRequest)
+	} else if errors.Is(err, storage.ErrFileTooLarge) {
+		http.Error(w, "File is too big for the storage", http.StatusRequestEntityTooLarge)
+	} else if errors.Is(err, storage.ErrMetadataTooLarge) {
+		http.Error(w, "File details are too large for the storage, use fewer or shorter labels", http.StatusBadRequest)
+	} else if errors.Is(err, storage.ErrInsufficientSpace) {
+		http.Error(w, "Not enough storage space left, try again later", http.StatusInsufficientStorage)
+	} else {
+		s.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// errorRecorder remembers the first error reading the content failed with
+type errorRecorder struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *errorRecorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// checksumVerifier fails with storage.ErrChecksumMismatch at the end of content not matching the checksum
+type checksumVerifier struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (v *checksumVerifier) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return n, storage.ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// sniffLength is how much of the content is used to detect its type
+const sniffLength = 512
+
+type contentTypeSniffer struct {
+	allowedTypes []string
+}
+
+// SniffContentType detects the type of uploads from their content. Uploads sent without a type or
+// as application/octet-stream are stored with the detected one. If allowedTypes are given, uploads of
+// other detected types are rejected and all uploads are stored with the detected type, so that files
+// are never served as a type that was not checked. Types ending with a slash match all subtypes (e.g. image/).
+func SniffContentType(allowedTypes []string) UploadProcessor {
+	return &contentTypeSniffer{allowedTypes: allowedTypes}
+}
+
+func (p *contentTypeSniffer) Process(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+	reader := bufio.NewReaderSize(content, sniffLength)
+	head, err := reader.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	detected := http.DetectContentType(head)
+	if len(p.allowedTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(detected)
+		if !matchesContentType(mediaType, p.allowedTypes) {
+			return nil, RejectUpload(http.StatusUnsupportedMediaType, fmt.Sprintf("Files of type %s are not allowed", mediaType))
+		}
+		metadata.ContentType = detected
+	} else if declared, _, _ := mime.ParseMediaType(metadata.ContentType); declared == "" || declared == "application/octet-stream" {
+		metadata.ContentType = detected
+	}
+	return reader, nil
+}
+
+func matchesContentType(mediaType string, types []string) bool {
+	for _, t := range types {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+type exifStripper struct{}
+
+// StripEXIF removes metadata, like camera details and GPS coordinates, from JPEG images.
+// EXIF and XMP (APP1), IPTC (APP13) and comment segments are removed, other content is stored as uploaded.
+// Images lose their EXIF orientation too, so some may be displayed rotated.
+func StripEXIF() UploadProcessor {
+	return exifStripper{}
+}
+
+const (
+	jpegMarkerSOI = 0xD8
+	jpegMarkerEOI = 0xD9
+	jpegMarkerSOS = 0xDA
+
+	// maxJPEGHeaderSize bounds the segments kept in memory until the image data starts
+	maxJPEGHeaderSize = 4 << 20
+)
+
+// jpegMetadataMarkers are the markers of the segments that are removed
+var jpegMetadataMarkers = map[byte]bool{
+	0xE1: true, // APP1: EXIF, XMP
+	0xED: true, // APP13: IPTC
+	0xFE: true, // COM
+}
+
+func (exifStripper) Process(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+	reader := bufio.NewReader(content)
+	magic, err := reader.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	} else if !bytes.Equal(magic, []byte{0xFF, jpegMarkerSOI, 0xFF}) {
+		// Not a JPEG image
+		return reader, nil
+	}
+
+	invalid := RejectUpload(http.StatusBadRequest, "File is not a valid JPEG image")
+
+	// Segments are rewritten up to the image data, which is copied as it is
+	header := bytes.NewBuffer([]byte{0xFF, jpegMarkerSOI})
+	reader.Discard(2) //#nosec
+	var removed int64
+	for {
+		if b, err := reader.ReadByte(); err != nil || b != 0xFF {
+			return nil, invalid
+		}
+		marker, err := reader.ReadByte()
+		// Markers may be preceded by any number of fill bytes
+		for err == nil && marker == 0xFF {
+			removed++
+			marker, err = reader.ReadByte()
+		}
+		if err != nil {
+			return nil, invalid
+		}
+
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			header.Write([]byte{0xFF, marker})
+			break
+		} else if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Markers without a segment
+			header.Write([]byte{0xFF, marker})
+			continue
+		}
+
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(reader, lengthBytes[:]); err != nil {
+			return nil, invalid
+		}
+		length := int64(binary.BigEndian.Uint16(lengthBytes[:]))
+		if length < 2 {
+			return nil, invalid
+		}
+
+		if jpegMetadataMarkers[marker] {
+			if _, err := reader.Discard(int(length - 2)); err != nil {
+				return nil, invalid
+			}
+			removed += 2 + length
+			continue
+		}
+
+		header.Write([]byte{0xFF, marker})
+		header.Write(lengthBytes[:])
+		if _, err := io.CopyN(header, reader, length-2); err != nil {
+			return nil, invalid
+		} else if header.Len() > maxJPEGHeaderSize {
+			return nil, invalid
+		}
+	}
+
+	if metadata.ContentLength > 0 {
+		metadata.ContentLength -= removed
+	}
+	return io.MultiReader(header, reader), nil
+}
@@ -0,0 +1,338 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/exler/fileigloo/server"
+	"github.com/exler/fileigloo/storage"
+)
+
+func setupProcessingServer(t *testing.T, processors ...server.UploadProcessor) (*httptest.Server, *storage.MemoryStorage) {
+	t.Helper()
+
+	memoryStorage, err := storage.NewMemoryStorage(0)
+	if err != nil {
+		t.Fatalf("Failed to create memory storage: %v", err)
+	}
+
+	srv := server.New(
+		server.UseStorage(memoryStorage),
+		server.MaxRequests(100),
+		server.UploadProcessors(processors...),
+	)
+	ts := httptest.NewServer(srv.GetRouter())
+	t.Cleanup(ts.Close)
+	return ts, memoryStorage
+}
+
+// uploadFile uploads the content as a file of the given type, returning the response and the stored file ID
+func uploadFile(t *testing.T, ts *httptest.Server, contentType string, content []byte, fields map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write(content)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/", &buf)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	var uploadResp server.FileUploadResponse
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&uploadResp)
+	}
+	resp.Body.Close()
+	return resp, uploadResp.FileId
+}
+
+func getStored(t *testing.T, s storage.Storage, fileId string) ([]byte, storage.Metadata) {
+	t.Helper()
+
+	reader, metadata, err := s.GetWithMetadata(context.Background(), fileId)
+	if err != nil {
+		t.Fatalf("Failed to get stored file: %v", err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read stored file: %v", err)
+	}
+	return content, metadata
+}
+
+// failingReader fails with err once the content has been read
+type failingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestUploadProcessors(t *testing.T) {
+	upperCase := server.UploadProcessorFunc(func(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Labels = map[string]string{"processed": "true"}
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	})
+
+	t.Run("stores processed content and metadata", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, upperCase)
+
+		resp, fileId := uploadFile(t, ts, "text/plain", []byte("hello"), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		content, metadata := getStored(t, memoryStorage, fileId)
+		if string(content) != "HELLO" {
+			t.Errorf("Expected processed content, got %q", content)
+		}
+		if metadata.Labels["processed"] != "true" {
+			t.Errorf("Expected metadata set by processor, got %v", metadata.Labels)
+		}
+		if sum := sha256.Sum256([]byte("HELLO")); metadata.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected checksum of processed content, got %s", metadata.Checksum)
+		}
+	})
+
+	t.Run("verifies checksum of uploaded content", func(t *testing.T) {
+		ts, _ := setupProcessingServer(t, upperCase)
+
+		sum := sha256.Sum256([]byte("hello"))
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte("hello"), map[string]string{"checksum": hex.EncodeToString(sum[:])}); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for matching checksum, got %d", resp.StatusCode)
+		}
+
+		sum = sha256.Sum256([]byte("other"))
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte("hello"), map[string]string{"checksum": hex.EncodeToString(sum[:])}); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for mismatching checksum, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("rejects uploads", func(t *testing.T) {
+		reject := server.UploadProcessorFunc(func(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+			return nil, server.RejectUpload(http.StatusUnprocessableEntity, "Rejected")
+		})
+		ts, memoryStorage := setupProcessingServer(t, reject)
+
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte("hello"), nil); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422, got %d", resp.StatusCode)
+		}
+		if filenames, _, _ := memoryStorage.List(context.Background()); len(filenames) != 0 {
+			t.Errorf("Expected rejected upload not to be stored, got %v", filenames)
+		}
+	})
+
+	t.Run("rejects uploads at the end of the content", func(t *testing.T) {
+		rejectAtEnd := server.UploadProcessorFunc(func(ctx context.Context, content io.Reader, metadata *storage.Metadata) (io.Reader, error) {
+			return &failingReader{reader: content, err: fmt.Errorf("scan failed: %w", server.RejectUpload(http.StatusUnprocessableEntity, "Rejected"))}, nil
+		})
+		ts, memoryStorage := setupProcessingServer(t, rejectAtEnd)
+
+		if resp, _ := uploadFile(t, ts, "text/plain", []byte("hello"), nil); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422, got %d", resp.StatusCode)
+		}
+		if filenames, _, _ := memoryStorage.List(context.Background()); len(filenames) != 0 {
+			t.Errorf("Expected rejected upload not to be stored, got %v", filenames)
+		}
+	})
+
+	t.Run("processes pastes", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, upperCase)
+
+		resp := postForm(t, ts, map[string]string{"text": "hello"})
+		var uploadResp server.FileUploadResponse
+		json.NewDecoder(resp.Body).Decode(&uploadResp)
+		resp.Body.Close()
+
+		if content, _ := getStored(t, memoryStorage, uploadResp.FileId); string(content) != "HELLO" {
+			t.Errorf("Expected processed paste, got %q", content)
+		}
+	})
+}
+
+func postForm(t *testing.T, ts *httptest.Server, fields map[string]string) *http.Response {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/", &buf)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := range 16 {
+		for y := range 16 {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestSniffContentType(t *testing.T) {
+	var pngImage bytes.Buffer
+	png.Encode(&pngImage, testImage())
+
+	t.Run("detects type of untyped uploads", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, server.SniffContentType(nil))
+
+		_, fileId := uploadFile(t, ts, "application/octet-stream", pngImage.Bytes(), nil)
+		if _, metadata := getStored(t, memoryStorage, fileId); metadata.ContentType != "image/png" {
+			t.Errorf("Expected detected type image/png, got %s", metadata.ContentType)
+		}
+	})
+
+	t.Run("keeps declared type", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, server.SniffContentType(nil))
+
+		_, fileId := uploadFile(t, ts, "text/csv", []byte("a,b\n1,2\n"), nil)
+		content, metadata := getStored(t, memoryStorage, fileId)
+		if metadata.ContentType != "text/csv" {
+			t.Errorf("Expected declared type text/csv, got %s", metadata.ContentType)
+		}
+		if string(content) != "a,b\n1,2\n" {
+			t.Errorf("Expected content to be stored as uploaded, got %q", content)
+		}
+	})
+
+	t.Run("rejects types not allowed", func(t *testing.T) {
+		ts, _ := setupProcessingServer(t, server.SniffContentType([]string{"image/"}))
+
+		if resp, _ := uploadFile(t, ts, "application/octet-stream", pngImage.Bytes(), nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for allowed type, got %d", resp.StatusCode)
+		}
+		// The declared type is not trusted
+		if resp, _ := uploadFile(t, ts, "image/png", []byte("<html><body>not an image</body></html>"), nil); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status 415 for other type, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("stores checked type of allowed uploads", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, server.SniffContentType([]string{"image/"}))
+
+		// An image declared as HTML would otherwise be served as HTML
+		resp, fileId := uploadFile(t, ts, "text/html", pngImage.Bytes(), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if _, metadata := getStored(t, memoryStorage, fileId); metadata.ContentType != "image/png" {
+			t.Errorf("Expected detected type image/png, got %s", metadata.ContentType)
+		}
+	})
+}
+
+// withJPEGSegment inserts a segment with the marker and payload after the start of the image
+func withJPEGSegment(img []byte, marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+	return append(append(append([]byte(nil), img[:2]...), segment...), img[2:]...)
+}
+
+func TestStripEXIF(t *testing.T) {
+	var original bytes.Buffer
+	if err := jpeg.Encode(&original, testImage(), nil); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+
+	t.Run("removes metadata from JPEG images", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, server.StripEXIF())
+
+		img := withJPEGSegment(original.Bytes(), 0xE1, []byte("Exif\x00\x00GPS 52.2297N 21.0122E"))
+		img = withJPEGSegment(img, 0xFE, []byte("secret comment"))
+
+		resp, fileId := uploadFile(t, ts, "image/jpeg", img, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		content, metadata := getStored(t, memoryStorage, fileId)
+		if bytes.Contains(content, []byte("GPS")) || bytes.Contains(content, []byte("secret comment")) {
+			t.Error("Expected metadata to be removed")
+		}
+		if !bytes.Equal(content, original.Bytes()) {
+			t.Errorf("Expected image without metadata segments, got %d bytes instead of %d", len(content), original.Len())
+		}
+		if metadata.ContentLength != int64(len(content)) {
+			t.Errorf("Expected content length %d, got %d", len(content), metadata.ContentLength)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(content)); err != nil {
+			t.Errorf("Expected valid image, got %v", err)
+		}
+	})
+
+	t.Run("keeps other files", func(t *testing.T) {
+		ts, memoryStorage := setupProcessingServer(t, server.StripEXIF())
+
+		_, fileId := uploadFile(t, ts, "text/plain", []byte("Exif\x00\x00"), nil)
+		if content, _ := getStored(t, memoryStorage, fileId); string(content) != "Exif\x00\x00" {
+			t.Errorf("Expected content to be stored as uploaded, got %q", content)
+		}
+	})
+
+	t.Run("rejects invalid JPEG images", func(t *testing.T) {
+		ts, _ := setupProcessingServer(t, server.StripEXIF())
+
+		if resp, _ := uploadFile(t, ts, "image/jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF}, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -2,15 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"embed"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/exler/fileigloo/logger"
 	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
 	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/go-chi/chi/v5"
@@ -42,6 +45,62 @@ func UseStorage(storage storage.Storage) OptionFn {
 	}
 }
 
+// PresignedDownloads redirects downloads to URLs signed by the storage and valid for the given duration,
+// if the storage supports it. Otherwise downloads are proxied through the server.
+func PresignedDownloads(expiry time.Duration) OptionFn {
+	return func(s *Server) {
+		s.presignedDownloadExpiry = expiry
+	}
+}
+
+// PresignedUploads lets clients upload files directly to the storage through URLs valid
+// for the given duration, if the storage supports it
+func PresignedUploads(expiry time.Duration) OptionFn {
+	return func(s *Server) {
+		s.presignedUploadExpiry = expiry
+	}
+}
+
+// ReadyMinFreeSpace reports the server as not ready while its storage has less free space, if the
+// storage is kept on a local disk
+func ReadyMinFreeSpace(megabytes int64) OptionFn {
+	return func(s *Server) {
+		s.readyMinFreeSpace = uint64(megabytes) * 1024 * 1024 //#nosec
+	}
+}
+
+// IPHashKey is the key uploader IP addresses are hashed with before they are stored. Without it,
+// a random key is used and hashes of the same address differ after a restart.
+func IPHashKey(key string) OptionFn {
+	return func(s *Server) {
+		if key != "" {
+			s.ipHashKey = []byte(key)
+		}
+	}
+}
+
+// UseWebhooks sends events about files to webhooks
+func UseWebhooks(hooks *webhooks.Webhooks) OptionFn {
+	return func(s *Server) {
+		s.webhooks = hooks
+	}
+}
+
+// UploadProcessors run on every upload before it is stored, in the given order
+func UploadProcessors(processors ...UploadProcessor) OptionFn {
+	return func(s *Server) {
+		s.uploadProcessors = processors
+	}
+}
+
+// CleanupInterval deletes expired files from the storage periodically, zero to leave them
+// until they are cleaned up with the CLI
+func CleanupInterval(interval time.Duration) OptionFn {
+	return func(s *Server) {
+		s.cleanupInterval = interval
+	}
+}
+
 func Sentry(sentryDSN, sentryEnvironment string, sentryTracesSampleRate float64) OptionFn {
 	return func(s *Server) {
 		if sentryDSN == "" {
@@ -92,18 +151,40 @@ type Server struct {
 
 	storage storage.Storage
 
+	// presignedDownloadExpiry is zero if downloads are not redirected to the storage
+	presignedDownloadExpiry time.Duration
+
+	// presignedUploadExpiry is zero if direct uploads to the storage are disabled
+	presignedUploadExpiry time.Duration
+	pendingUploads        *pendingUploads
+
 	// maxUploadSize is in bytes
 	maxUploadSize int64
 	maxRequests   int
 
+	// readyMinFreeSpace is in bytes, zero if free space is not checked
+	readyMinFreeSpace uint64
+
 	sitePasswordHash string
 
+	ipHashKey []byte
+
+	uploadProcessors []UploadProcessor
+
+	// webhooks is nil if no webhooks are configured
+	webhooks *webhooks.Webhooks
+
+	// cleanupInterval is zero if expired files are not deleted by the server
+	cleanupInterval time.Duration
+
 	port int
 }
 
 func New(options ...OptionFn) *Server {
 	s := &Server{
-		logger: logger.NewLogger(),
+		logger:         logger.NewLogger(),
+		pendingUploads: newPendingUploads(),
+		ipHashKey:      []byte(rand.Text()),
 	}
 	for _, optionFn := range options {
 		optionFn(s)
@@ -115,7 +196,7 @@ func (s *Server) GetRouter() chi.Router {
 	if s.router != nil {
 		return s.router
 	}
-	
+
 	// Initialize router if not already done
 	s.setupRouter()
 	return s.router
@@ -130,14 +211,15 @@ func (s *Server) setupRouter() {
 	})
 
 	s.router = chi.NewRouter()
-	s.router.Use(middleware.Logger)
-	s.router.Use(middleware.Recoverer)
-	s.router.Use(limiter)
-	s.router.Use(sentryMiddleware.Handle)
 
-	s.router.Handle("/static/*", fs)
-	s.router.Get("/{action:(?:view|download)}/{fileId}", s.downloadHandler)
-	s.router.Post("/{action:(?:view|download)}/{fileId}", s.downloadHandler)
+	// Probes are polled frequently, so they are neither logged nor rate limited
+	s.router.Get("/healthz", s.livenessHandler)
+	s.router.Get("/readyz", s.readinessHandler)
+
+	router := s.router.With(middleware.Logger, middleware.Recoverer, limiter, sentryMiddleware.Handle)
+	router.Handle("/static/*", fs)
+	router.Get("/{action:(?:view|download)}/{fileId}", s.downloadHandler)
+	router.Post("/{action:(?:view|download)}/{fileId}", s.downloadHandler)
 
 	s.protectedRouter = chi.NewRouter()
 	s.protectedRouter.Use(middleware.Logger)
@@ -145,8 +227,8 @@ func (s *Server) setupRouter() {
 	s.protectedRouter.Use(limiter)
 
 	if s.sitePasswordHash != "" {
-		s.router.Get("/login", s.loginGETHandler)
-		s.router.Post("/login", s.loginPOSTHandler)
+		router.Get("/login", s.loginGETHandler)
+		router.Post("/login", s.loginPOSTHandler)
 		s.protectedRouter.Use(SitePasswordMiddleware(s.sitePasswordHash))
 	}
 
@@ -158,7 +240,13 @@ func (s *Server) setupRouter() {
 	s.protectedRouter.Get("/api", s.apiHandler)
 	s.protectedRouter.Post("/", s.formHandler)
 
-	s.router.Mount("/", s.protectedRouter)
+	if _, ok := s.storage.(storage.UploadPresigner); ok && s.presignedUploadExpiry > 0 {
+		s.protectedRouter.Post("/api/uploads", s.presignUploadHandler)
+		s.protectedRouter.Post("/api/uploads/{fileId}/complete", s.completeUploadHandler)
+		s.protectedRouter.Delete("/api/uploads/{fileId}", s.abortUploadHandler)
+	}
+
+	router.Mount("/", s.protectedRouter)
 }
 
 func (s *Server) Run() {
@@ -173,6 +261,15 @@ func (s *Server) Run() {
 	}
 	s.logger.Debug(fmt.Sprintf("Server started [storage=%s]", s.storage.Type()))
 
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if s.webhooks != nil {
+		go s.webhooks.Run(background)
+	}
+	if s.cleanupInterval > 0 {
+		go s.runCleanup(background)
+	}
+
 	go func() {
 		err := srv.ListenAndServe()
 		if err != nil {
@@ -195,3 +292,45 @@ func (s *Server) Run() {
 	// Does not block if no connections, otherwises waits for timeout
 	srv.Shutdown(ctx) //#nosec
 }
+
+// emit sends an event about the file to the webhooks, if any are configured
+func (s *Server) emit(eventType webhooks.EventType, fileId string, fileUrl *url.URL, metadata storage.Metadata) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var rawUrl string
+	if fileUrl != nil {
+		rawUrl = fileUrl.String()
+	}
+	s.webhooks.Emit(webhooks.NewEvent(eventType, fileId, rawUrl, metadata))
+}
+
+// DeleteExpired deletes expired files from the storage, sending a file.expired event for each
+func (s *Server) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return storage.DeleteExpiredWith(ctx, s.storage, func(object storage.Object) {
+		s.emit(webhooks.EventFileExpired, object.Filename, nil, object.Metadata)
+	})
+}
+
+func (s *Server) runCleanup(ctx context.Context) {
+	ticker := time.NewTicker(s.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Some files may have been deleted even if others failed
+		deletedCount, err := s.DeleteExpired(ctx)
+		if err != nil {
+			s.logger.Error(err)
+		}
+		if deletedCount > 0 {
+			s.logger.Info(fmt.Sprintf("Deleted expired files [count=%d]", deletedCount))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+type pendingUpload struct {
+	uploadID  string
+	metadata  storage.Metadata
+	expiresAt time.Time
+}
+
+// pendingUploads keeps track of presigned uploads that have been reserved but not completed yet
+type pendingUploads struct {
+	mu      sync.Mutex
+	uploads map[string]pendingUpload
+}
+
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{
+		uploads: make(map[string]pendingUpload),
+	}
+}
+
+func (p *pendingUploads) add(fileId string, upload pendingUpload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.uploads[fileId] = upload
+}
+
+func (p *pendingUploads) has(fileId string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, exists := p.uploads[fileId]
+	return exists
+}
+
+// get returns the upload unless it has already expired
+func (p *pendingUploads) get(fileId string) (pendingUpload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, exists := p.uploads[fileId]
+	if !exists || time.Now().After(upload.expiresAt) {
+		return pendingUpload{}, false
+	}
+	return upload, true
+}
+
+func (p *pendingUploads) remove(fileId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.uploads, fileId)
+}
+
+// take removes the upload and returns it unless it has already expired.
+// Expired uploads are left to removeExpired.
+func (p *pendingUploads) take(fileId string) (pendingUpload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, exists := p.uploads[fileId]
+	if !exists || time.Now().After(upload.expiresAt) {
+		return pendingUpload{}, false
+	}
+	delete(p.uploads, fileId)
+	return upload, true
+}
+
+// removeExpired removes and returns all uploads whose URLs have expired
+func (p *pendingUploads) removeExpired() map[string]pendingUpload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expired := make(map[string]pendingUpload)
+	now := time.Now()
+	for fileId, upload := range p.uploads {
+		if now.After(upload.expiresAt) {
+			expired[fileId] = upload
+			delete(p.uploads, fileId)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,154 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/server"
+	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	event  webhooks.Event
+}
+
+// receiveWebhooks starts a webhook receiver, returning its URL and the requests it receives
+func receiveWebhooks(t *testing.T) (string, <-chan webhookRequest) {
+	t.Helper()
+
+	requests := make(chan webhookRequest, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event webhooks.Event
+		json.Unmarshal(body, &event)
+		requests <- webhookRequest{header: r.Header, body: body, event: event}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver.URL, requests
+}
+
+func waitWebhook(t *testing.T, requests <-chan webhookRequest) webhookRequest {
+	t.Helper()
+
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for webhook request")
+		return webhookRequest{}
+	}
+}
+
+// runWebhooks delivers the events of webhooks with the config until the test ends
+func runWebhooks(t *testing.T, config webhooks.Config) *webhooks.Webhooks {
+	t.Helper()
+
+	config.OutboxDirectory = t.TempDir()
+	hooks, err := webhooks.NewWebhooks(config)
+	if err != nil {
+		t.Fatalf("Failed to create webhooks: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hooks.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return hooks
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Run("sends signed events of uploads and downloads", func(t *testing.T) {
+		receiver, requests := receiveWebhooks(t)
+		hooks := runWebhooks(t, webhooks.Config{URLs: []string{receiver}, Secret: "secret"})
+
+		memoryStorage, err := storage.NewMemoryStorage(0)
+		if err != nil {
+			t.Fatalf("Failed to create memory storage: %v", err)
+		}
+		ts := httptest.NewServer(server.New(server.UseStorage(memoryStorage), server.MaxRequests(100), server.UseWebhooks(hooks)).GetRouter())
+		defer ts.Close()
+
+		formData := url.Values{"text": {"Hello, World!"}, "label.project": {"foo"}}
+		req, _ := http.NewRequest("POST", ts.URL+"/", strings.NewReader(formData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var uploadResp server.FileUploadResponse
+		json.NewDecoder(resp.Body).Decode(&uploadResp)
+		resp.Body.Close()
+
+		uploaded := waitWebhook(t, requests)
+		if uploaded.event.Type != webhooks.EventFileUploaded || uploaded.header.Get("X-Fileigloo-Event") != "file.uploaded" {
+			t.Errorf("Expected file.uploaded event, got %s", uploaded.event.Type)
+		}
+		if uploaded.event.File.FileId != uploadResp.FileId || uploaded.event.File.FileUrl != uploadResp.FileUrl {
+			t.Errorf("Expected event about %s, got %+v", uploadResp.FileId, uploaded.event.File)
+		}
+		if uploaded.event.File.Labels["project"] != "foo" || uploaded.event.File.ContentLength != 13 {
+			t.Errorf("Expected file details in event, got %+v", uploaded.event.File)
+		}
+		if signature := uploaded.header.Get("X-Fileigloo-Signature"); signature != webhooks.Sign(uploaded.body, []byte("secret")) {
+			t.Errorf("Unexpected signature %s", signature)
+		}
+		if uploaded.header.Get("X-Fileigloo-Delivery") != uploaded.event.Id {
+			t.Errorf("Expected delivery header to be the event id %s", uploaded.event.Id)
+		}
+		if strings.Contains(string(uploaded.body), "Hash") {
+			t.Errorf("Expected no password nor IP hashes in event, got %s", uploaded.body)
+		}
+
+		downloadResp, err := http.Get(ts.URL + "/download/" + uploadResp.FileId)
+		if err != nil {
+			t.Fatalf("Failed to make download request: %v", err)
+		}
+		io.Copy(io.Discard, downloadResp.Body)
+		downloadResp.Body.Close()
+
+		downloaded := waitWebhook(t, requests)
+		if downloaded.event.Type != webhooks.EventFileDownloaded || downloaded.event.File.FileId != uploadResp.FileId {
+			t.Errorf("Expected file.downloaded event about %s, got %s about %s", uploadResp.FileId, downloaded.event.Type, downloaded.event.File.FileId)
+		}
+	})
+
+	t.Run("sends events of expired files", func(t *testing.T) {
+		receiver, requests := receiveWebhooks(t)
+		hooks := runWebhooks(t, webhooks.Config{URLs: []string{receiver}})
+
+		memoryStorage, err := storage.NewMemoryStorage(0)
+		if err != nil {
+			t.Fatalf("Failed to create memory storage: %v", err)
+		}
+		memoryStorage.Put(context.Background(), "expired", strings.NewReader("old"), storage.Metadata{Filename: "old.txt", ExpiresAt: time.Now().Add(-time.Hour)})
+		memoryStorage.Put(context.Background(), "valid", strings.NewReader("new"), storage.Metadata{Filename: "new.txt"})
+
+		srv := server.New(server.UseStorage(memoryStorage), server.UseWebhooks(hooks))
+		if deletedCount, err := srv.DeleteExpired(context.Background()); err != nil || deletedCount != 1 {
+			t.Fatalf("Expected 1 deleted file, got %d: %v", deletedCount, err)
+		}
+
+		expired := waitWebhook(t, requests)
+		if expired.event.Type != webhooks.EventFileExpired || expired.event.File.FileId != "expired" || expired.event.File.Filename != "old.txt" {
+			t.Errorf("Expected file.expired event about expired, got %s about %+v", expired.event.Type, expired.event.File)
+		}
+	})
+
+}
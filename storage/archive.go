@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archives are zstd-compressed tarballs with the manifest as the first entry,
+// followed by the content of every file listed in it
+const (
+	archiveVersion      = 1
+	archiveManifestName = "manifest.json"
+	archiveFilesDir     = "files/"
+)
+
+type ArchiveManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt string         `json:"createdAt"`
+	Files     []ArchiveEntry `json:"files"`
+}
+
+type ArchiveEntry struct {
+	FileId   string   `json:"fileId"`
+	Metadata Metadata `json:"metadata"`
+}
+
+type ExportOptions struct {
+	// SkipExpired leaves out files that have already expired
+	SkipExpired bool
+
+	// FileIds limits the export to the given files, all files are exported if empty
+	FileIds []string
+}
+
+type ImportOptions struct {
+	// SkipExpired leaves out files that have already expired
+	SkipExpired bool
+
+	// Overwrite replaces files that already exist in the storage instead of skipping them
+	Overwrite bool
+}
+
+// Export writes files and their metadata from the storage into a portable archive
+func Export(ctx context.Context, s Storage, w io.Writer, options ExportOptions) (exportedCount int, err error) {
+	filenames, metadata, err := s.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := ArchiveManifest{
+		Version:   archiveVersion,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Files:     []ArchiveEntry{},
+	}
+	for i, filename := range filenames {
+		if options.SkipExpired && metadata[i].IsExpired() {
+			continue
+		}
+		if len(options.FileIds) > 0 && !slices.Contains(options.FileIds, filename) {
+			continue
+		}
+
+		manifest.Files = append(manifest.Files, ArchiveEntry{FileId: filename, Metadata: metadata[i]})
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	defer zw.Close()
+	tw := tar.NewWriter(zw)
+	defer tw.Close()
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeArchiveEntry(tw, archiveManifestName, int64(len(manifestBytes)), bytes.NewReader(manifestBytes)); err != nil {
+		return 0, err
+	}
+
+	for _, entry := range manifest.Files {
+		if err := exportFile(ctx, s, tw, entry); err != nil {
+			return exportedCount, fmt.Errorf("failed to export file %s: %w", entry.FileId, err)
+		}
+		exportedCount++
+	}
+
+	if err := tw.Close(); err != nil {
+		return exportedCount, err
+	}
+	return exportedCount, zw.Close()
+}
+
+func exportFile(ctx context.Context, s Storage, tw *tar.Writer, entry ArchiveEntry) error {
+	reader, err := s.Get(ctx, entry.FileId)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Tar headers need the size upfront, which is unknown if the metadata lacks it
+	// or the file is stored encoded
+	size := entry.Metadata.ContentLength
+	if size == 0 || entry.Metadata.ContentEncoding != "" {
+		file, err := os.CreateTemp("", "fileigloo-export-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if size, err = io.Copy(file, reader); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeArchiveEntry(tw, archiveFilesDir+entry.FileId, size, file)
+	}
+
+	return writeArchiveEntry(tw, archiveFilesDir+entry.FileId, size, reader)
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, size int64, reader io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	written, err := io.Copy(tw, reader)
+	if err != nil {
+		return err
+	} else if written != size {
+		return fmt.Errorf("file is %d bytes long but its metadata says %d", written, size)
+	}
+	return nil
+}
+
+// Import restores files and their metadata from an archive created by Export
+func Import(ctx context.Context, s Storage, r io.Reader, options ImportOptions) (importedCount, skippedCount int, err error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil {
+		return 0, 0, err
+	} else if header.Name != archiveManifestName {
+		return 0, 0, errors.New("archive does not start with a manifest")
+	}
+
+	var manifest ArchiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, 0, err
+	} else if manifest.Version != archiveVersion {
+		return 0, 0, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+
+	metadata := make(map[string]Metadata, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		metadata[entry.FileId] = entry.Metadata
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return importedCount, skippedCount, err
+		}
+
+		fileId := strings.TrimPrefix(header.Name, archiveFilesDir)
+		m, listed := metadata[fileId]
+		if !listed || fileId != path.Base(fileId) {
+			return importedCount, skippedCount, fmt.Errorf("unexpected archive entry %s", header.Name)
+		}
+
+		imported, err := importFile(ctx, s, fileId, tr, m, options)
+		if err != nil {
+			return importedCount, skippedCount, fmt.Errorf("failed to import file %s: %w", fileId, err)
+		}
+
+		if imported {
+			importedCount++
+		} else {
+			skippedCount++
+		}
+	}
+
+	return importedCount, skippedCount, nil
+}
+
+func importFile(ctx context.Context, s Storage, fileId string, reader io.Reader, metadata Metadata, options ImportOptions) (bool, error) {
+	if options.SkipExpired && metadata.IsExpired() {
+		return false, nil
+	}
+
+	if !options.Overwrite {
+		_, err := s.GetOnlyMetadata(ctx, fileId)
+		if err == nil {
+			return false, nil
+		} else if !s.FileNotExists(err) {
+			return false, err
+		}
+	}
+
+	return true, s.Put(ctx, fileId, reader, metadata)
+}
@@ -0,0 +1,115 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("restores files with metadata into another storage", func(t *testing.T) {
+		from, err := storage.NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+		to, _ := setupS3Storage(t)
+		files := putTestFiles(t, from)
+
+		var archive bytes.Buffer
+		exportedCount, err := storage.Export(ctx, from, &archive, storage.ExportOptions{})
+		if err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+		if exportedCount != 2 {
+			t.Errorf("Expected 2 exported files, got %d", exportedCount)
+		}
+
+		importedCount, skippedCount, err := storage.Import(ctx, to, &archive, storage.ImportOptions{})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if importedCount != 2 || skippedCount != 0 {
+			t.Errorf("Expected 2 imported and 0 skipped files, got %d and %d", importedCount, skippedCount)
+		}
+
+		for filename, metadata := range files {
+			reader, importedMetadata, err := to.GetWithMetadata(ctx, filename)
+			if err != nil {
+				t.Fatalf("Failed to get imported file %s: %v", filename, err)
+			}
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+
+			if string(content) != "Hello, World!" {
+				t.Errorf("Content mismatch for %s: %s", filename, content)
+			}
+			if !importedMetadata.Equal(metadata) {
+				t.Errorf("Metadata mismatch for %s. Expected: %+v, Got: %+v", filename, metadata, importedMetadata)
+			}
+		}
+	})
+
+	t.Run("exports only selected files", func(t *testing.T) {
+		from, _ := storage.NewLocalStorage(t.TempDir())
+		to, _ := storage.NewLocalStorage(t.TempDir())
+		putTestFiles(t, from)
+
+		var archive bytes.Buffer
+		if _, err := storage.Export(ctx, from, &archive, storage.ExportOptions{FileIds: []string{"expired"}}); err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+		if _, _, err := storage.Import(ctx, to, &archive, storage.ImportOptions{}); err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+
+		filenames, _, _ := to.List(ctx)
+		if len(filenames) != 1 || filenames[0] != "expired" {
+			t.Errorf("Expected [expired], got %v", filenames)
+		}
+	})
+
+	t.Run("skips expired and existing files", func(t *testing.T) {
+		from, _ := storage.NewLocalStorage(t.TempDir())
+		to, _ := storage.NewLocalStorage(t.TempDir())
+		putTestFiles(t, from)
+
+		existing := storage.Metadata{
+			Filename:      "existing.txt",
+			ContentLength: 4,
+			Checksum:      "79f076abdd19a752db7267bfff2f9022161d120dea919fdaca2ffdfc24ca8c96",
+		}
+		if err := to.Put(ctx, "valid", bytes.NewBufferString("kept"), existing); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		var archive bytes.Buffer
+		if _, err := storage.Export(ctx, from, &archive, storage.ExportOptions{}); err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+
+		importedCount, skippedCount, err := storage.Import(ctx, to, &archive, storage.ImportOptions{SkipExpired: true})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if importedCount != 0 || skippedCount != 2 {
+			t.Errorf("Expected 0 imported and 2 skipped files, got %d and %d", importedCount, skippedCount)
+		}
+
+		if metadata, _ := to.GetOnlyMetadata(ctx, "valid"); !metadata.Equal(existing) {
+			t.Errorf("Expected existing file to be kept, got %+v", metadata)
+		}
+	})
+
+	t.Run("rejects archives without a manifest", func(t *testing.T) {
+		to, _ := storage.NewLocalStorage(t.TempDir())
+
+		if _, _, err := storage.Import(ctx, to, bytes.NewBufferString("not an archive"), storage.ImportOptions{}); err == nil {
+			t.Error("Expected error for invalid archive, got nil")
+		}
+	})
+}
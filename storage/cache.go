@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CachedStorage keeps recently downloaded files of a slower storage, e.g. S3, on local disk.
+// When the size budget is reached, the least recently used files are evicted. Only
+// GetWithMetadata, which serves downloads, fills the cache, so that bulk reads like exports
+// do not evict popular files. Cached files are only served while the backend reports the same
+// metadata for them, which costs a metadata request per download but saves transferring the content.
+type CachedStorage struct {
+	Storage
+	backend Storage
+	cache   *LocalStorage
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*list.Element
+	// lru holds *cachedFile values, most recently used first
+	lru *list.List
+	// fills holds files being copied into the cache, one copy per file at a time
+	fills map[string]*cacheFill
+	stats CacheStats
+}
+
+type cachedFile struct {
+	filename string
+	size     int64
+	// metadata is what the backend returned when the file was cached
+	metadata Metadata
+}
+
+type cacheFill struct {
+	// stale is set when the file changes while it is being copied, so the copy is discarded
+	stale bool
+}
+
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// Size is the total size of the cached files in bytes
+	Size  int64
+	Files int
+}
+
+// cacheSubdirectory is where the cache keeps its files, so that it never removes files it did not write
+const cacheSubdirectory = "fileigloo-cache"
+
+// NewCachedStorage creates a cache of at most maxSize bytes in directory in front of backend.
+// The cache starts empty, files left in the directory by a previous run are removed as the
+// backend may have changed since. The directory must not overlap the directory of a local backend.
+func NewCachedStorage(ctx context.Context, backend Storage, directory string, maxSize int64) (*CachedStorage, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("cache size limit must be positive")
+	}
+
+	for _, uploadDirectory := range localDirectories(backend) {
+		overlapping, err := overlappingDirectories(directory, uploadDirectory)
+		if err != nil {
+			return nil, err
+		} else if overlapping {
+			return nil, fmt.Errorf("cache directory %s overlaps the upload directory %s", directory, uploadDirectory)
+		}
+	}
+
+	cacheDirectory := filepath.Join(directory, cacheSubdirectory)
+	if err := os.RemoveAll(cacheDirectory); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cacheDirectory, 0700); err != nil {
+		return nil, err
+	}
+	cache, err := NewLocalStorage(cacheDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedStorage{
+		backend: backend,
+		cache:   cache,
+		maxSize: maxSize,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+		fills:   make(map[string]*cacheFill),
+	}, nil
+}
+
+// localDirectories returns the directories of the local storages s keeps files in
+func localDirectories(s Storage) []string {
+	switch s := s.(type) {
+	case *LocalStorage:
+		return []string{s.basedir}
+	case *MirrorStorage:
+		var directories []string
+		for _, replica := range s.Replicas() {
+			directories = append(directories, localDirectories(replica)...)
+		}
+		return directories
+	}
+	return nil
+}
+
+// overlappingDirectories reports whether the directories are the same or one is inside the other
+func overlappingDirectories(a, b string) (bool, error) {
+	a, err := resolveDirectory(a)
+	if err != nil {
+		return false, err
+	}
+	b, err = resolveDirectory(b)
+	if err != nil {
+		return false, err
+	}
+	return isSubdirectory(a, b) || isSubdirectory(b, a), nil
+}
+
+// resolveDirectory returns the absolute path of the directory, with symlinks resolved if it exists
+func resolveDirectory(directory string) (string, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(directory); err == nil {
+		return resolved, nil
+	}
+	return directory, nil
+}
+
+// isSubdirectory reports whether child is parent or inside it, both must be absolute and clean
+func isSubdirectory(parent, child string) bool {
+	rel, err := filepath.Rel(parent, child)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *CachedStorage) Type() string {
+	return s.backend.Type()
+}
+
+// Stats returns the cache statistics since the storage was created
+func (s *CachedStorage) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Size = s.size
+	stats.Files = len(s.files)
+	return stats
+}
+
+func (s *CachedStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return s.backend.List(ctx)
+}
+
+func (s *CachedStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return s.backend.Iterate(ctx, options)
+}
+
+// cached returns the backend metadata of the file if it is in the cache and marks it as recently used
+func (s *CachedStorage) cached(filename string) (Metadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.files[filename]
+	if !ok {
+		return Metadata{}, false
+	}
+	s.lru.MoveToFront(element)
+	return element.Value.(*cachedFile).metadata, true
+}
+
+// fresh reports whether the cached copy of the file can be served, returning the current metadata of
+// cached files. Files changed or deleted in the backend outside of this process, e.g. by the CLI or
+// lifecycle rules, are invalidated.
+func (s *CachedStorage) fresh(ctx context.Context, filename string) (metadata Metadata, ok bool, err error) {
+	cached, ok := s.cached(filename)
+	if !ok {
+		return Metadata{}, false, nil
+	}
+
+	metadata, err = s.backend.GetOnlyMetadata(ctx, filename)
+	if err != nil {
+		if s.backend.FileNotExists(err) {
+			s.invalidate(ctx, filename)
+		}
+		return metadata, false, err
+	} else if !metadata.Equal(cached) {
+		s.invalidate(ctx, filename)
+		return metadata, false, nil
+	}
+	return metadata, true, nil
+}
+
+func (s *CachedStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	_, ok, err := s.fresh(ctx, filename)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		if reader, err = s.cache.Get(ctx, filename); err == nil {
+			return reader, nil
+		}
+		s.invalidate(ctx, filename)
+	}
+	return s.backend.Get(ctx, filename)
+}
+
+func (s *CachedStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	metadata, ok, err := s.fresh(ctx, filename)
+	if err != nil {
+		return nil, metadata, err
+	} else if ok {
+		if reader, err = s.cache.Get(ctx, filename); err == nil {
+			s.mu.Lock()
+			s.stats.Hits++
+			s.mu.Unlock()
+			return reader, metadata, nil
+		}
+		// The cached copy is unreadable, e.g. removed from the disk
+		s.invalidate(ctx, filename)
+	}
+
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	reader, metadata, err = s.backend.GetWithMetadata(ctx, filename)
+	if err != nil {
+		return nil, metadata, err
+	}
+	return s.fill(ctx, filename, reader, metadata), metadata, nil
+}
+
+// GetOnlyMetadata is always answered by the backend, which has to be asked whether the file changed anyway
+func (s *CachedStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	return s.backend.GetOnlyMetadata(ctx, filename)
+}
+
+// fill returns a reader that copies the file into the cache while it is read. The copy is
+// only kept if the file is read to the end.
+func (s *CachedStorage) fill(ctx context.Context, filename string, reader io.ReadCloser, metadata Metadata) io.ReadCloser {
+	if metadata.ContentLength > s.maxSize {
+		return reader
+	}
+
+	s.mu.Lock()
+	if _, ok := s.fills[filename]; ok {
+		s.mu.Unlock()
+		return reader
+	}
+	fill := &cacheFill{}
+	s.fills[filename] = fill
+	s.mu.Unlock()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.cache.Put(context.WithoutCancel(ctx), filename, pr, metadata)
+		// Unblocks the reader if the cache stopped reading early
+		pr.CloseWithError(io.ErrClosedPipe) //#nosec
+		done <- err
+	}()
+
+	return &fillReader{
+		reader: reader,
+		pw:     pw,
+		done:   done,
+		commit: func(size int64, err error) {
+			s.commit(ctx, filename, metadata, fill, size, err)
+		},
+	}
+}
+
+// commit adds a copied file to the cache, evicting the least recently used files if needed
+func (s *CachedStorage) commit(ctx context.Context, filename string, metadata Metadata, fill *cacheFill, size int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.fills, filename)
+	if err != nil {
+		return
+	} else if fill.stale || size > s.maxSize {
+		s.cache.Delete(context.WithoutCancel(ctx), filename) //#nosec
+		return
+	}
+
+	if element, ok := s.files[filename]; ok {
+		s.remove(element)
+	}
+	for s.size+size > s.maxSize {
+		s.cache.Delete(context.WithoutCancel(ctx), s.remove(s.lru.Back())) //#nosec
+		s.stats.Evictions++
+	}
+
+	s.files[filename] = s.lru.PushFront(&cachedFile{filename: filename, size: size, metadata: metadata})
+	s.size += size
+}
+
+// remove drops the file from the index and returns its name, it must be called with the lock held
+func (s *CachedStorage) remove(element *list.Element) string {
+	file := s.lru.Remove(element).(*cachedFile)
+	delete(s.files, file.filename)
+	s.size -= file.size
+	return file.filename
+}
+
+// invalidate removes the file from the cache and discards copies in progress
+func (s *CachedStorage) invalidate(ctx context.Context, filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fill, ok := s.fills[filename]; ok {
+		fill.stale = true
+	}
+	if element, ok := s.files[filename]; ok {
+		s.remove(element)
+		s.cache.Delete(context.WithoutCancel(ctx), filename) //#nosec
+	}
+}
+
+func (s *CachedStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	// Invalidated again afterwards, as the old version may be cached while the new one is stored
+	s.invalidate(ctx, filename)
+	defer s.invalidate(ctx, filename)
+	return s.backend.Put(ctx, filename, reader, metadata)
+}
+
+func (s *CachedStorage) Delete(ctx context.Context, filename string) error {
+	s.invalidate(ctx, filename)
+	defer s.invalidate(ctx, filename)
+	return s.backend.Delete(ctx, filename)
+}
+
+func (s *CachedStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+func (s *CachedStorage) CheckHealth(ctx context.Context) error {
+	return CheckHealth(ctx, s.backend)
+}
+
+func (s *CachedStorage) FreeSpace() (uint64, error) {
+	return FreeSpace(s.backend)
+}
+
+func (s *CachedStorage) FileNotExists(err error) bool {
+	return s.backend.FileNotExists(err)
+}
+
+// fillReader copies everything read from reader into the cache
+type fillReader struct {
+	reader io.ReadCloser
+	pw     *io.PipeWriter
+	done   chan error
+	commit func(size int64, err error)
+
+	size int64
+	// err is set once the cache copy has failed, the file is still read from the backend
+	err      error
+	finished bool
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.pw.Write(p[:n])
+		r.size += int64(n)
+	}
+
+	if err == io.EOF {
+		r.finish(nil)
+	} else if err != nil {
+		r.finish(err)
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	// Files not read to the end are not cached
+	r.finish(errors.New("file was not read completely"))
+	return r.reader.Close()
+}
+
+func (r *fillReader) finish(err error) {
+	if r.finished {
+		return
+	}
+	r.finished = true
+
+	if err != nil {
+		r.pw.CloseWithError(err) //#nosec
+	} else {
+		r.pw.Close() //#nosec
+	}
+
+	putErr := <-r.done
+	if err == nil {
+		err = r.err
+	}
+	if err == nil {
+		err = putErr
+	}
+	r.commit(r.size, err)
+}
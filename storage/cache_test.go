@@ -0,0 +1,225 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+func setupCachedStorage(t *testing.T, maxSize int64) (*storage.CachedStorage, *storage.MemoryStorage) {
+	t.Helper()
+
+	backend, _ := storage.NewMemoryStorage(0)
+	s, err := storage.NewCachedStorage(context.Background(), backend, t.TempDir(), maxSize)
+	if err != nil {
+		t.Fatalf("Failed to create cached storage: %v", err)
+	}
+	return s, backend
+}
+
+func download(t *testing.T, s storage.Storage, filename string) string {
+	t.Helper()
+
+	reader, _, err := s.GetWithMetadata(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Failed to get file %s: %v", filename, err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %v", filename, err)
+	}
+	return string(content)
+}
+
+func TestNewCachedStorage(t *testing.T) {
+	backend, _ := storage.NewMemoryStorage(0)
+
+	t.Run("returns error for non-positive size limit", func(t *testing.T) {
+		if _, err := storage.NewCachedStorage(context.Background(), backend, t.TempDir(), 0); err == nil {
+			t.Error("Expected error for zero size limit, got nil")
+		}
+	})
+
+	t.Run("removes files left by previous run", func(t *testing.T) {
+		directory := t.TempDir()
+		previous, err := storage.NewCachedStorage(context.Background(), backend, directory, 1024)
+		if err != nil {
+			t.Fatalf("Failed to create cached storage: %v", err)
+		}
+		putTestFiles(t, backend)
+		download(t, previous, "valid")
+
+		s, err := storage.NewCachedStorage(context.Background(), backend, directory, 1024)
+		if err != nil {
+			t.Fatalf("Failed to create cached storage: %v", err)
+		}
+		if entries, _ := os.ReadDir(filepath.Join(directory, "fileigloo-cache")); len(entries) != 0 {
+			t.Errorf("Expected cache directory to be emptied, got %v", entries)
+		}
+		if stats := s.Stats(); stats.Files != 0 {
+			t.Errorf("Expected empty cache, got %+v", stats)
+		}
+	})
+
+	t.Run("keeps files it did not write", func(t *testing.T) {
+		directory := t.TempDir()
+		other := filepath.Join(directory, "notes.txt")
+		if err := os.WriteFile(other, []byte("keep me"), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		if _, err := storage.NewCachedStorage(context.Background(), backend, directory, 1024); err != nil {
+			t.Fatalf("Failed to create cached storage: %v", err)
+		}
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("Expected unrelated file to be kept: %v", err)
+		}
+	})
+
+	t.Run("refuses upload directories", func(t *testing.T) {
+		uploads := t.TempDir()
+		local, _ := storage.NewLocalStorage(uploads)
+		putTestFiles(t, local)
+		mirror, err := storage.NewMirrorStorage([]storage.Storage{backend, local})
+		if err != nil {
+			t.Fatalf("Failed to create mirror storage: %v", err)
+		}
+
+		for _, directory := range []string{uploads, filepath.Join(uploads, "cache"), filepath.Dir(uploads)} {
+			if _, err := storage.NewCachedStorage(context.Background(), local, directory, 1024); err == nil {
+				t.Errorf("Expected error for cache directory %s", directory)
+			}
+			if _, err := storage.NewCachedStorage(context.Background(), mirror, directory, 1024); err == nil {
+				t.Errorf("Expected error for cache directory %s of mirror", directory)
+			}
+		}
+		if filenames, _, _ := local.List(context.Background()); len(filenames) != 2 {
+			t.Errorf("Expected uploaded files to be kept, got %v", filenames)
+		}
+	})
+}
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("serves downloaded files from cache", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 1024)
+		putTestFiles(t, backend)
+
+		download(t, s, "valid")
+		if content := download(t, s, "valid"); content != "Hello, World!" {
+			t.Errorf("Content mismatch: %s", content)
+		}
+
+		stats := s.Stats()
+		if stats.Hits != 1 || stats.Misses != 1 || stats.Files != 1 || stats.Size != 13 {
+			t.Errorf("Unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("does not cache partially read files", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 1024)
+		putTestFiles(t, backend)
+
+		reader, _, err := s.GetWithMetadata(ctx, "valid")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		reader.Read(make([]byte, 5)) //#nosec
+		reader.Close()
+
+		if stats := s.Stats(); stats.Files != 0 {
+			t.Errorf("Expected no cached files, got %+v", stats)
+		}
+	})
+
+	t.Run("evicts least recently used files", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 25)
+		for _, filename := range []string{"first", "second", "third"} {
+			if err := backend.Put(ctx, filename, strings.NewReader("0123456789"), storage.Metadata{}); err != nil {
+				t.Fatalf("Failed to put file %s: %v", filename, err)
+			}
+		}
+
+		download(t, s, "first")
+		download(t, s, "second")
+		// Makes second the least recently used file
+		download(t, s, "first")
+		download(t, s, "third")
+
+		stats := s.Stats()
+		if stats.Evictions != 1 || stats.Files != 2 || stats.Size != 20 {
+			t.Errorf("Unexpected stats: %+v", stats)
+		}
+
+		download(t, s, "first")
+		if hits := s.Stats().Hits; hits != 2 {
+			t.Errorf("Expected first file to stay cached, got %d hits", hits)
+		}
+	})
+
+	t.Run("does not cache files over size limit", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 10)
+		putTestFiles(t, backend)
+
+		download(t, s, "valid")
+		if stats := s.Stats(); stats.Files != 0 {
+			t.Errorf("Expected no cached files, got %+v", stats)
+		}
+	})
+
+	t.Run("invalidates files changed outside of the process", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 1024)
+		putTestFiles(t, backend)
+		download(t, s, "valid")
+		download(t, s, "expired")
+
+		// Written to the backend directly, like the CLI or lifecycle rules do
+		if err := backend.Put(ctx, "valid", bytes.NewBufferString("New content"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		if content := download(t, s, "valid"); content != "New content" {
+			t.Errorf("Expected new content, got %s", content)
+		}
+
+		backend.Delete(ctx, "expired") //#nosec
+		if _, _, err := s.GetWithMetadata(ctx, "expired"); !s.FileNotExists(err) {
+			t.Errorf("Expected deleted file to be missing, got %v", err)
+		}
+		if _, err := s.Get(ctx, "expired"); !s.FileNotExists(err) {
+			t.Errorf("Expected deleted file to be missing, got %v", err)
+		}
+		if stats := s.Stats(); stats.Hits != 0 || stats.Files != 1 {
+			t.Errorf("Expected no hits of changed files, got %+v", stats)
+		}
+	})
+
+	t.Run("invalidates changed and deleted files", func(t *testing.T) {
+		s, backend := setupCachedStorage(t, 1024)
+		putTestFiles(t, backend)
+		download(t, s, "valid")
+		download(t, s, "expired")
+
+		if err := s.Put(ctx, "valid", bytes.NewBufferString("New content"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		if content := download(t, s, "valid"); content != "New content" {
+			t.Errorf("Expected new content, got %s", content)
+		}
+
+		if err := s.Delete(ctx, "expired"); err != nil {
+			t.Fatalf("Failed to delete file: %v", err)
+		}
+		if _, _, err := s.GetWithMetadata(ctx, "expired"); !s.FileNotExists(err) {
+			t.Errorf("Expected deleted file to be missing, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingZstd is the content encoding of files compressed by CompressedStorage
+const EncodingZstd = "zstd"
+
+// DefaultCompressibleTypes are the content types compressed by CompressedStorage by default.
+// Types ending with a slash match all of their subtypes.
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-ndjson",
+	"application/x-yaml",
+	"application/yaml",
+	"application/sql",
+	"image/svg+xml",
+}
+
+// EncodedGetter is implemented by storages that can return files in the encoding they are
+// stored with, e.g. to send compressed files to clients that accept them as they are
+type EncodedGetter interface {
+	// GetEncoded returns the stored content with metadata.ContentEncoding set if accept reports
+	// its encoding as supported, and the decoded content otherwise
+	GetEncoded(ctx context.Context, filename string, accept func(encoding string) bool) (reader io.ReadCloser, metadata Metadata, err error)
+}
+
+// CompressedStorage compresses files with compressible content types before storing them
+// and decompresses them when read. Presigned URLs of the backend are not exposed, as they
+// would bypass the compression.
+type CompressedStorage struct {
+	Storage
+	backend Storage
+	types   []string
+	level   zstd.EncoderLevel
+}
+
+type CompressedOptionFn func(*CompressedStorage)
+
+// CompressTypes replaces the content types that are compressed
+func CompressTypes(types []string) CompressedOptionFn {
+	return func(s *CompressedStorage) {
+		s.types = types
+	}
+}
+
+func CompressionLevel(level zstd.EncoderLevel) CompressedOptionFn {
+	return func(s *CompressedStorage) {
+		s.level = level
+	}
+}
+
+func NewCompressedStorage(backend Storage, options ...CompressedOptionFn) *CompressedStorage {
+	s := &CompressedStorage{
+		backend: backend,
+		types:   DefaultCompressibleTypes,
+		level:   zstd.SpeedDefault,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+func (s *CompressedStorage) Type() string {
+	return s.backend.Type()
+}
+
+// compressible reports whether files of the content type are compressed
+func (s *CompressedStorage) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range s.types {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newDecoder returns a reader of the decoded content, closing it does not close reader
+func newDecoder(reader io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(reader), nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// decoded returns the metadata of the file as uploaded
+func decoded(metadata Metadata) Metadata {
+	metadata.ContentEncoding = ""
+	return metadata
+}
+
+func (s *CompressedStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+func (s *CompressedStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		for object, err := range s.backend.Iterate(ctx, options) {
+			object.Metadata = decoded(object.Metadata)
+			if !yield(object, err) {
+				return
+			}
+		}
+	}
+}
+
+func (s *CompressedStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	reader, _, err = s.GetWithMetadata(ctx, filename)
+	return
+}
+
+func (s *CompressedStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	return s.GetEncoded(ctx, filename, func(encoding string) bool { return false })
+}
+
+func (s *CompressedStorage) GetEncoded(ctx context.Context, filename string, accept func(encoding string) bool) (reader io.ReadCloser, metadata Metadata, err error) {
+	reader, metadata, err = s.backend.GetWithMetadata(ctx, filename)
+	if err != nil || metadata.ContentEncoding == "" || accept(metadata.ContentEncoding) {
+		return
+	}
+
+	decoder, err := newDecoder(reader, metadata.ContentEncoding)
+	if err != nil {
+		reader.Close()
+		return nil, metadata, err
+	}
+	return &decodingReader{decoder: decoder, reader: reader}, decoded(metadata), nil
+}
+
+func (s *CompressedStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	metadata, err = s.backend.GetOnlyMetadata(ctx, filename)
+	return decoded(metadata), err
+}
+
+func (s *CompressedStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	if metadata.ContentEncoding != "" || !s.compressible(metadata.ContentType) {
+		return s.backend.Put(ctx, filename, reader, metadata)
+	}
+
+	// The checksum of the uploaded content is stored with the file, so it has to be known
+	// before the compressed content is passed to the backend
+	file, err := os.CreateTemp("", "fileigloo-compress-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) //#nosec
+	defer file.Close()
+
+	checksum := newChecksumReader(reader)
+	if err := compress(file, checksum, s.level); err != nil {
+		return err
+	}
+	if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+		return ErrChecksumMismatch
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	metadata.Checksum = checksum.Sum()
+	metadata.ContentEncoding = EncodingZstd
+	return s.backend.Put(ctx, filename, file, metadata)
+}
+
+func compress(w io.Writer, r io.Reader, level zstd.EncoderLevel) error {
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(encoder, r); err != nil {
+		encoder.Close() //#nosec
+		return err
+	}
+	return encoder.Close()
+}
+
+func (s *CompressedStorage) Delete(ctx context.Context, filename string) error {
+	return s.backend.Delete(ctx, filename)
+}
+
+func (s *CompressedStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+func (s *CompressedStorage) CheckHealth(ctx context.Context) error {
+	return CheckHealth(ctx, s.backend)
+}
+
+func (s *CompressedStorage) FreeSpace() (uint64, error) {
+	return FreeSpace(s.backend)
+}
+
+func (s *CompressedStorage) FileNotExists(err error) bool {
+	return s.backend.FileNotExists(err)
+}
+
+// decodingReader closes both the decoder and the stored content
+type decodingReader struct {
+	decoder io.ReadCloser
+	reader  io.ReadCloser
+}
+
+func (r *decodingReader) Read(p []byte) (int, error) {
+	return r.decoder.Read(p)
+}
+
+func (r *decodingReader) Close() error {
+	r.decoder.Close()
+	return r.reader.Close()
+}
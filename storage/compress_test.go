@@ -0,0 +1,126 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/exler/fileigloo/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("Hello, World!\n", 100)
+
+	setup := func(t *testing.T) (*storage.CompressedStorage, *storage.MemoryStorage) {
+		backend, _ := storage.NewMemoryStorage(0)
+		return storage.NewCompressedStorage(backend), backend
+	}
+
+	put := func(t *testing.T, s storage.Storage, contentType string) {
+		t.Helper()
+
+		metadata := storage.Metadata{Filename: "file", ContentType: contentType}
+		if err := s.Put(ctx, "file", strings.NewReader(content), metadata); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+	}
+
+	t.Run("compresses compressible content types", func(t *testing.T) {
+		s, backend := setup(t)
+		put(t, s, "text/plain; charset=utf-8")
+
+		reader, metadata, err := backend.GetWithMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get stored file: %v", err)
+		}
+		stored, _ := io.ReadAll(reader)
+		reader.Close()
+
+		if metadata.ContentEncoding != storage.EncodingZstd {
+			t.Errorf("Expected zstd content encoding, got %q", metadata.ContentEncoding)
+		}
+		if len(stored) >= len(content) {
+			t.Errorf("Expected stored file to be smaller than %d bytes, got %d", len(content), len(stored))
+		}
+
+		// Checksums describe the uploaded content, even when read from the backend directly
+		if err := storage.VerifyChecksum(ctx, backend, "file"); err != nil {
+			t.Errorf("Failed to verify checksum of stored file: %v", err)
+		}
+	})
+
+	t.Run("decompresses on get", func(t *testing.T) {
+		s, _ := setup(t)
+		put(t, s, "application/json")
+
+		reader, metadata, err := s.GetWithMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+
+		if string(data) != content {
+			t.Errorf("Content mismatch: %s", data)
+		}
+		if metadata.ContentEncoding != "" {
+			t.Errorf("Expected no content encoding, got %q", metadata.ContentEncoding)
+		}
+		if err := storage.VerifyChecksum(ctx, s, "file"); err != nil {
+			t.Errorf("Failed to verify checksum: %v", err)
+		}
+	})
+
+	t.Run("returns compressed content when accepted", func(t *testing.T) {
+		s, _ := setup(t)
+		put(t, s, "text/plain")
+
+		reader, metadata, err := s.GetEncoded(ctx, "file", func(encoding string) bool {
+			return encoding == storage.EncodingZstd
+		})
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		defer reader.Close()
+
+		if metadata.ContentEncoding != storage.EncodingZstd {
+			t.Errorf("Expected zstd content encoding, got %q", metadata.ContentEncoding)
+		}
+		decoder, _ := zstd.NewReader(reader)
+		defer decoder.Close()
+		if data, _ := io.ReadAll(decoder); string(data) != content {
+			t.Errorf("Content mismatch after decompressing: %s", data)
+		}
+	})
+
+	t.Run("stores other content types as uploaded", func(t *testing.T) {
+		s, backend := setup(t)
+		put(t, s, "image/png")
+
+		metadata, err := backend.GetOnlyMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get stored metadata: %v", err)
+		}
+		if metadata.ContentEncoding != "" {
+			t.Errorf("Expected no content encoding, got %q", metadata.ContentEncoding)
+		}
+	})
+
+	t.Run("rejects mismatching checksum", func(t *testing.T) {
+		s, backend := setup(t)
+
+		metadata := storage.Metadata{ContentType: "text/plain", Checksum: helloWorldChecksum}
+		err := s.Put(ctx, "file", bytes.NewBufferString("Goodbye, World!"), metadata)
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+		}
+		if _, err := backend.GetOnlyMetadata(ctx, "file"); !backend.FileNotExists(err) {
+			t.Errorf("Expected rejected file not to be stored, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, err := storage.NewLocalStorage(t.TempDir())
+			if err != nil {
+				t.Fatalf("Failed to create local storage: %v", err)
+			}
+			return s
+		})
+	})
+
+	t.Run("local sharded", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, err := storage.NewLocalStorage(t.TempDir(), storage.ShardDepth(2))
+			if err != nil {
+				t.Fatalf("Failed to create local storage: %v", err)
+			}
+			return s
+		})
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, _ := setupS3Storage(t)
+			return s
+		})
+	})
+
+	for _, policy := range []storage.WritePolicy{storage.WriteAll, storage.WriteQuorum, storage.WritePrimary} {
+		t.Run("mirror "+string(policy), func(t *testing.T) {
+			storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+				local, err := storage.NewLocalStorage(t.TempDir())
+				if err != nil {
+					t.Fatalf("Failed to create local storage: %v", err)
+				}
+				memory, _ := storage.NewMemoryStorage(0)
+
+				s, err := storage.NewMirrorStorage([]storage.Storage{local, memory}, storage.MirrorWritePolicy(policy))
+				if err != nil {
+					t.Fatalf("Failed to create mirror storage: %v", err)
+				}
+				t.Cleanup(s.Wait)
+				return s
+			})
+		})
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			backend, _ := storage.NewMemoryStorage(0)
+			s, err := storage.NewCachedStorage(context.Background(), backend, t.TempDir(), 1024*1024)
+			if err != nil {
+				t.Fatalf("Failed to create cached storage: %v", err)
+			}
+			return s
+		})
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			backend, _ := storage.NewMemoryStorage(0)
+			return storage.NewCompressedStorage(backend)
+		})
+	})
+
+	t.Run("webdav", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, _ := setupWebDAVStorage(t)
+			return s
+		})
+	})
+
+	t.Run("sftp", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, _ := setupSFTPStorage(t)
+			return s
+		})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+			s, err := storage.NewMemoryStorage(0)
+			if err != nil {
+				t.Fatalf("Failed to create memory storage: %v", err)
+			}
+			return s
+		})
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+func diskFreeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("free space of %s: %w", path, errors.ErrUnsupported)
+}
@@ -4,20 +4,64 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
-
-	"github.com/exler/fileigloo/datetime"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type LocalStorage struct {
 	Storage
-	basedir string
+	basedir    string
+	shardDepth int
+
+	// minFreeSpace is in bytes, zero if free space is not checked
+	minFreeSpace uint64
+	onLowSpace   func(deletedCount int, err error)
+	sweeping     atomic.Bool
+}
+
+// ErrInsufficientSpace is returned when storing a file would leave the disk with less free space than required
+var ErrInsufficientSpace = errors.New("not enough free space left on the storage")
+
+type LocalOptionFn func(*LocalStorage)
+
+// maxShardDepth keeps shard directories meaningful for the 12 character file IDs
+const maxShardDepth = 4
+
+// ShardDepth stores files in nested directories named after pairs of leading characters
+// of the file ID, e.g. ab/cd/abcdEFGHijkl for depth 2. Depth 0 keeps all files in basedir.
+func ShardDepth(depth int) LocalOptionFn {
+	return func(s *LocalStorage) {
+		s.shardDepth = depth
+	}
+}
+
+// MinFreeSpace makes Put fail with ErrInsufficientSpace rather than leave less free space on the
+// disk. Free space is checked before and, for large files, periodically while writing them.
+func MinFreeSpace(bytes uint64) LocalOptionFn {
+	return func(s *LocalStorage) {
+		s.minFreeSpace = bytes
+	}
+}
+
+// SweepOnLowSpace deletes expired files in the background when Put fails with ErrInsufficientSpace,
+// without waiting for the next scheduled cleanup. fn, if not nil, is called with the result of the sweep.
+func SweepOnLowSpace(fn func(deletedCount int, err error)) LocalOptionFn {
+	return func(s *LocalStorage) {
+		s.onLowSpace = fn
+		if fn == nil {
+			s.onLowSpace = func(int, error) {}
+		}
+	}
 }
 
-func NewLocalStorage(basedir string) (*LocalStorage, error) {
+func NewLocalStorage(basedir string, options ...LocalOptionFn) (*LocalStorage, error) {
 	if basedir[len(basedir)-1:] != "/" {
 		basedir += "/"
 	}
@@ -25,6 +69,18 @@ func NewLocalStorage(basedir string) (*LocalStorage, error) {
 	storage := &LocalStorage{
 		basedir: basedir,
 	}
+	for _, optionFn := range options {
+		optionFn(storage)
+	}
+
+	if storage.shardDepth < 0 || storage.shardDepth > maxShardDepth {
+		return nil, fmt.Errorf("shard depth must be between 0 and %d", maxShardDepth)
+	}
+
+	// Created up front, so that a fresh install passes health checks before the first upload
+	if err := os.MkdirAll(basedir, 0700); err != nil {
+		return nil, err
+	}
 
 	return storage, nil
 }
@@ -33,131 +89,502 @@ func (s *LocalStorage) Type() string {
 	return "local"
 }
 
+// filePath returns the path of the file in the configured layout
+func (s *LocalStorage) filePath(filename string) string {
+	return s.pathAtDepth(filename, s.shardDepth)
+}
+
+// pathAtDepth returns the path of the file in the layout of the shard depth. IDs too short to be
+// sharded or containing characters unsafe in directory names stay in basedir.
+func (s *LocalStorage) pathAtDepth(filename string, depth int) string {
+	if len(filename) < 2*depth || strings.ContainsAny(filename[:2*depth], `./\`) {
+		return filepath.Join(s.basedir, filename)
+	}
+
+	elems := []string{s.basedir}
+	for i := range depth {
+		elems = append(elems, filename[2*i:2*i+2])
+	}
+	return filepath.Join(append(elems, filename)...)
+}
+
+// existingPath returns the path of a stored file. Files written with another shard depth, e.g.
+// before sharding was enabled, are found in their layout until they are moved with Reshard.
+func (s *LocalStorage) existingPath(filename string) string {
+	path := s.filePath(filename)
+	if _, err := os.Stat(path + ".metadata"); !os.IsNotExist(err) {
+		return path
+	}
+
+	for depth := range maxShardDepth + 1 {
+		if depth == s.shardDepth {
+			continue
+		}
+		if other := s.pathAtDepth(filename, depth); other != path {
+			if _, err := os.Stat(other + ".metadata"); err == nil {
+				return other
+			}
+		}
+	}
+	return path
+}
+
+func readMetadata(metadataPath string) (metadata Metadata, err error) {
+	mReader, err := os.Open(metadataPath) //#nosec
+	if err != nil {
+		return
+	}
+	defer mReader.Close()
+
+	err = json.NewDecoder(mReader).Decode(&metadata)
+	return
+}
+
 func (s *LocalStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
-	err = filepath.WalkDir(s.basedir, func(path string, d os.DirEntry, err error) error {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+// errStopIteration ends a walk early when the consumer of an iterator stops
+var errStopIteration = errors.New("iteration stopped")
+
+func (s *LocalStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		err := s.walkFiles(ctx, func(path string, d os.DirEntry, metadata Metadata) error {
+			info, err := d.Info()
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			filename := filepath.Base(path)
+			if !options.matchesStored(filename, info.ModTime()) || !options.matchesMetadata(metadata) {
+				return nil
+			}
+
+			if !yield(Object{Filename: filename, Metadata: metadata, ModTime: info.ModTime()}, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			yield(Object{}, err)
+		}
+	}
+}
+
+// Walk calls fn for every stored file and its metadata without loading the whole listing
+// into memory. An error returned by fn stops the walk and is returned by Walk.
+func (s *LocalStorage) Walk(ctx context.Context, fn func(filename string, metadata Metadata) error) error {
+	return s.walkFiles(ctx, func(path string, d os.DirEntry, metadata Metadata) error {
+		return fn(filepath.Base(path), metadata)
+	})
+}
+
+// walkFiles calls fn with the path of every complete file in basedir and its shard directories
+func (s *LocalStorage) walkFiles(ctx context.Context, fn func(path string, d os.DirEntry, metadata Metadata) error) error {
+	return filepath.WalkDir(s.basedir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		if d.IsDir() {
+		if d.IsDir() || filepath.Ext(path) == ".metadata" || isTemp(d.Name()) {
 			return nil
 		}
 
-		if filepath.Ext(path) == ".metadata" {
+		metadata, err := readMetadata(path + ".metadata")
+		if os.IsNotExist(err) {
+			// Files without metadata have not been completely written
 			return nil
+		} else if err != nil {
+			return err
 		}
 
-		filenames = append(filenames, d.Name())
-
-		m, err := s.GetOnlyMetadata(ctx, d.Name())
-		metadata = append(metadata, m)
-
-		return err
+		return fn(path, d, metadata)
 	})
-	return
 }
 
 func (s *LocalStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
-	path := filepath.Join(s.basedir, filename)
+	path := s.existingPath(filename)
 	reader, err = os.Open(path) //#nosec
 	return
 }
 
 func (s *LocalStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
-	reader, err = s.Get(ctx, filename)
+	path := s.existingPath(filename)
+	reader, err = os.Open(path) //#nosec
 	if err != nil {
 		return
 	}
 
-	var mReader io.ReadCloser
-	mPath := fmt.Sprintf("%s.metadata", filename)
-	mReader, err = s.Get(ctx, mPath)
+	metadata, err = readMetadata(fmt.Sprintf("%s.metadata", path))
 	if err != nil {
-		return
+		reader.Close()
+		reader = nil
 	}
-	defer mReader.Close()
-
-	err = json.NewDecoder(mReader).Decode(&metadata)
 	return
 }
 
 func (s *LocalStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
-	var mReader io.ReadCloser
-	mPath := fmt.Sprintf("%s.metadata", filename)
-	mReader, err = s.Get(ctx, mPath)
-	if err != nil {
-		return
-	}
-	defer mReader.Close()
-
-	err = json.NewDecoder(mReader).Decode(&metadata)
-	return
+	return readMetadata(fmt.Sprintf("%s.metadata", s.existingPath(filename)))
 }
 
 func (s *LocalStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
-	var f, mf io.WriteCloser
-	var err error
+	path := s.filePath(filename)
+	metadataPath := fmt.Sprintf("%s.metadata", path)
 
-	if err = os.MkdirAll(s.basedir, 0600); os.IsNotExist(err) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
 	}
 
-	path := filepath.Join(s.basedir, filename)
-	f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) // #nosec G304
-	if err != nil {
+	// Files of known size are rejected before anything is written
+	var size uint64
+	if metadata.ContentEncoding == "" && metadata.ContentLength > 0 {
+		size = uint64(metadata.ContentLength)
+	}
+	if err := s.checkFreeSpace(size); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	if _, err = io.Copy(f, reader); err != nil {
+	// Both files are written next to their final paths and renamed into place once complete
+	f, err := createTemp(path)
+	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name()) //#nosec
 
-	metadataPath := fmt.Sprintf("%s.metadata", path)
-	metadataBuffer := &bytes.Buffer{}
-	if err = json.NewEncoder(metadataBuffer).Encode(metadata); err != nil {
+	checksum := newChecksumReader(reader)
+	var w io.Writer = f
+	if s.minFreeSpace > 0 {
+		w = &spaceGuardWriter{w: f, s: s}
+	}
+	if _, err := io.Copy(w, checksum); err != nil {
+		f.Close()
 		return err
 	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+
+	if metadata.ContentEncoding == "" {
+		if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+			return ErrChecksumMismatch
+		}
+		metadata.Checksum = checksum.Sum()
+	}
 
-	mf, err = os.OpenFile(metadataPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) // #nosec G304
+	mf, err := createTemp(metadataPath)
 	if err != nil {
 		return err
 	}
-	defer mf.Close()
+	defer os.Remove(mf.Name()) //#nosec
 
-	_, err = io.Copy(mf, metadataBuffer)
-	return err
-}
+	if err := json.NewEncoder(mf).Encode(metadata); err != nil {
+		mf.Close()
+		return err
+	}
+	if err := syncAndClose(mf); err != nil {
+		return err
+	}
 
-func (s *LocalStorage) Delete(ctx context.Context, filename string) error {
-	path := filepath.Join(s.basedir, filename)
-	metadataPath := fmt.Sprintf("%s.metadata", path)
-	if err := os.Remove(path); err != nil {
+	// Metadata is renamed last and marks the file as complete. Metadata of a file being
+	// overwritten is removed first, so it can never be paired with the new body.
+	if err := os.Remove(metadataPath); err != nil && !os.IsNotExist(err) {
 		return err
-	} else if err := os.Remove(metadataPath); err != nil {
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	if err := os.Rename(mf.Name(), metadataPath); err != nil {
 		return err
 	}
+	syncDir(filepath.Dir(path))
+
+	// A file being overwritten may still be stored with another shard depth
+	for depth := range maxShardDepth + 1 {
+		other := s.pathAtDepth(filename, depth)
+		if other == path {
+			continue
+		}
+		for _, name := range []string{other + ".metadata", other} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
 
-func (s *LocalStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
-	filenames, metadata, err := s.List(ctx)
+// spaceCheckInterval is how many bytes are written between free space checks
+const spaceCheckInterval = 8 << 20
+
+// checkFreeSpace returns ErrInsufficientSpace if writing size more bytes would leave less than the minimum
+// free space, and starts a sweep of expired files if configured. Platforms that cannot report free space
+// are not checked.
+func (s *LocalStorage) checkFreeSpace(size uint64) error {
+	if s.minFreeSpace == 0 {
+		return nil
+	}
+
+	free, err := s.FreeSpace()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if free >= size && free-size >= s.minFreeSpace {
+		return nil
+	}
+
+	if s.onLowSpace != nil && s.sweeping.CompareAndSwap(false, true) {
+		go func() {
+			defer s.sweeping.Store(false)
+			s.onLowSpace(s.DeleteExpired(context.Background()))
+		}()
+	}
+	return ErrInsufficientSpace
+}
+
+// spaceGuardWriter fails with ErrInsufficientSpace once the disk runs low on free space while writing
+type spaceGuardWriter struct {
+	w io.Writer
+	s *LocalStorage
+	// unchecked counts the bytes written since the last check
+	unchecked int
+}
+
+func (w *spaceGuardWriter) Write(p []byte) (int, error) {
+	if w.unchecked += len(p); w.unchecked >= spaceCheckInterval {
+		w.unchecked = 0
+		if err := w.s.checkFreeSpace(0); err != nil {
+			return 0, err
+		}
+	}
+	return w.w.Write(p)
+}
+
+// createTemp creates a temporary file in the directory of path
+func createTemp(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempExt)
+}
+
+func syncAndClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir persists renames in the directory. Not every platform supports syncing
+// directories, so this is best-effort.
+func syncDir(dir string) {
+	d, err := os.Open(dir) //#nosec
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	d.Sync() //#nosec
+}
+
+// removeFile removes the file at path and its metadata. Metadata goes first, so an interrupted
+// removal leaves an orphaned body for Fsck instead of metadata pointing to nothing.
+func removeFile(path string) error {
+	if err := os.Remove(fmt.Sprintf("%s.metadata", path)); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, filename string) error {
+	return removeFile(s.existingPath(filename))
+}
+
+// Reshard moves files stored in a different layout, e.g. before sharding was enabled or
+// with another depth, to their paths in the configured layout. Files stay readable while
+// they are moved and an interrupted run can be resumed by running it again.
+func (s *LocalStorage) Reshard(ctx context.Context) (movedCount int, err error) {
+	// Collected first, as moving files while walking could visit them twice
+	var paths []string
+	err = s.walkFiles(ctx, func(path string, d os.DirEntry, metadata Metadata) error {
+		if path != s.filePath(filepath.Base(path)) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	for i, filename := range filenames {
-		if datetime.IsExpired(metadata[i].ExpiresAt) {
-			if err := s.Delete(ctx, filename); err != nil {
-				// Log error but continue with other files
-				continue
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return movedCount, err
+		}
+
+		if err := s.moveFile(path, s.filePath(filepath.Base(path))); err != nil {
+			return movedCount, err
+		}
+		movedCount++
+	}
+
+	return movedCount, nil
+}
+
+// moveFile moves a file and its metadata so that either location holds the complete file at
+// any time. The body is linked (or copied) first and the metadata is moved to commit the move.
+func (s *LocalStorage) moveFile(from, to string) error {
+	// A file written in the new location is newer than the one left behind
+	if _, err := os.Stat(to + ".metadata"); err == nil {
+		return removeFile(from)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+
+	// Left over by an interrupted move
+	if err := os.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Link(from, to); err != nil {
+		if err := copyFile(from, to); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(from+".metadata", to+".metadata"); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(to))
+
+	return os.Remove(from)
+}
+
+// copyFile is the fallback for file systems without hard links
+func copyFile(from, to string) error {
+	src, err := os.Open(from) //#nosec
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := createTemp(to)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name()) //#nosec
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := syncAndClose(dst); err != nil {
+		return err
+	}
+
+	return os.Rename(dst.Name(), to)
+}
+
+// Fsck removes leftovers of interrupted writes and deletes: temporary files, bodies without
+// metadata and metadata without a body. It returns the paths of the removed files relative to basedir.
+func (s *LocalStorage) Fsck(ctx context.Context, options FsckOptions) (removed []string, err error) {
+	if _, err := os.Stat(s.basedir); os.IsNotExist(err) {
+		// Nothing has been uploaded yet
+		return nil, nil
+	}
+
+	cutoff := time.Now().Add(-options.GracePeriod)
+	err = filepath.WalkDir(s.basedir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		var counterpart string
+		switch {
+		case isTemp(d.Name()):
+		case filepath.Ext(path) == ".metadata":
+			counterpart = strings.TrimSuffix(path, ".metadata")
+		default:
+			counterpart = path + ".metadata"
+		}
+		if counterpart != "" {
+			if _, err := os.Stat(counterpart); err == nil {
+				return nil
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if !options.DryRun {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
 			}
-			deletedCount++
 		}
+
+		relPath, err := filepath.Rel(s.basedir, path)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, relPath)
+		return nil
+	})
+	return removed, err
+}
+
+func (s *LocalStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+// CheckHealth writes, reads back and removes a probe file, which is hidden from listings like other temporary files
+func (s *LocalStorage) CheckHealth(ctx context.Context) error {
+	probe := []byte("fileigloo health check")
+
+	f, err := createTemp(filepath.Join(s.basedir, "healthcheck"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //#nosec
+
+	if _, err := f.Write(probe); err != nil {
+		f.Close()
+		return err
 	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	} else if !bytes.Equal(content, probe) {
+		return errors.New("health check file read back with different content")
+	}
+	return os.Remove(f.Name())
+}
 
-	return deletedCount, nil
+func (s *LocalStorage) FreeSpace() (uint64, error) {
+	return diskFreeSpace(s.basedir)
 }
 
 func (s *LocalStorage) FileNotExists(err error) bool {
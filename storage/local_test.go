@@ -3,11 +3,15 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/exler/fileigloo/storage"
 )
@@ -52,9 +56,9 @@ func TestLocalStorage_Put(t *testing.T) {
 		metadata := storage.Metadata{
 			Filename:      "original.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 			PasswordHash:  "hash123",
-			ExpiresAt:     "2025-12-31T23:59:59Z",
+			ExpiresAt:     time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC),
 		}
 
 		err := s.Put(ctx, filename, reader, metadata)
@@ -94,7 +98,7 @@ func TestLocalStorage_Put(t *testing.T) {
 		metadata1 := storage.Metadata{
 			Filename:      "first.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 		}
 
 		err := s.Put(ctx, filename, reader1, metadata1)
@@ -108,7 +112,7 @@ func TestLocalStorage_Put(t *testing.T) {
 		metadata2 := storage.Metadata{
 			Filename:      "second.txt",
 			ContentType:   "text/plain",
-			ContentLength: "14",
+			ContentLength: 14,
 		}
 
 		err = s.Put(ctx, filename, reader2, metadata2)
@@ -145,7 +149,7 @@ func TestLocalStorage_Get(t *testing.T) {
 		metadata := storage.Metadata{
 			Filename:      "original.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 		}
 
 		err := s.Put(ctx, filename, reader, metadata)
@@ -201,9 +205,9 @@ func TestLocalStorage_GetWithMetadata(t *testing.T) {
 		originalMetadata := storage.Metadata{
 			Filename:      "original.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 			PasswordHash:  "hash123",
-			ExpiresAt:     "2025-12-31T23:59:59Z",
+			ExpiresAt:     time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC),
 		}
 
 		err := s.Put(ctx, filename, reader, originalMetadata)
@@ -235,12 +239,12 @@ func TestLocalStorage_GetWithMetadata(t *testing.T) {
 			t.Errorf("ContentType mismatch. Expected: %s, Got: %s", originalMetadata.ContentType, metadata.ContentType)
 		}
 		if metadata.ContentLength != originalMetadata.ContentLength {
-			t.Errorf("ContentLength mismatch. Expected: %s, Got: %s", originalMetadata.ContentLength, metadata.ContentLength)
+			t.Errorf("ContentLength mismatch. Expected: %d, Got: %d", originalMetadata.ContentLength, metadata.ContentLength)
 		}
 		if metadata.PasswordHash != originalMetadata.PasswordHash {
 			t.Errorf("PasswordHash mismatch. Expected: %s, Got: %s", originalMetadata.PasswordHash, metadata.PasswordHash)
 		}
-		if metadata.ExpiresAt != originalMetadata.ExpiresAt {
+		if !metadata.ExpiresAt.Equal(originalMetadata.ExpiresAt) {
 			t.Errorf("ExpiresAt mismatch. Expected: %s, Got: %s", originalMetadata.ExpiresAt, metadata.ExpiresAt)
 		}
 	})
@@ -263,9 +267,9 @@ func TestLocalStorage_GetOnlyMetadata(t *testing.T) {
 		originalMetadata := storage.Metadata{
 			Filename:      "original.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 			PasswordHash:  "hash123",
-			ExpiresAt:     "2025-12-31T23:59:59Z",
+			ExpiresAt:     time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC),
 		}
 
 		err := s.Put(ctx, filename, reader, originalMetadata)
@@ -287,12 +291,12 @@ func TestLocalStorage_GetOnlyMetadata(t *testing.T) {
 			t.Errorf("ContentType mismatch. Expected: %s, Got: %s", originalMetadata.ContentType, metadata.ContentType)
 		}
 		if metadata.ContentLength != originalMetadata.ContentLength {
-			t.Errorf("ContentLength mismatch. Expected: %s, Got: %s", originalMetadata.ContentLength, metadata.ContentLength)
+			t.Errorf("ContentLength mismatch. Expected: %d, Got: %d", originalMetadata.ContentLength, metadata.ContentLength)
 		}
 		if metadata.PasswordHash != originalMetadata.PasswordHash {
 			t.Errorf("PasswordHash mismatch. Expected: %s, Got: %s", originalMetadata.PasswordHash, metadata.PasswordHash)
 		}
-		if metadata.ExpiresAt != originalMetadata.ExpiresAt {
+		if !metadata.ExpiresAt.Equal(originalMetadata.ExpiresAt) {
 			t.Errorf("ExpiresAt mismatch. Expected: %s, Got: %s", originalMetadata.ExpiresAt, metadata.ExpiresAt)
 		}
 	})
@@ -320,7 +324,7 @@ func TestLocalStorage_List(t *testing.T) {
 				metadata: storage.Metadata{
 					Filename:      "original1.txt",
 					ContentType:   "text/plain",
-					ContentLength: "9",
+					ContentLength: 9,
 				},
 			},
 			{
@@ -329,7 +333,7 @@ func TestLocalStorage_List(t *testing.T) {
 				metadata: storage.Metadata{
 					Filename:      "original2.txt",
 					ContentType:   "text/plain",
-					ContentLength: "9",
+					ContentLength: 9,
 				},
 			},
 		}
@@ -410,7 +414,7 @@ func TestLocalStorage_Delete(t *testing.T) {
 		metadata := storage.Metadata{
 			Filename:      "original.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
+			ContentLength: 13,
 		}
 
 		err := s.Put(ctx, filename, reader, metadata)
@@ -470,8 +474,8 @@ func TestLocalStorage_DeleteExpired(t *testing.T) {
 		expiredMetadata := storage.Metadata{
 			Filename:      "expired.txt",
 			ContentType:   "text/plain",
-			ContentLength: "15",
-			ExpiresAt:     "2020-01-01T00:00:00Z", // Already expired
+			ContentLength: 15,
+			ExpiresAt:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), // Already expired
 		}
 
 		err := s.Put(ctx, expiredFile, expiredReader, expiredMetadata)
@@ -486,8 +490,8 @@ func TestLocalStorage_DeleteExpired(t *testing.T) {
 		validMetadata := storage.Metadata{
 			Filename:      "valid.txt",
 			ContentType:   "text/plain",
-			ContentLength: "13",
-			ExpiresAt:     "2099-01-01T00:00:00Z", // Future date
+			ContentLength: 13,
+			ExpiresAt:     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC), // Future date
 		}
 
 		err = s.Put(ctx, validFile, validReader, validMetadata)
@@ -502,8 +506,8 @@ func TestLocalStorage_DeleteExpired(t *testing.T) {
 		noExpiryMetadata := storage.Metadata{
 			Filename:      "no-expiry.txt",
 			ContentType:   "text/plain",
-			ContentLength: "17",
-			ExpiresAt:     "", // No expiration
+			ContentLength: 17,
+			ExpiresAt:     time.Time{}, // No expiration
 		}
 
 		err = s.Put(ctx, noExpiryFile, noExpiryReader, noExpiryMetadata)
@@ -580,3 +584,497 @@ func TestLocalStorage_FileNotExists(t *testing.T) {
 		}
 	})
 }
+
+func TestLocalStorage_Checksum(t *testing.T) {
+	tempDir := t.TempDir()
+	s, err := storage.NewLocalStorage(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	t.Run("records checksum of content", func(t *testing.T) {
+		if err := s.Put(ctx, "test.txt", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		metadata, err := s.GetOnlyMetadata(ctx, "test.txt")
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.Checksum != helloWorldChecksum {
+			t.Errorf("Checksum mismatch. Expected: %s, Got: %s", helloWorldChecksum, metadata.Checksum)
+		}
+	})
+
+	t.Run("rejects content not matching expected checksum", func(t *testing.T) {
+		metadata := storage.Metadata{Checksum: helloWorldChecksum}
+		err := s.Put(ctx, "corrupted.txt", bytes.NewBufferString("Hello, World"), metadata)
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+		}
+
+		if _, err := s.Get(ctx, "corrupted.txt"); !s.FileNotExists(err) {
+			t.Errorf("Expected corrupted file not to be stored")
+		}
+	})
+
+	t.Run("detects corrupted files", func(t *testing.T) {
+		if err := s.Put(ctx, "rotten.txt", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		if err := storage.VerifyChecksum(ctx, s, "rotten.txt"); err != nil {
+			t.Fatalf("Expected intact file to verify, got %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(tempDir, "rotten.txt"), []byte("Hello, World?"), 0600); err != nil {
+			t.Fatalf("Failed to corrupt file: %v", err)
+		}
+		if err := storage.VerifyChecksum(ctx, s, "rotten.txt"); !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+		}
+	})
+}
+
+func TestLocalStorage_AtomicPut(t *testing.T) {
+	tempDir := t.TempDir()
+	s, err := storage.NewLocalStorage(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	t.Run("leaves no temporary files", func(t *testing.T) {
+		if err := s.Put(ctx, "test.txt", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("Expected only the file and its metadata, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("keeps existing file when overwrite fails", func(t *testing.T) {
+		if err := s.Put(ctx, "kept.txt", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		metadata := storage.Metadata{Checksum: strings.Repeat("0", 64)}
+		if err := s.Put(ctx, "kept.txt", bytes.NewBufferString("Corrupted"), metadata); !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+		}
+
+		if err := storage.VerifyChecksum(ctx, s, "kept.txt"); err != nil {
+			t.Errorf("Expected original file to be intact: %v", err)
+		}
+	})
+
+	t.Run("lists only files with metadata", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(tempDir, "incomplete.txt"), []byte("partial"), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		for _, filename := range filenames {
+			if filename == "incomplete.txt" {
+				t.Errorf("Expected file without metadata not to be listed")
+			}
+		}
+	})
+}
+
+func TestLocalStorage_Fsck(t *testing.T) {
+	tempDir := t.TempDir()
+	s, err := storage.NewLocalStorage(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "complete", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+		t.Fatalf("Failed to put file: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	leftovers := []string{"body-only", "metadata-only.metadata", ".complete.123456.tmp"}
+	for _, name := range append(leftovers, "recent-body-only") {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, []byte("leftover"), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if name != "recent-body-only" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("Failed to change file times: %v", err)
+			}
+		}
+	}
+
+	t.Run("reports leftovers in dry run", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{GracePeriod: time.Hour, DryRun: true})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		if len(removed) != len(leftovers) {
+			t.Errorf("Expected %v, got %v", leftovers, removed)
+		}
+		for _, name := range leftovers {
+			if _, err := os.Stat(filepath.Join(tempDir, name)); err != nil {
+				t.Errorf("Expected %s to be kept in dry run: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("removes leftovers older than grace period", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{GracePeriod: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		if len(removed) != len(leftovers) {
+			t.Errorf("Expected %v, got %v", leftovers, removed)
+		}
+
+		for _, name := range leftovers {
+			if _, err := os.Stat(filepath.Join(tempDir, name)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed", name)
+			}
+		}
+		for _, name := range []string{"complete", "complete.metadata", "recent-body-only"} {
+			if _, err := os.Stat(filepath.Join(tempDir, name)); err != nil {
+				t.Errorf("Expected %s to be kept: %v", name, err)
+			}
+		}
+	})
+}
+
+func TestLocalStorage_Sharding(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("stores files in shard directories", func(t *testing.T) {
+		tempDir := t.TempDir()
+		s, err := storage.NewLocalStorage(tempDir, storage.ShardDepth(2))
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+
+		if err := s.Put(ctx, "abcdEFGHijkl", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		for _, name := range []string{"abcdEFGHijkl", "abcdEFGHijkl.metadata"} {
+			if _, err := os.Stat(filepath.Join(tempDir, "ab", "cd", name)); err != nil {
+				t.Errorf("Expected %s in shard directory: %v", name, err)
+			}
+		}
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != 1 || filenames[0] != "abcdEFGHijkl" {
+			t.Errorf("Expected [abcdEFGHijkl], got %v", filenames)
+		}
+	})
+
+	t.Run("rejects invalid depth", func(t *testing.T) {
+		if _, err := storage.NewLocalStorage(t.TempDir(), storage.ShardDepth(5)); err == nil {
+			t.Error("Expected error for invalid shard depth, got nil")
+		}
+	})
+
+	t.Run("reads flat files and reshards them", func(t *testing.T) {
+		tempDir := t.TempDir()
+		flat, _ := storage.NewLocalStorage(tempDir)
+		for _, filename := range []string{"abcdEFGHijkl", "x"} {
+			if err := flat.Put(ctx, filename, bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+				t.Fatalf("Failed to put file %s: %v", filename, err)
+			}
+		}
+
+		sharded, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(1))
+		if err := storage.VerifyChecksum(ctx, sharded, "abcdEFGHijkl"); err != nil {
+			t.Fatalf("Failed to read flat file: %v", err)
+		}
+
+		movedCount, err := sharded.Reshard(ctx)
+		if err != nil {
+			t.Fatalf("Failed to reshard: %v", err)
+		}
+		// IDs shorter than the shard prefix stay in place
+		if movedCount != 1 {
+			t.Errorf("Expected 1 moved file, got %d", movedCount)
+		}
+
+		if _, err := os.Stat(filepath.Join(tempDir, "ab", "abcdEFGHijkl.metadata")); err != nil {
+			t.Errorf("Expected file to be moved: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "abcdEFGHijkl")); !os.IsNotExist(err) {
+			t.Errorf("Expected flat file to be removed")
+		}
+		if err := storage.VerifyChecksum(ctx, sharded, "abcdEFGHijkl"); err != nil {
+			t.Errorf("Failed to read resharded file: %v", err)
+		}
+	})
+
+	t.Run("reads files stored with another depth", func(t *testing.T) {
+		tempDir := t.TempDir()
+		deep, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(2))
+		if err := deep.Put(ctx, "abcdEFGHijkl", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		for _, depth := range []int{0, 1, 3} {
+			s, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(depth))
+			if err := storage.VerifyChecksum(ctx, s, "abcdEFGHijkl"); err != nil {
+				t.Errorf("Failed to read file stored with depth 2 at depth %d: %v", depth, err)
+			}
+		}
+
+		shallow, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(1))
+		if err := shallow.Delete(ctx, "abcdEFGHijkl"); err != nil {
+			t.Fatalf("Failed to delete file: %v", err)
+		}
+		if _, err := deep.GetOnlyMetadata(ctx, "abcdEFGHijkl"); !deep.FileNotExists(err) {
+			t.Errorf("Expected file to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("overwrite removes copies stored with another depth", func(t *testing.T) {
+		tempDir := t.TempDir()
+		for _, depth := range []int{0, 2} {
+			s, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(depth))
+			if err := s.Put(ctx, "abcdEFGHijkl", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+				t.Fatalf("Failed to put file at depth %d: %v", depth, err)
+			}
+		}
+
+		s, _ := storage.NewLocalStorage(tempDir, storage.ShardDepth(1))
+		if err := s.Put(ctx, "abcdEFGHijkl", bytes.NewBufferString("Hello again!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to overwrite file: %v", err)
+		}
+
+		for _, dir := range []string{tempDir, filepath.Join(tempDir, "ab", "cd")} {
+			for _, name := range []string{"abcdEFGHijkl", "abcdEFGHijkl.metadata"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to be removed from %s", name, dir)
+				}
+			}
+		}
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != 1 {
+			t.Errorf("Expected a single file, got %v", filenames)
+		}
+	})
+
+	t.Run("walk stops on error", func(t *testing.T) {
+		s, _ := storage.NewLocalStorage(t.TempDir())
+		putTestFiles(t, s)
+
+		stop := errors.New("stop")
+		var visited int
+		err := s.Walk(ctx, func(filename string, metadata storage.Metadata) error {
+			visited++
+			return stop
+		})
+		if !errors.Is(err, stop) || visited != 1 {
+			t.Errorf("Expected walk to stop after first file, got %v after %d files", err, visited)
+		}
+	})
+}
+
+func TestLocalStorage_CheckHealth(t *testing.T) {
+	ctx := context.Background()
+	newStorage := func(t *testing.T) (*storage.LocalStorage, string) {
+		tempDir := t.TempDir()
+		s, err := storage.NewLocalStorage(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+		return s, tempDir
+	}
+
+	t.Run("healthy storage leaves no files behind", func(t *testing.T) {
+		s, tempDir := newStorage(t)
+
+		if err := s.CheckHealth(ctx); err != nil {
+			t.Fatalf("Expected storage to be healthy, got %v", err)
+		}
+
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Expected no files to be left behind, got %d", len(entries))
+		}
+	})
+
+	t.Run("fresh directory is healthy", func(t *testing.T) {
+		s, err := storage.NewLocalStorage(filepath.Join(t.TempDir(), "uploads"))
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+
+		if err := s.CheckHealth(ctx); err != nil {
+			t.Errorf("Expected storage to be healthy before the first upload, got %v", err)
+		}
+	})
+
+	t.Run("missing directory is unhealthy", func(t *testing.T) {
+		s, tempDir := newStorage(t)
+		os.RemoveAll(tempDir)
+
+		if err := s.CheckHealth(ctx); err == nil {
+			t.Error("Expected error for missing directory, got nil")
+		}
+	})
+
+	t.Run("reports free space", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		free, err := storage.FreeSpace(s)
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip("Free space is not supported on this platform")
+		} else if err != nil {
+			t.Fatalf("Failed to get free space: %v", err)
+		}
+		if free == 0 {
+			t.Error("Expected free space to be reported")
+		}
+	})
+}
+
+func TestLocalStorage_MinFreeSpace(t *testing.T) {
+	ctx := context.Background()
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("Free space is not supported on this platform")
+	}
+
+	t.Run("rejects files when disk is low on space", func(t *testing.T) {
+		tempDir := t.TempDir()
+		s := mustLocalStorage(t, tempDir, storage.MinFreeSpace(math.MaxUint64))
+
+		err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{})
+		if !errors.Is(err, storage.ErrInsufficientSpace) {
+			t.Fatalf("Expected ErrInsufficientSpace, got %v", err)
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+			t.Errorf("Expected no files to be written, got %d", len(entries))
+		}
+	})
+
+	t.Run("rejects files larger than the free space", func(t *testing.T) {
+		s := mustLocalStorage(t, t.TempDir(), storage.MinFreeSpace(1))
+
+		err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{
+			ContentLength: math.MaxInt64,
+		})
+		if !errors.Is(err, storage.ErrInsufficientSpace) {
+			t.Errorf("Expected ErrInsufficientSpace, got %v", err)
+		}
+	})
+
+	t.Run("stops writing when disk runs low on space", func(t *testing.T) {
+		tempDir := t.TempDir()
+		free, err := mustLocalStorage(t, tempDir).FreeSpace()
+		if err != nil {
+			t.Fatalf("Failed to get free space: %v", err)
+		}
+
+		// The file is larger than the space left above the minimum, but its size is not declared
+		s := mustLocalStorage(t, tempDir, storage.MinFreeSpace(free-4<<20))
+		reader := io.LimitReader(zeroReader{}, 32<<20)
+		if err := s.Put(ctx, "file", reader, storage.Metadata{}); !errors.Is(err, storage.ErrInsufficientSpace) {
+			t.Fatalf("Expected ErrInsufficientSpace, got %v", err)
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+			t.Errorf("Expected partial file to be removed, got %d files", len(entries))
+		}
+	})
+
+	t.Run("sweeps expired files when disk is low on space", func(t *testing.T) {
+		tempDir := t.TempDir()
+		putTestFiles(t, mustLocalStorage(t, tempDir))
+
+		swept := make(chan int, 1)
+		s := mustLocalStorage(t, tempDir, storage.MinFreeSpace(math.MaxUint64), storage.SweepOnLowSpace(func(deletedCount int, err error) {
+			if err != nil {
+				t.Errorf("Failed to sweep expired files: %v", err)
+			}
+			swept <- deletedCount
+		}))
+
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); !errors.Is(err, storage.ErrInsufficientSpace) {
+			t.Fatalf("Expected ErrInsufficientSpace, got %v", err)
+		}
+		select {
+		case deletedCount := <-swept:
+			if deletedCount != 1 {
+				t.Errorf("Expected 1 expired file to be deleted, got %d", deletedCount)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected expired files to be swept")
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "valid"); err != nil {
+			t.Errorf("Expected valid file to be kept, got %v", err)
+		}
+	})
+}
+
+func mustLocalStorage(t *testing.T, directory string, options ...storage.LocalOptionFn) *storage.LocalStorage {
+	t.Helper()
+
+	s, err := storage.NewLocalStorage(directory, options...)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	return s
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestLocalStorage_Version1Metadata(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	// As written by fileigloo before metadata was versioned
+	if err := os.WriteFile(filepath.Join(tempDir, "legacy"), []byte("Hello, World!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"Filename":"legacy.txt","ContentType":"text/plain","ContentLength":"13","PasswordHash":"","ExpiresAt":"2020-01-01T00:00:00Z"}`
+	if err := os.WriteFile(filepath.Join(tempDir, "legacy.metadata"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := storage.NewLocalStorage(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+
+	metadata, err := s.GetOnlyMetadata(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("Failed to get metadata: %v", err)
+	}
+	if metadata.ContentLength != 13 || !metadata.IsExpired() {
+		t.Errorf("Expected size 13 and expired file, got %+v", metadata)
+	}
+
+	if deletedCount, err := s.DeleteExpired(ctx); err != nil || deletedCount != 1 {
+		t.Errorf("Expected legacy file to be deleted as expired, got %d, %v", deletedCount, err)
+	}
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFileTooLarge is returned when a file does not fit into the storage even when empty
+var ErrFileTooLarge = errors.New("file is larger than the storage size limit")
+
+// MemoryStorage keeps files in memory, e.g. for tests and ephemeral instances. When the size
+// limit is reached, the least recently used files are evicted to make room for new ones.
+type MemoryStorage struct {
+	Storage
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*list.Element
+	// lru holds *memoryFile values, most recently used first
+	lru *list.List
+}
+
+type memoryFile struct {
+	filename string
+	content  []byte
+	metadata Metadata
+	modTime  time.Time
+}
+
+// NewMemoryStorage creates an empty storage holding at most maxSize bytes of file content,
+// 0 means unlimited
+func NewMemoryStorage(maxSize int64) (*MemoryStorage, error) {
+	if maxSize < 0 {
+		return nil, errors.New("memory storage size limit must not be negative")
+	}
+
+	return &MemoryStorage{
+		maxSize: maxSize,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+func (s *MemoryStorage) Type() string {
+	return "memory"
+}
+
+func notExistError(filename string) error {
+	return fmt.Errorf("file %s: %w", filename, fs.ErrNotExist)
+}
+
+// get returns the file and marks it as recently used if touch is set
+func (s *MemoryStorage) get(filename string, touch bool) (*memoryFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.files[filename]
+	if !ok {
+		return nil, notExistError(filename)
+	}
+	if touch {
+		s.lru.MoveToFront(element)
+	}
+	return element.Value.(*memoryFile), nil
+}
+
+func (s *MemoryStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+func (s *MemoryStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		// Files are yielded from a snapshot, so the consumer may modify the storage
+		s.mu.Lock()
+		var objects []Object
+		for filename, element := range s.files {
+			file := element.Value.(*memoryFile)
+			if options.matchesStored(filename, file.modTime) && options.matchesMetadata(file.metadata) {
+				objects = append(objects, Object{Filename: filename, Metadata: file.metadata, ModTime: file.modTime})
+			}
+		}
+		s.mu.Unlock()
+
+		slices.SortFunc(objects, func(a, b Object) int {
+			return strings.Compare(a.Filename, b.Filename)
+		})
+
+		for _, object := range objects {
+			if err := ctx.Err(); err != nil {
+				yield(Object{}, err)
+				return
+			}
+			if !yield(object, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	file, err := s.get(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(file.content)), nil
+}
+
+func (s *MemoryStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	file, err := s.get(filename, true)
+	if err != nil {
+		return nil, metadata, err
+	}
+	return io.NopCloser(bytes.NewReader(file.content)), file.metadata, nil
+}
+
+func (s *MemoryStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	file, err := s.get(filename, false)
+	if err != nil {
+		return metadata, err
+	}
+	return file.metadata, nil
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	// Reading one byte over the limit is enough to reject files that are too large
+	if s.maxSize > 0 {
+		reader = io.LimitReader(reader, s.maxSize+1)
+	}
+
+	checksum := newChecksumReader(reader)
+	content, err := io.ReadAll(checksum)
+	if err != nil {
+		return err
+	}
+
+	if s.maxSize > 0 && int64(len(content)) > s.maxSize {
+		return ErrFileTooLarge
+	} else if metadata.ContentEncoding == "" {
+		if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+			return ErrChecksumMismatch
+		}
+		metadata.Checksum = checksum.Sum()
+	}
+	// Other storages keep a copy of the labels, so changes made by the caller are not stored
+	metadata.Labels = maps.Clone(metadata.Labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.files[filename]; ok {
+		s.remove(element)
+	}
+	for s.maxSize > 0 && s.size+int64(len(content)) > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+
+	s.files[filename] = s.lru.PushFront(&memoryFile{
+		filename: filename,
+		content:  content,
+		metadata: metadata,
+		modTime:  time.Now(),
+	})
+	s.size += int64(len(content))
+
+	return nil
+}
+
+// remove must be called with the lock held
+func (s *MemoryStorage) remove(element *list.Element) {
+	file := s.lru.Remove(element).(*memoryFile)
+	delete(s.files, file.filename)
+	s.size -= int64(len(file.content))
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.files[filename]
+	if !ok {
+		return notExistError(filename)
+	}
+	s.remove(element)
+
+	return nil
+}
+
+func (s *MemoryStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+func (s *MemoryStorage) FileNotExists(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
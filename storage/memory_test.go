@@ -0,0 +1,132 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+func TestNewMemoryStorage(t *testing.T) {
+	t.Run("returns error for negative size limit", func(t *testing.T) {
+		if _, err := storage.NewMemoryStorage(-1); err == nil {
+			t.Error("Expected error for negative size limit, got nil")
+		}
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("puts and gets file with metadata", func(t *testing.T) {
+		s, err := storage.NewMemoryStorage(0)
+		if err != nil {
+			t.Fatalf("Failed to create memory storage: %v", err)
+		}
+		files := putTestFiles(t, s)
+
+		reader, metadata, err := s.GetWithMetadata(ctx, "valid")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+
+		if string(content) != "Hello, World!" {
+			t.Errorf("Content mismatch: %s", content)
+		}
+		if !metadata.Equal(files["valid"]) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", files["valid"], metadata)
+		}
+
+		deletedCount, err := s.DeleteExpired(ctx)
+		if err != nil || deletedCount != 1 {
+			t.Errorf("Expected 1 deleted file, got %d (%v)", deletedCount, err)
+		}
+	})
+
+	t.Run("returns not exists error for missing files", func(t *testing.T) {
+		s, _ := storage.NewMemoryStorage(0)
+
+		if _, err := s.Get(ctx, "missing"); !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+		if err := s.Delete(ctx, "missing"); !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+		if s.FileNotExists(nil) {
+			t.Error("Expected FileNotExists to return false for nil error")
+		}
+	})
+
+	t.Run("evicts least recently used files", func(t *testing.T) {
+		s, _ := storage.NewMemoryStorage(10)
+
+		for _, filename := range []string{"first", "second"} {
+			if err := s.Put(ctx, filename, bytes.NewBufferString("12345"), storage.Metadata{}); err != nil {
+				t.Fatalf("Failed to put file %s: %v", filename, err)
+			}
+		}
+
+		// Reading the first file makes the second one the least recently used
+		reader, err := s.Get(ctx, "first")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		reader.Close()
+
+		if err := s.Put(ctx, "third", bytes.NewBufferString("12345"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		if _, err := s.GetOnlyMetadata(ctx, "second"); !s.FileNotExists(err) {
+			t.Errorf("Expected second file to be evicted")
+		}
+		for _, filename := range []string{"first", "third"} {
+			if _, err := s.GetOnlyMetadata(ctx, filename); err != nil {
+				t.Errorf("Expected %s to be kept: %v", filename, err)
+			}
+		}
+	})
+
+	t.Run("rejects files over size limit", func(t *testing.T) {
+		s, _ := storage.NewMemoryStorage(10)
+
+		err := s.Put(ctx, "large", bytes.NewBufferString("more than ten bytes"), storage.Metadata{})
+		if !errors.Is(err, storage.ErrFileTooLarge) {
+			t.Errorf("Expected ErrFileTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		s, _ := storage.NewMemoryStorage(100)
+
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				filename := fmt.Sprintf("file%d", i)
+				if err := s.Put(ctx, filename, bytes.NewBufferString("0123456789"), storage.Metadata{}); err != nil {
+					t.Errorf("Failed to put file %s: %v", filename, err)
+				}
+				s.List(ctx)
+			}()
+		}
+		wg.Wait()
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != 10 {
+			t.Errorf("Expected 10 files to fit, got %d", len(filenames))
+		}
+	})
+}
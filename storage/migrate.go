@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type MigrateOptions struct {
+	// Concurrency is the number of files copied in parallel, defaults to 1
+	Concurrency int
+
+	// SkipExpired leaves out files that have already expired
+	SkipExpired bool
+
+	// OnFile, if set, is called after each file has been processed. It may be called concurrently.
+	OnFile func(filename string, status MigrateStatus, err error)
+}
+
+type MigrateStatus int
+
+const (
+	MigrateCopied MigrateStatus = iota
+	// MigrateSkipped is reported for expired files and files already present in the destination
+	MigrateSkipped
+	MigrateFailed
+)
+
+type MigrateResult struct {
+	Copied  int
+	Skipped int
+	Failed  int
+}
+
+// Migrate copies every file and its metadata from one storage to another, keeping file IDs.
+// Files that already exist in the destination with the same metadata are skipped, so an
+// interrupted migration can be resumed by running it again. Every copy is read back and
+// compared with the source, mismatching copies are removed and reported as failed.
+func Migrate(ctx context.Context, from, to Storage, options MigrateOptions) (result MigrateResult, err error) {
+	filenames, metadata, err := from.List(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	concurrency := max(options.Concurrency, 1)
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				status, err := migrateFile(ctx, from, to, filenames[i], metadata[i], options.SkipExpired)
+
+				mu.Lock()
+				switch status {
+				case MigrateCopied:
+					result.Copied++
+				case MigrateSkipped:
+					result.Skipped++
+				case MigrateFailed:
+					result.Failed++
+				}
+				mu.Unlock()
+
+				if options.OnFile != nil {
+					options.OnFile(filenames[i], status, err)
+				}
+			}
+		}()
+	}
+
+	for i := range filenames {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return result, ctx.Err()
+}
+
+func migrateFile(ctx context.Context, from, to Storage, filename string, metadata Metadata, skipExpired bool) (MigrateStatus, error) {
+	if skipExpired && metadata.IsExpired() {
+		return MigrateSkipped, nil
+	}
+
+	existing, err := to.GetOnlyMetadata(ctx, filename)
+	if metadata.Checksum == "" {
+		// The destination computes checksums for files stored without one
+		existing.Checksum = ""
+	}
+	if err == nil && existing.Equal(metadata) {
+		return MigrateSkipped, nil
+	} else if err != nil && !to.FileNotExists(err) {
+		return MigrateFailed, err
+	}
+
+	reader, err := from.Get(ctx, filename)
+	if err != nil {
+		return MigrateFailed, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	if err := to.Put(ctx, filename, io.TeeReader(reader, io.MultiWriter(hash, counter)), metadata); err != nil {
+		return MigrateFailed, err
+	}
+
+	if err := verifyCopy(ctx, to, filename, metadata, counter.n, hash.Sum(nil)); err != nil {
+		to.Delete(ctx, filename) //#nosec
+		return MigrateFailed, err
+	}
+
+	return MigrateCopied, nil
+}
+
+// verifyCopy reads the copied file back and compares its size and SHA-256 with the source
+func verifyCopy(ctx context.Context, to Storage, filename string, metadata Metadata, size int64, checksum []byte) error {
+	// The size of encoded files differs from the uploaded size
+	if metadata.ContentLength != 0 && metadata.ContentEncoding == "" && metadata.ContentLength != size {
+		return fmt.Errorf("source size %d does not match metadata size %d", size, metadata.ContentLength)
+	}
+
+	reader, err := to.Get(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	copied, err := io.Copy(hash, reader)
+	if err != nil {
+		return err
+	}
+
+	if copied != size {
+		return fmt.Errorf("copied size %d does not match source size %d", copied, size)
+	} else if !bytes.Equal(hash.Sum(nil), checksum) {
+		return errors.New("copied checksum does not match source checksum")
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,152 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+// corruptingStorage drops the last byte of every stored file
+type corruptingStorage struct {
+	*storage.LocalStorage
+}
+
+func (s *corruptingStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata storage.Metadata) error {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return s.LocalStorage.Put(ctx, filename, bytes.NewReader(content[:len(content)-1]), metadata)
+}
+
+// helloWorldChecksum is the SHA-256 of "Hello, World!"
+const helloWorldChecksum = "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"
+
+func putTestFiles(t *testing.T, s storage.Storage) map[string]storage.Metadata {
+	t.Helper()
+
+	files := map[string]storage.Metadata{
+		"valid": {
+			Filename:      "valid.txt",
+			ContentType:   "text/plain",
+			ContentLength: 13,
+			PasswordHash:  "hash123",
+			ExpiresAt:     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+			Checksum:      helloWorldChecksum,
+		},
+		"expired": {
+			Filename:      "expired.txt",
+			ContentType:   "text/plain",
+			ContentLength: 13,
+			ExpiresAt:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Checksum:      helloWorldChecksum,
+		},
+	}
+	for filename, metadata := range files {
+		if err := s.Put(context.Background(), filename, bytes.NewBufferString("Hello, World!"), metadata); err != nil {
+			t.Fatalf("Failed to put file %s: %v", filename, err)
+		}
+	}
+	return files
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("copies files with metadata to S3", func(t *testing.T) {
+		from, err := storage.NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create local storage: %v", err)
+		}
+		to, _ := setupS3Storage(t)
+		files := putTestFiles(t, from)
+
+		result, err := storage.Migrate(ctx, from, to, storage.MigrateOptions{Concurrency: 2})
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if result.Copied != 2 || result.Skipped != 0 || result.Failed != 0 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+
+		for filename, metadata := range files {
+			reader, copiedMetadata, err := to.GetWithMetadata(ctx, filename)
+			if err != nil {
+				t.Fatalf("Failed to get migrated file %s: %v", filename, err)
+			}
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+
+			if string(content) != "Hello, World!" {
+				t.Errorf("Content mismatch for %s: %s", filename, content)
+			}
+			if !copiedMetadata.Equal(metadata) {
+				t.Errorf("Metadata mismatch for %s. Expected: %+v, Got: %+v", filename, metadata, copiedMetadata)
+			}
+		}
+	})
+
+	t.Run("skips expired files", func(t *testing.T) {
+		from, _ := storage.NewLocalStorage(t.TempDir())
+		to, _ := storage.NewLocalStorage(t.TempDir())
+		putTestFiles(t, from)
+
+		result, err := storage.Migrate(ctx, from, to, storage.MigrateOptions{SkipExpired: true})
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if result.Copied != 1 || result.Skipped != 1 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+		if _, err := to.GetOnlyMetadata(ctx, "expired"); !to.FileNotExists(err) {
+			t.Errorf("Expected expired file not to be copied")
+		}
+	})
+
+	t.Run("resumes by skipping copied files", func(t *testing.T) {
+		from, _ := storage.NewLocalStorage(t.TempDir())
+		to, _ := storage.NewLocalStorage(t.TempDir())
+		putTestFiles(t, from)
+
+		if _, err := storage.Migrate(ctx, from, to, storage.MigrateOptions{}); err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+
+		result, err := storage.Migrate(ctx, from, to, storage.MigrateOptions{})
+		if err != nil {
+			t.Fatalf("Failed to migrate again: %v", err)
+		}
+		if result.Copied != 0 || result.Skipped != 2 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+	})
+
+	t.Run("removes copies that fail verification", func(t *testing.T) {
+		from, _ := storage.NewLocalStorage(t.TempDir())
+		local, _ := storage.NewLocalStorage(t.TempDir())
+		to := &corruptingStorage{local}
+		putTestFiles(t, from)
+
+		var failed []string
+		result, err := storage.Migrate(ctx, from, to, storage.MigrateOptions{
+			OnFile: func(filename string, status storage.MigrateStatus, err error) {
+				if status == storage.MigrateFailed && err != nil {
+					failed = append(failed, filename)
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if result.Failed != 2 || len(failed) != 2 {
+			t.Errorf("Expected 2 failed files, got %+v", result)
+		}
+		if _, err := to.Get(ctx, "valid"); !to.FileNotExists(err) {
+			t.Errorf("Expected corrupted copy to be removed")
+		}
+	})
+}
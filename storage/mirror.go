@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"sync"
+)
+
+// WritePolicy decides when a write to a mirror storage succeeds
+type WritePolicy string
+
+const (
+	// WriteAll succeeds once every replica has stored the file
+	WriteAll WritePolicy = "all"
+	// WriteQuorum succeeds once a majority of replicas has stored the file
+	WriteQuorum WritePolicy = "quorum"
+	// WritePrimary succeeds once the first replica has stored the file, the other
+	// replicas are written to in the background
+	WritePrimary WritePolicy = "primary"
+)
+
+// MirrorStorage stores every file on several replicas. Reads are served by the first replica
+// that has the file, so downloads keep working while some replicas are unavailable.
+// Replicas that missed writes can be repaired with Resync.
+//
+// The mirror does not expose the optional capabilities of its replicas, so files are neither
+// uploaded nor downloaded through presigned URLs, and encoded files are always served decoded.
+type MirrorStorage struct {
+	Storage
+	replicas []Storage
+	policy   WritePolicy
+	// onReplicaError is called for failed replica writes that did not fail the whole write
+	onReplicaError func(filename string, err error)
+	// onListError is called for replicas that failed to list their files while others did not
+	onListError func(replica Storage, err error)
+
+	mu sync.Mutex
+	// pending holds channels of background writes, closed once the write is done
+	pending map[string]chan struct{}
+}
+
+type MirrorOptionFn func(*MirrorStorage)
+
+func MirrorWritePolicy(policy WritePolicy) MirrorOptionFn {
+	return func(s *MirrorStorage) {
+		s.policy = policy
+	}
+}
+
+// OnReplicaError sets a function called for every replica that failed to store a file
+// when the write as a whole succeeded, e.g. for logging. It may be called concurrently.
+func OnReplicaError(fn func(filename string, err error)) MirrorOptionFn {
+	return func(s *MirrorStorage) {
+		s.onReplicaError = fn
+	}
+}
+
+// OnListError sets a function called for every replica that failed to list its files when the
+// listing as a whole continued with the other replicas, e.g. for logging
+func OnListError(fn func(replica Storage, err error)) MirrorOptionFn {
+	return func(s *MirrorStorage) {
+		s.onListError = fn
+	}
+}
+
+func NewMirrorStorage(replicas []Storage, options ...MirrorOptionFn) (*MirrorStorage, error) {
+	if len(replicas) < 2 {
+		return nil, errors.New("mirror storage needs at least two replicas")
+	}
+
+	s := &MirrorStorage{
+		replicas: replicas,
+		policy:   WriteAll,
+		pending:  make(map[string]chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	switch s.policy {
+	case WriteAll, WriteQuorum, WritePrimary:
+	default:
+		return nil, fmt.Errorf("unknown write policy %q", s.policy)
+	}
+
+	return s, nil
+}
+
+func (s *MirrorStorage) Type() string {
+	return "mirror"
+}
+
+// Replicas returns the storages files are mirrored to, the primary one first
+func (s *MirrorStorage) Replicas() []Storage {
+	return s.replicas
+}
+
+// Wait blocks until all background writes have finished
+func (s *MirrorStorage) Wait() {
+	s.mu.Lock()
+	pending := make([]chan struct{}, 0, len(s.pending))
+	for _, done := range s.pending {
+		pending = append(pending, done)
+	}
+	s.mu.Unlock()
+
+	for _, done := range pending {
+		<-done
+	}
+}
+
+// waitPending blocks until the background write of the file, if any, has finished
+func (s *MirrorStorage) waitPending(filename string) {
+	s.mu.Lock()
+	done, ok := s.pending[filename]
+	s.mu.Unlock()
+
+	if ok {
+		<-done
+	}
+}
+
+// read calls fn with each replica until it succeeds. The returned error is only
+// a not exists error if no replica has the file.
+func (s *MirrorStorage) read(fn func(replica Storage) error) error {
+	var notExistErr error
+	var errs []error
+	for _, replica := range s.replicas {
+		err := fn(replica)
+		if err == nil {
+			return nil
+		} else if replica.FileNotExists(err) {
+			notExistErr = err
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return notExistErr
+}
+
+func (s *MirrorStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+// Iterate yields the files of all replicas, each file once. Replicas that fail to list their
+// files are skipped, so the iteration only fails if no replica could list its files.
+func (s *MirrorStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		seen := make(map[string]struct{})
+		var failed []Storage
+		var errs []error
+		for _, replica := range s.replicas {
+			for object, err := range replica.Iterate(ctx, options) {
+				if err != nil {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						yield(Object{}, ctxErr)
+						return
+					}
+					failed = append(failed, replica)
+					errs = append(errs, err)
+					break
+				}
+				if _, ok := seen[object.Filename]; ok {
+					continue
+				}
+				seen[object.Filename] = struct{}{}
+
+				if !yield(object, nil) {
+					return
+				}
+			}
+		}
+
+		if len(errs) == len(s.replicas) {
+			yield(Object{}, errors.Join(errs...))
+			return
+		}
+		if s.onListError != nil {
+			for i, err := range errs {
+				s.onListError(failed[i], err)
+			}
+		}
+	}
+}
+
+func (s *MirrorStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	err = s.read(func(replica Storage) (err error) {
+		reader, err = replica.Get(ctx, filename)
+		return
+	})
+	return
+}
+
+func (s *MirrorStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	err = s.read(func(replica Storage) (err error) {
+		reader, metadata, err = replica.GetWithMetadata(ctx, filename)
+		return
+	})
+	return
+}
+
+func (s *MirrorStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	err = s.read(func(replica Storage) (err error) {
+		metadata, err = replica.GetOnlyMetadata(ctx, filename)
+		return
+	})
+	return
+}
+
+func (s *MirrorStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	// A background write of an older version could otherwise overwrite this one
+	s.waitPending(filename)
+
+	if s.policy == WritePrimary {
+		if err := s.replicas[0].Put(ctx, filename, reader, metadata); err != nil {
+			return err
+		}
+		s.putAsync(context.WithoutCancel(ctx), filename)
+		return nil
+	}
+
+	errs := putConcurrently(ctx, s.replicas, filename, reader, metadata)
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if len(s.replicas)-len(failed) < s.required() {
+		// Files stored by only some replicas are removed, as the upload is reported as failed
+		for i, replica := range s.replicas {
+			if errs[i] == nil {
+				replica.Delete(context.WithoutCancel(ctx), filename) //#nosec
+			}
+		}
+		return errors.Join(failed...)
+	}
+
+	if s.onReplicaError != nil {
+		for _, err := range failed {
+			s.onReplicaError(filename, err)
+		}
+	}
+	return nil
+}
+
+// required returns the number of replicas that have to store a file for Put to succeed
+func (s *MirrorStorage) required() int {
+	switch s.policy {
+	case WriteQuorum:
+		return len(s.replicas)/2 + 1
+	case WritePrimary:
+		return 1
+	default:
+		return len(s.replicas)
+	}
+}
+
+// putAsync copies the file from the primary replica to the others in the background
+func (s *MirrorStorage) putAsync(ctx context.Context, filename string) {
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.pending[filename] = done
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.pending, filename)
+			s.mu.Unlock()
+			close(done)
+		}()
+
+		primary := s.replicas[0]
+		metadata, err := primary.GetOnlyMetadata(ctx, filename)
+		if err != nil {
+			if s.onReplicaError != nil {
+				s.onReplicaError(filename, err)
+			}
+			return
+		}
+
+		for _, replica := range s.replicas[1:] {
+			_, err := migrateFile(ctx, primary, replica, filename, metadata, false)
+			if err != nil && s.onReplicaError != nil {
+				s.onReplicaError(filename, err)
+			}
+		}
+	}()
+}
+
+// putConcurrently streams the content to all replicas at once and returns the error of each replica
+func putConcurrently(ctx context.Context, replicas []Storage, filename string, reader io.Reader, metadata Metadata) []error {
+	errs := make([]error, len(replicas))
+	writers := make(fanoutWriter, len(replicas))
+
+	var wg sync.WaitGroup
+	for i, replica := range replicas {
+		pr, pw := io.Pipe()
+		writers[i] = &replicaWriter{pw: pw}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			errs[i] = replica.Put(ctx, filename, pr, metadata)
+			// Unblocks the writer if the replica stopped reading early
+			pr.CloseWithError(io.ErrClosedPipe) //#nosec
+		}()
+	}
+
+	_, copyErr := io.Copy(writers, reader)
+	for _, w := range writers {
+		if copyErr != nil {
+			w.pw.CloseWithError(copyErr) //#nosec
+		} else {
+			w.pw.Close() //#nosec
+		}
+	}
+	wg.Wait()
+
+	for i, w := range writers {
+		if errs[i] == nil && w.err != nil {
+			errs[i] = w.err
+		}
+	}
+	return errs
+}
+
+var errAllReplicasFailed = errors.New("all replicas failed")
+
+type replicaWriter struct {
+	pw  *io.PipeWriter
+	err error
+}
+
+// fanoutWriter writes to all replicas that have not failed yet, so that a single
+// failing replica does not stop the others
+type fanoutWriter []*replicaWriter
+
+func (f fanoutWriter) Write(p []byte) (int, error) {
+	failed := 0
+	for _, w := range f {
+		if w.err == nil {
+			_, w.err = w.pw.Write(p)
+		}
+		if w.err != nil {
+			failed++
+		}
+	}
+
+	if failed == len(f) {
+		return 0, errAllReplicasFailed
+	}
+	return len(p), nil
+}
+
+// Delete removes the file from all replicas, it only fails with a not exists error if no replica had the file
+func (s *MirrorStorage) Delete(ctx context.Context, filename string) error {
+	// A background write could otherwise bring the file back
+	s.waitPending(filename)
+
+	deleted := false
+	var notExistErr error
+	var errs []error
+	for _, replica := range s.replicas {
+		err := replica.Delete(ctx, filename)
+		if err == nil {
+			deleted = true
+		} else if replica.FileNotExists(err) {
+			notExistErr = err
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	} else if !deleted {
+		return notExistErr
+	}
+	return nil
+}
+
+func (s *MirrorStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+// CheckHealth reports the mirror as healthy if enough replicas are healthy to satisfy its write policy.
+// With the primary policy, the primary replica has to be healthy.
+func (s *MirrorStorage) CheckHealth(ctx context.Context) error {
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = CheckHealth(ctx, replica)
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if (s.policy == WritePrimary && errs[0] != nil) || len(s.replicas)-len(failed) < s.required() {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// FreeSpace returns the least free space of the replicas kept on a local disk
+func (s *MirrorStorage) FreeSpace() (uint64, error) {
+	var free uint64
+	reported := false
+	for _, replica := range s.replicas {
+		replicaFree, err := FreeSpace(replica)
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if !reported || replicaFree < free {
+			free = replicaFree
+		}
+		reported = true
+	}
+
+	if !reported {
+		return 0, fmt.Errorf("free space of mirror storage: %w", errors.ErrUnsupported)
+	}
+	return free, nil
+}
+
+func (s *MirrorStorage) FileNotExists(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, replica := range s.replicas {
+		if replica.FileNotExists(err) {
+			return true
+		}
+	}
+	return false
+}
+
+type ResyncOptions struct {
+	// OnFile, if set, is called after each file has been processed. MigrateCopied is reported
+	// for files that were repaired on at least one replica.
+	OnFile func(filename string, status MigrateStatus, err error)
+}
+
+// Resync copies files missing from some replicas, or stored there with different metadata,
+// from the copy most replicas agree on: the one whose checksum is stored by the most replicas,
+// then the most recently created one, then the one on the first replica. Expired files are
+// skipped. Files deleted while a replica was unavailable are copied back from that replica.
+func (s *MirrorStorage) Resync(ctx context.Context, options ResyncOptions) (result MigrateResult, err error) {
+	// Repairs are only made once all files are known, as they change what replicas list
+	type replicaCopy struct {
+		metadata Metadata
+		replica  int
+	}
+	type file struct {
+		filename string
+		copies   []replicaCopy
+	}
+	var files []*file
+	byName := make(map[string]*file)
+	for i, replica := range s.replicas {
+		for object, err := range replica.Iterate(ctx, ListOptions{}) {
+			if err != nil {
+				return result, err
+			}
+			f, ok := byName[object.Filename]
+			if !ok {
+				f = &file{filename: object.Filename}
+				byName[object.Filename] = f
+				files = append(files, f)
+			}
+			f.copies = append(f.copies, replicaCopy{metadata: object.Metadata, replica: i})
+		}
+	}
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		source := f.copies[0]
+		sourceVotes := 0
+		for _, candidate := range f.copies {
+			// Copies without a checksum cannot be compared, so they only count for themselves
+			votes := 1
+			if candidate.metadata.Checksum != "" {
+				votes = 0
+				for _, other := range f.copies {
+					if other.metadata.Checksum == candidate.metadata.Checksum {
+						votes++
+					}
+				}
+			}
+
+			if votes > sourceVotes || (votes == sourceVotes && candidate.metadata.CreatedAt.After(source.metadata.CreatedAt)) {
+				source, sourceVotes = candidate, votes
+			}
+		}
+
+		fileStatus := MigrateSkipped
+		var fileErr error
+		for i, replica := range s.replicas {
+			if i == source.replica {
+				continue
+			}
+
+			status, err := migrateFile(ctx, s.replicas[source.replica], replica, f.filename, source.metadata, true)
+			if status == MigrateFailed {
+				fileStatus = MigrateFailed
+				fileErr = errors.Join(fileErr, err)
+			} else if status == MigrateCopied && fileStatus != MigrateFailed {
+				fileStatus = MigrateCopied
+			}
+		}
+
+		switch fileStatus {
+		case MigrateCopied:
+			result.Copied++
+		case MigrateSkipped:
+			result.Skipped++
+		case MigrateFailed:
+			result.Failed++
+		}
+		if options.OnFile != nil {
+			options.OnFile(f.filename, fileStatus, fileErr)
+		}
+	}
+
+	return result, nil
+}
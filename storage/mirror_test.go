@@ -0,0 +1,362 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"iter"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+var errUnavailable = errors.New("replica unavailable")
+
+// unavailableStorage fails every operation, like a storage that cannot be reached
+type unavailableStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s *unavailableStorage) Get(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return nil, errUnavailable
+}
+
+func (s *unavailableStorage) GetWithMetadata(ctx context.Context, filename string) (io.ReadCloser, storage.Metadata, error) {
+	return nil, storage.Metadata{}, errUnavailable
+}
+
+func (s *unavailableStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata storage.Metadata) error {
+	return errUnavailable
+}
+
+func (s *unavailableStorage) Iterate(ctx context.Context, options storage.ListOptions) iter.Seq2[storage.Object, error] {
+	return func(yield func(storage.Object, error) bool) {
+		yield(storage.Object{}, errUnavailable)
+	}
+}
+
+func (s *unavailableStorage) CheckHealth(ctx context.Context) error {
+	return errUnavailable
+}
+
+func newMemoryReplicas(t *testing.T, count int) []*storage.MemoryStorage {
+	t.Helper()
+
+	replicas := make([]*storage.MemoryStorage, count)
+	for i := range replicas {
+		replicas[i], _ = storage.NewMemoryStorage(0)
+	}
+	return replicas
+}
+
+func TestNewMirrorStorage(t *testing.T) {
+	replicas := newMemoryReplicas(t, 2)
+
+	t.Run("returns error for single replica", func(t *testing.T) {
+		if _, err := storage.NewMirrorStorage([]storage.Storage{replicas[0]}); err == nil {
+			t.Error("Expected error for single replica, got nil")
+		}
+	})
+
+	t.Run("returns error for unknown write policy", func(t *testing.T) {
+		_, err := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1]}, storage.MirrorWritePolicy("some"))
+		if err == nil {
+			t.Error("Expected error for unknown write policy, got nil")
+		}
+	})
+}
+
+func TestMirrorStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reads from next replica when file is missing", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1]})
+		files := putTestFiles(t, replicas[1])
+
+		reader, metadata, err := s.GetWithMetadata(ctx, "valid")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		reader.Close()
+		if !metadata.Equal(files["valid"]) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", files["valid"], metadata)
+		}
+	})
+
+	t.Run("reads from next replica when replica is unavailable", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{&unavailableStorage{replicas[0]}, replicas[1]})
+		putTestFiles(t, replicas[1])
+
+		reader, err := s.Get(ctx, "valid")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(content) != "Hello, World!" {
+			t.Errorf("Content mismatch: %s", content)
+		}
+
+		if _, err := s.Get(ctx, "missing"); s.FileNotExists(err) || !errors.Is(err, errUnavailable) {
+			t.Errorf("Expected unavailable error for file missing from available replicas, got %v", err)
+		}
+	})
+
+	t.Run("all policy fails and rolls back when a replica fails", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], &unavailableStorage{replicas[1]}})
+
+		err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{})
+		if !errors.Is(err, errUnavailable) {
+			t.Errorf("Expected unavailable error, got %v", err)
+		}
+		if _, err := replicas[0].GetOnlyMetadata(ctx, "file"); !replicas[0].FileNotExists(err) {
+			t.Errorf("Expected file to be removed from healthy replica, got %v", err)
+		}
+	})
+
+	t.Run("quorum policy tolerates failing minority", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 3)
+
+		var mu sync.Mutex
+		var replicaErrs []error
+		s, _ := storage.NewMirrorStorage(
+			[]storage.Storage{replicas[0], &unavailableStorage{replicas[1]}, replicas[2]},
+			storage.MirrorWritePolicy(storage.WriteQuorum),
+			storage.OnReplicaError(func(filename string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				replicaErrs = append(replicaErrs, err)
+			}),
+		)
+
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		for _, replica := range []*storage.MemoryStorage{replicas[0], replicas[2]} {
+			if err := storage.VerifyChecksum(ctx, replica, "file"); err != nil {
+				t.Errorf("Expected file on healthy replica: %v", err)
+			}
+		}
+		if len(replicaErrs) != 1 {
+			t.Errorf("Expected 1 replica error to be reported, got %v", replicaErrs)
+		}
+	})
+
+	t.Run("quorum policy fails without majority", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 3)
+		s, _ := storage.NewMirrorStorage(
+			[]storage.Storage{replicas[0], &unavailableStorage{replicas[1]}, &unavailableStorage{replicas[2]}},
+			storage.MirrorWritePolicy(storage.WriteQuorum),
+		)
+
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err == nil {
+			t.Error("Expected error without majority, got nil")
+		}
+	})
+
+	t.Run("primary policy writes other replicas in background", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage(
+			[]storage.Storage{replicas[0], replicas[1]},
+			storage.MirrorWritePolicy(storage.WritePrimary),
+		)
+
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{Filename: "hello.txt"}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		s.Wait()
+
+		metadata, err := replicas[1].GetOnlyMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Expected file on secondary replica: %v", err)
+		}
+		if metadata.Filename != "hello.txt" || metadata.Checksum != helloWorldChecksum {
+			t.Errorf("Metadata mismatch on secondary replica: %+v", metadata)
+		}
+	})
+
+	t.Run("lists other replicas when a replica is unavailable", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		var failed []storage.Storage
+		unavailable := &unavailableStorage{replicas[0]}
+		s, _ := storage.NewMirrorStorage([]storage.Storage{unavailable, replicas[1]},
+			storage.OnListError(func(replica storage.Storage, err error) {
+				failed = append(failed, replica)
+			}),
+		)
+		putTestFiles(t, replicas[1])
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		slices.Sort(filenames)
+		if !slices.Equal(filenames, []string{"expired", "valid"}) {
+			t.Errorf("Expected files of the available replica, got %v", filenames)
+		}
+		if len(failed) != 1 || failed[0] != unavailable {
+			t.Errorf("Expected the unavailable replica to be reported, got %v", failed)
+		}
+
+		deletedCount, err := s.DeleteExpired(ctx)
+		if err != nil {
+			t.Fatalf("Failed to delete expired files: %v", err)
+		} else if deletedCount != 1 {
+			t.Errorf("Expected 1 deleted file, got %d", deletedCount)
+		}
+	})
+
+	t.Run("listing fails when every replica is unavailable", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{&unavailableStorage{replicas[0]}, &unavailableStorage{replicas[1]}})
+
+		if _, _, err := s.List(ctx); !errors.Is(err, errUnavailable) {
+			t.Errorf("Expected unavailable error, got %v", err)
+		}
+	})
+
+	t.Run("deletes from all replicas", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1]})
+		putTestFiles(t, replicas[0])
+
+		if err := s.Delete(ctx, "valid"); err != nil {
+			t.Fatalf("Failed to delete file only on one replica: %v", err)
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "valid"); !s.FileNotExists(err) {
+			t.Errorf("Expected file to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestMirrorStorage_Resync(t *testing.T) {
+	ctx := context.Background()
+	replicas := newMemoryReplicas(t, 2)
+	s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1]})
+
+	files := putTestFiles(t, replicas[0])
+	divergent := files["valid"]
+	divergent.Filename = "renamed.txt"
+	if err := replicas[1].Put(ctx, "valid", bytes.NewBufferString("Hello, World!"), divergent); err != nil {
+		t.Fatalf("Failed to put divergent file: %v", err)
+	}
+	if err := replicas[1].Put(ctx, "secondary", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+		t.Fatalf("Failed to put file: %v", err)
+	}
+
+	result, err := s.Resync(ctx, storage.ResyncOptions{})
+	if err != nil {
+		t.Fatalf("Failed to resync: %v", err)
+	}
+	// The expired file is skipped
+	if result.Copied != 2 || result.Skipped != 1 || result.Failed != 0 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	if metadata, _ := replicas[1].GetOnlyMetadata(ctx, "valid"); !metadata.Equal(files["valid"]) {
+		t.Errorf("Expected divergent metadata to be repaired, got %+v", metadata)
+	}
+	if err := storage.VerifyChecksum(ctx, replicas[0], "secondary"); err != nil {
+		t.Errorf("Expected missing file to be copied: %v", err)
+	}
+
+	if result, err := s.Resync(ctx, storage.ResyncOptions{}); err != nil || result.Copied != 0 {
+		t.Errorf("Expected nothing to repair after resync, got %+v (%v)", result, err)
+	}
+}
+
+func TestMirrorStorage_ResyncSource(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stale := storage.Metadata{Filename: "stale.txt", Checksum: helloWorldChecksum, CreatedAt: created}
+	sum := sha256.Sum256([]byte("Hello, Mirror!"))
+	fresh := storage.Metadata{Filename: "fresh.txt", Checksum: hex.EncodeToString(sum[:]), CreatedAt: created.Add(time.Hour)}
+
+	t.Run("copies the checksum most replicas store", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 3)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1], replicas[2]})
+
+		replicas[0].Put(ctx, "file", bytes.NewBufferString("Hello, Mirror!"), fresh) //#nosec
+		replicas[1].Put(ctx, "file", bytes.NewBufferString("Hello, World!"), stale)  //#nosec
+		replicas[2].Put(ctx, "file", bytes.NewBufferString("Hello, World!"), stale)  //#nosec
+
+		if _, err := s.Resync(ctx, storage.ResyncOptions{}); err != nil {
+			t.Fatalf("Failed to resync: %v", err)
+		}
+		if metadata, _ := replicas[0].GetOnlyMetadata(ctx, "file"); !metadata.Equal(stale) {
+			t.Errorf("Expected the majority copy on the first replica, got %+v", metadata)
+		}
+	})
+
+	t.Run("copies the newest file on a tie", func(t *testing.T) {
+		replicas := newMemoryReplicas(t, 2)
+		s, _ := storage.NewMirrorStorage([]storage.Storage{replicas[0], replicas[1]})
+
+		replicas[0].Put(ctx, "file", bytes.NewBufferString("Hello, World!"), stale)  //#nosec
+		replicas[1].Put(ctx, "file", bytes.NewBufferString("Hello, Mirror!"), fresh) //#nosec
+
+		if _, err := s.Resync(ctx, storage.ResyncOptions{}); err != nil {
+			t.Fatalf("Failed to resync: %v", err)
+		}
+		if err := storage.VerifyChecksum(ctx, replicas[0], "file"); err != nil {
+			t.Errorf("Expected the newest copy on the first replica: %v", err)
+		}
+		if metadata, _ := replicas[0].GetOnlyMetadata(ctx, "file"); !metadata.Equal(fresh) {
+			t.Errorf("Expected the newest copy on the first replica, got %+v", metadata)
+		}
+	})
+}
+
+func TestMirrorStorage_CheckHealth(t *testing.T) {
+	ctx := context.Background()
+
+	newMirror := func(t *testing.T, policy storage.WritePolicy, unavailable ...int) *storage.MirrorStorage {
+		t.Helper()
+
+		replicas := make([]storage.Storage, 3)
+		for i, replica := range newMemoryReplicas(t, 3) {
+			replicas[i] = replica
+			if slices.Contains(unavailable, i) {
+				replicas[i] = &unavailableStorage{replica}
+			}
+		}
+		s, err := storage.NewMirrorStorage(replicas, storage.MirrorWritePolicy(policy))
+		if err != nil {
+			t.Fatalf("Failed to create mirror storage: %v", err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name        string
+		policy      storage.WritePolicy
+		unavailable []int
+		healthy     bool
+	}{
+		{"all with healthy replicas", storage.WriteAll, nil, true},
+		{"all with an unavailable replica", storage.WriteAll, []int{2}, false},
+		{"quorum with an unavailable replica", storage.WriteQuorum, []int{2}, true},
+		{"quorum without a majority", storage.WriteQuorum, []int{1, 2}, false},
+		{"primary with unavailable secondaries", storage.WritePrimary, []int{1, 2}, true},
+		{"primary with an unavailable primary", storage.WritePrimary, []int{0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newMirror(t, tt.policy, tt.unavailable...).CheckHealth(ctx)
+			if tt.healthy && err != nil {
+				t.Errorf("Expected mirror to be healthy, got %v", err)
+			} else if !tt.healthy && !errors.Is(err, errUnavailable) {
+				t.Errorf("Expected unavailable error, got %v", err)
+			}
+		})
+	}
+}
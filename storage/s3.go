@@ -2,72 +2,279 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/exler/fileigloo/datetime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
+// S3Config configures the connection to an S3-compatible bucket.
+// When AccessKey is empty the default AWS credential chain is used
+// (environment, shared config profile, IAM role).
+type S3Config struct {
+	Bucket       string
+	Region       string
+	EndpointURL  string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Profile      string
+
+	// UsePathStyle addresses the bucket as part of the path instead of the host (required by e.g. MinIO)
+	UsePathStyle bool
+
+	// PresignedPartSize is the part size of presigned multipart uploads in bytes, defaults to 64 MiB.
+	// Smaller files are uploaded with a single request.
+	PresignedPartSize int64
+}
+
 type S3Storage struct {
 	Storage
-	s3      *s3.S3
-	session *session.Session
-	bucket  string
+	s3       *s3.Client
+	presign  *s3.PresignClient
+	uploader *transfermanager.Client
+	bucket   string
+
+	presignedPartSize int64
 }
 
-func newAWSSession(accessKey, secretKey, sessionToken, endpointUrl, region string) *session.Session {
-	return session.Must(session.NewSession(&aws.Config{
-		Endpoint:    aws.String(endpointUrl),
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, sessionToken),
-	}))
+func newAWSConfig(ctx context.Context, cfg S3Config) (aws.Config, error) {
+	var loadOptions []func(*config.LoadOptions) error
+	if cfg.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(cfg.Region))
+	}
+	if cfg.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(cfg.Profile))
+	}
+	if cfg.AccessKey != "" {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken),
+		))
+	}
+
+	// S3-compatible services often do not support the checksums that the SDK sends by default
+	loadOptions = append(loadOptions,
+		config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	)
+
+	return config.LoadDefaultConfig(ctx, loadOptions...)
 }
 
 func (s *S3Storage) Type() string {
 	return "s3"
 }
 
-func NewS3Storage(accessKey, secretKey, sessionToken, endpointUrl, region, bucket string) (*S3Storage, error) {
-	session := newAWSSession(accessKey, secretKey, sessionToken, endpointUrl, region)
+func NewS3Storage(ctx context.Context, cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("no S3 bucket specified")
+	}
+
+	awsConfig, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if cfg.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.EndpointURL)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	})
+
+	presignedPartSize := cfg.PresignedPartSize
+	if presignedPartSize <= 0 {
+		presignedPartSize = s3DefaultPresignedPartSize
+	}
 
 	return &S3Storage{
-		s3:      s3.New(session),
-		session: session,
-		bucket:  bucket,
+		s3:                client,
+		presign:           s3.NewPresignClient(client),
+		uploader:          transfermanager.New(client),
+		bucket:            cfg.Bucket,
+		presignedPartSize: presignedPartSize,
 	}, nil
 }
 
+const (
+	s3DefaultPresignedPartSize = 64 << 20
+	s3MaxParts                 = 10000
+
+	// s3MaxCopySize is the largest object that can be copied with a single request
+	s3MaxCopySize = 5 << 30
+	// s3CopyPartSize is the part size used when copying larger objects
+	s3CopyPartSize = 1 << 30
+)
+
+// s3MaxMetadataSize is the limit of user-defined metadata, which S3 measures as the total length of its keys and values
+const s3MaxMetadataSize = 2 << 10
+
+// s3Metadata returns the metadata as user-defined metadata of an object, or ErrMetadataTooLarge if S3 would reject it
+func s3Metadata(metadata Metadata) (map[string]string, error) {
+	m := MetadataToStringMap(metadata)
+	size := 0
+	for key, value := range m {
+		size += len(key) + len(value)
+	}
+	if metadata.Checksum == "" {
+		// Put adds the checksum once the content has been read
+		size += sha256.Size * 2
+	}
+
+	if size > s3MaxMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+	return m, nil
+}
+
+// s3StagingPrefix is where presigned uploads are stored until they are completed, so that they are
+// never served without their metadata. Uploads that are never completed are removed by the lifecycle
+// rule installed with SetupLifecycle.
+const s3StagingPrefix = "fileigloo-staging/"
+
+// s3StagingExpiryDays is how long uncompleted presigned uploads are kept
+const s3StagingExpiryDays = 1
+
+// s3StagingKey returns the key a presigned upload of the file is stored under until it is completed
+func s3StagingKey(filename string) string {
+	return s3StagingPrefix + filename
+}
+
+// s3ListConcurrency bounds the number of HeadObject requests issued in parallel
+// while collecting metadata for List
+const s3ListConcurrency = 16
+
 func (s *S3Storage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
-	r := &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.bucket),
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+func (s *S3Storage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+		}
+		if options.Prefix != "" {
+			input.Prefix = aws.String(options.Prefix)
+		}
+
+		paginator := s3.NewListObjectsV2Paginator(s.s3, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(Object{}, err)
+				return
+			}
+
+			// Objects are filtered by age before fetching their metadata
+			var objects []Object
+			for _, obj := range page.Contents {
+				filename, modTime := aws.ToString(obj.Key), aws.ToTime(obj.LastModified)
+				if strings.HasPrefix(filename, s3StagingPrefix) {
+					continue
+				}
+				if options.matchesStored(filename, modTime) {
+					objects = append(objects, Object{Filename: filename, ModTime: modTime})
+				}
+			}
+
+			objects, err = s.getMetadataConcurrently(ctx, objects)
+			if err != nil {
+				yield(Object{}, err)
+				return
+			}
+
+			for _, object := range objects {
+				if options.matchesMetadata(object.Metadata) && !yield(object, nil) {
+					return
+				}
+			}
+		}
 	}
+}
 
-	response, err := s.s3.ListObjectsV2(r)
-	if err != nil {
-		return
+// getMetadataConcurrently fetches metadata of the given objects using at most
+// s3ListConcurrency parallel requests. Objects deleted since they were listed are left out.
+// The first error cancels the remaining requests.
+func (s *S3Storage) getMetadataConcurrently(ctx context.Context, objects []Object) ([]Object, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make([]bool, len(objects))
+	sem := make(chan struct{}, s3ListConcurrency)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for i, object := range objects {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			m, err := s.GetOnlyMetadata(ctx, object.Filename)
+			if s.FileNotExists(err) {
+				// Deleted since the listing
+				return
+			} else if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			objects[i].Metadata = m
+			found[i] = true
+		}()
 	}
+	wg.Wait()
 
-	contents := response.Contents
-	for _, obj := range contents {
-		filenames = append(filenames, *obj.Key)
-		metadata = append(metadata, Metadata{ContentLength: strconv.Itoa(int(*obj.Size)), Filename: "N/A"})
+	if firstErr != nil {
+		return nil, firstErr
 	}
-	return
+	// Cancellation by the caller is reported even if no request has failed yet
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var listed []Object
+	for i, object := range objects {
+		if found[i] {
+			listed = append(listed, object)
+		}
+	}
+	return listed, nil
 }
 
 func (s *S3Storage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
-	r := &s3.GetObjectInput{
+	response, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(filename),
-	}
-
-	response, err := s.s3.GetObject(r)
+	})
 	if err != nil {
 		return
 	}
@@ -76,77 +283,503 @@ func (s *S3Storage) Get(ctx context.Context, filename string) (reader io.ReadClo
 }
 
 func (s *S3Storage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
-	r := &s3.GetObjectInput{
+	response, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(filename),
+	})
+	if err != nil {
+		return
 	}
-
-	response, err := s.s3.GetObject(r)
+	metadata, err = StringMapToMetadata(response.Metadata)
 	if err != nil {
+		response.Body.Close()
 		return
 	}
 	reader = response.Body
-	metadata = StringMapToMetadata(response.Metadata)
 	return
 }
 
 func (s *S3Storage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
-	r := &s3.HeadObjectInput{
+	response, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		return
+	}
+	return StringMapToMetadata(response.Metadata)
+}
+
+func (s *S3Storage) PresignDownload(ctx context.Context, filename string, options PresignDownloadOptions) (string, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(filename),
 	}
+	if options.ContentType != "" {
+		input.ResponseContentType = aws.String(options.ContentType)
+	}
+	if options.ContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(options.ContentDisposition)
+	}
 
-	response, err := s.s3.HeadObject(r)
+	request, err := s.presign.PresignGetObject(ctx, input, s3.WithPresignExpires(options.Expiry))
 	if err != nil {
-		return
+		return "", err
 	}
-	metadata = StringMapToMetadata(response.Metadata)
-	return
+	return request.URL, nil
 }
 
 func (s *S3Storage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
-	uploader := s3manager.NewUploader(s.session, func(u *s3manager.Uploader) {
-		u.LeavePartsOnError = false
-	})
-	mMap := MetadataToStringMap(metadata)
+	// Checked before anything is uploaded, as the metadata may only be stored after the content
+	if _, err := s3Metadata(metadata); err != nil {
+		return err
+	}
+
+	if metadata.ContentEncoding != "" {
+		return s.upload(ctx, filename, reader, metadata)
+	}
+
+	// The checksum is stored in the object metadata which is sent before the content,
+	// so seekable content is read twice to avoid rewriting the metadata afterwards
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		checksum := newChecksumReader(seeker)
+		if _, err := io.Copy(io.Discard, checksum); err != nil {
+			return err
+		} else if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+			return ErrChecksumMismatch
+		}
+
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		metadata.Checksum = checksum.Sum()
+		return s.upload(ctx, filename, seeker, metadata)
+	}
+
+	checksum := newChecksumReader(reader)
+	if err := s.upload(ctx, filename, checksum, metadata); err != nil {
+		return err
+	}
+
+	if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+		s.Delete(ctx, filename) //#nosec
+		return ErrChecksumMismatch
+	} else if metadata.Checksum != "" {
+		// The expected checksum has been stored with the object and is now verified
+		return nil
+	}
 
-	_, err := uploader.Upload(&s3manager.UploadInput{
+	metadata.Checksum = checksum.Sum()
+	return s.replaceMetadata(ctx, filename, checksum.n, metadata)
+}
+
+func (s *S3Storage) upload(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	userMetadata, err := s3Metadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.uploader.UploadObject(ctx, &transfermanager.UploadObjectInput{
 		Bucket:   aws.String(s.bucket),
 		Key:      aws.String(filename),
 		Body:     reader,
-		Metadata: mMap,
+		Metadata: userMetadata,
+		Tagging:  s3ExpiryTagging(metadata),
 	})
-
 	return err
 }
 
-func (s *S3Storage) Delete(ctx context.Context, filename string) error {
-	r := &s3.DeleteObjectInput{
+func (s *S3Storage) PresignUpload(ctx context.Context, filename string, options PresignUploadOptions) (upload PresignedUpload, err error) {
+	if options.Size <= s.presignedPartSize {
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s3StagingKey(filename)),
+		}
+		if options.Checksum != "" {
+			// Signed into the URL, so that S3 rejects content not matching it and stores it with the object
+			sum, err := hex.DecodeString(options.Checksum)
+			if err != nil {
+				return upload, fmt.Errorf("invalid checksum: %w", err)
+			}
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum))
+		}
+
+		request, err := s.presign.PresignPutObject(ctx, input, s3.WithPresignExpires(options.Expiry))
+		if err != nil {
+			return upload, err
+		}
+
+		upload.URL = request.URL
+		for name, values := range request.SignedHeader {
+			if name != "Host" && len(values) > 0 {
+				if upload.Headers == nil {
+					upload.Headers = make(map[string]string)
+				}
+				upload.Headers[name] = values[0]
+			}
+		}
+		return upload, nil
+	}
+
+	// Parts must grow for files that would not fit into the maximum number of parts
+	partSize := max(s.presignedPartSize, (options.Size+s3MaxParts-1)/s3MaxParts)
+
+	response, err := s.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(filename),
+		Key:    aws.String(s3StagingKey(filename)),
+	})
+	if err != nil {
+		return upload, err
+	}
+	upload.UploadID = aws.ToString(response.UploadId)
+
+	for number, offset := 1, int64(0); offset < options.Size; number, offset = number+1, offset+partSize {
+		request, err := s.presign.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(s3StagingKey(filename)),
+			UploadId:   response.UploadId,
+			PartNumber: aws.Int32(int32(number)), // #nosec G115
+		}, s3.WithPresignExpires(options.Expiry))
+		if err != nil {
+			s.AbortUpload(ctx, filename, upload.UploadID) //#nosec
+			return PresignedUpload{}, err
+		}
+
+		upload.Parts = append(upload.Parts, PresignedUploadPart{
+			Number: number,
+			URL:    request.URL,
+			Size:   min(partSize, options.Size-offset),
+		})
+	}
+
+	return upload, nil
+}
+
+func (s *S3Storage) CompleteUpload(ctx context.Context, filename, uploadID string, etags []string, metadata Metadata) error {
+	// The staged object is kept until the upload is moved into place, so that failed completions
+	// can be retried. Uploads that are never completed are removed by AbortUpload.
+	stagingKey := s3StagingKey(filename)
+
+	if uploadID != "" {
+		parts := make([]types.CompletedPart, len(etags))
+		for i, etag := range etags {
+			parts[i] = types.CompletedPart{
+				ETag:       aws.String(etag),
+				PartNumber: aws.Int32(int32(i + 1)), // #nosec G115
+			}
+		}
+
+		_, err := s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(stagingKey),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		// Completed by an earlier attempt that failed afterwards
+		var noSuchUpload *types.NoSuchUpload
+		if err != nil && !errors.As(err, &noSuchUpload) {
+			return err
+		}
+	}
+
+	response, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(stagingKey),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return err
+	}
+
+	size := aws.ToInt64(response.ContentLength)
+	if size != metadata.ContentLength {
+		return ErrUploadSizeMismatch
+	}
+
+	checksum, err := s.stagedChecksum(ctx, stagingKey, size, response)
+	if err != nil {
+		return err
+	} else if !checksumMatches(metadata.Checksum, checksum) {
+		return ErrChecksumMismatch
+	}
+	metadata.Checksum = checksum
+
+	if err := s.copyObject(ctx, stagingKey, filename, size, metadata); err != nil {
+		return err
+	}
+	s.deleteObject(context.WithoutCancel(ctx), stagingKey) //#nosec
+	return nil
+}
+
+// stagedChecksum returns the SHA-256 of the staged upload at key as hex. The content never passed through
+// the server, so the checksum is computed by S3: single request uploads carry it from their signed URL,
+// other uploads only have checksums of their parts and get one when they are copied onto themselves.
+func (s *S3Storage) stagedChecksum(ctx context.Context, key string, size int64, head *s3.HeadObjectOutput) (string, error) {
+	if head.ChecksumSHA256 != nil && head.ChecksumType != types.ChecksumTypeComposite {
+		return decodeS3Checksum(*head.ChecksumSHA256)
+	}
+
+	if size > s3MaxCopySize {
+		// Larger objects are copied in parts, of which S3 would again only checksum the parts,
+		// so they are read back instead
+		object, err := s.Get(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		defer object.Close()
+
+		checksum := newChecksumReader(object)
+		if _, err := io.Copy(io.Discard, checksum); err != nil {
+			return "", err
+		}
+		return checksum.Sum(), nil
+	}
+
+	response, err := s.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        s.copySource(key),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		// Copying an object onto itself is only allowed when something changes
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		return "", err
+	} else if response.CopyObjectResult == nil || response.CopyObjectResult.ChecksumSHA256 == nil {
+		return "", errors.New("storage did not return the SHA-256 checksum of the upload")
+	}
+	return decodeS3Checksum(*response.CopyObjectResult.ChecksumSHA256)
+}
+
+// decodeS3Checksum converts a base64-encoded checksum of S3 to hex
+func decodeS3Checksum(checksum string) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 checksum %q", checksum)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+func (s *S3Storage) AbortUpload(ctx context.Context, filename, uploadID string) error {
+	if uploadID != "" {
+		_, err := s.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(s3StagingKey(filename)),
+			UploadId: aws.String(uploadID),
+		})
+		// Multipart uploads are gone once a failed completion has assembled them
+		var noSuchUpload *types.NoSuchUpload
+		if err != nil && !errors.As(err, &noSuchUpload) {
+			return err
+		}
 	}
-	_, err := s.s3.DeleteObject(r)
 
+	// The client may have already uploaded the file
+	return s.deleteObject(ctx, s3StagingKey(filename))
+}
+
+// replaceMetadata overwrites the metadata of an existing object. S3 does not allow
+// changing metadata in place, so the object is copied onto itself.
+func (s *S3Storage) replaceMetadata(ctx context.Context, filename string, size int64, metadata Metadata) error {
+	return s.copyObject(ctx, filename, filename, size, metadata)
+}
+
+// copyObject copies the object of size bytes at source to filename, replacing its metadata
+func (s *S3Storage) copyObject(ctx context.Context, source, filename string, size int64, metadata Metadata) error {
+	userMetadata, err := s3Metadata(metadata)
+	if err != nil {
+		return err
+	}
+	copySource := s.copySource(source)
+
+	if size <= s3MaxCopySize {
+		_, err := s.s3.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(filename),
+			CopySource:        copySource,
+			Metadata:          userMetadata,
+			MetadataDirective: types.MetadataDirectiveReplace,
+			Tagging:           s3ExpiryTagging(metadata),
+			TaggingDirective:  types.TaggingDirectiveReplace,
+		})
+		return err
+	}
+
+	response, err := s.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(filename),
+		Metadata: userMetadata,
+		Tagging:  s3ExpiryTagging(metadata),
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for number, offset := int32(1), int64(0); offset < size; number, offset = number+1, offset+s3CopyPartSize {
+		part, err := s.s3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(filename),
+			UploadId:        response.UploadId,
+			PartNumber:      aws.Int32(number),
+			CopySource:      copySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+s3CopyPartSize, size)-1)),
+		})
+		if err != nil {
+			s.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{ //#nosec
+				Bucket:   aws.String(s.bucket),
+				Key:      aws.String(filename),
+				UploadId: response.UploadId,
+			})
+			return err
+		}
+
+		parts = append(parts, types.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int32(number),
+		})
+	}
+
+	_, err = s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(filename),
+		UploadId:        response.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// copySource returns the CopySource of the object at key, escaped like a path as keys may contain slashes
+func (s *S3Storage) copySource(key string) *string {
+	return aws.String((&url.URL{Path: s.bucket + "/" + key}).EscapedPath())
+}
+
+// Delete deletes the file, succeeding if it does not exist like DeleteObject does
+func (s *S3Storage) Delete(ctx context.Context, filename string) error {
+	return s.deleteObject(ctx, filename)
+}
+
+// deleteObject deletes the object, succeeding if it does not exist
+func (s *S3Storage) deleteObject(ctx context.Context, key string) error {
+	_, err := s.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
 	return err
 }
 
 func (s *S3Storage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
-	filenames, metadata, err := s.List(ctx)
-	if err != nil {
-		return 0, err
+	return deleteExpired(ctx, s)
+}
+
+const (
+	// s3ExpiryTagKey is the object tag matched by the lifecycle rules installed with SetupLifecycle
+	s3ExpiryTagKey = "fileigloo-expiry-days"
+
+	s3LifecycleRulePrefix = "fileigloo-expiry-"
+)
+
+// S3ExpiryDays are the expiration periods for which SetupLifecycle installs lifecycle rules.
+// Files are tagged with the shortest period that is not shorter than their lifetime,
+// files living longer than the last period are left to the expired files cleanup.
+var S3ExpiryDays = []int{1, 2, 7, 30}
+
+// s3ExpiryDaysFor returns the value of the expiry tag for a file expiring at expiresAt
+// or 0 if the file should not be tagged
+func s3ExpiryDaysFor(expiresAt time.Time, now time.Time) int {
+	if expiresAt.IsZero() {
+		return 0
+	}
+
+	// S3 counts lifecycle days from object creation, so partial days are rounded up
+	lifetime := expiresAt.Sub(now)
+	for _, days := range S3ExpiryDays {
+		if lifetime <= time.Duration(days)*24*time.Hour {
+			return days
+		}
+	}
+
+	return 0
+}
+
+// s3ExpiryTagging returns the object tagging for the expiry lifecycle rules
+func s3ExpiryTagging(metadata Metadata) *string {
+	days := s3ExpiryDaysFor(metadata.ExpiresAt, time.Now())
+	if days == 0 {
+		return nil
 	}
 
-	for i, filename := range filenames {
-		if datetime.IsExpired(metadata[i].ExpiresAt) {
-			if err := s.Delete(ctx, filename); err != nil {
-				// Log error but continue with other files
-				continue
+	return aws.String(url.Values{s3ExpiryTagKey: {strconv.Itoa(days)}}.Encode())
+}
+
+// SetupLifecycle installs bucket lifecycle rules that expire objects by their expiry tag and
+// remove presigned uploads that were never completed. Existing rules not managed by fileigloo are preserved.
+func (s *S3Storage) SetupLifecycle(ctx context.Context) error {
+	var rules []types.LifecycleRule
+
+	current, err := s.s3.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.bucket),
+	})
+	var apiError smithy.APIError
+	if err != nil && !(errors.As(err, &apiError) && apiError.ErrorCode() == "NoSuchLifecycleConfiguration") {
+		return err
+	} else if err == nil {
+		for _, rule := range current.Rules {
+			if !strings.HasPrefix(aws.ToString(rule.ID), s3LifecycleRulePrefix) {
+				rules = append(rules, rule)
 			}
-			deletedCount++
 		}
 	}
 
-	return deletedCount, nil
+	for _, days := range S3ExpiryDays {
+		rules = append(rules, types.LifecycleRule{
+			ID:     aws.String(fmt.Sprintf("%s%dd", s3LifecycleRulePrefix, days)),
+			Status: types.ExpirationStatusEnabled,
+			Filter: &types.LifecycleRuleFilter{
+				Tag: &types.Tag{
+					Key:   aws.String(s3ExpiryTagKey),
+					Value: aws.String(strconv.Itoa(days)),
+				},
+			},
+			Expiration: &types.LifecycleExpiration{
+				Days: aws.Int32(int32(days)), // #nosec G115
+			},
+		})
+	}
+
+	// Presigned uploads that are never completed, e.g. because the server restarted in the meantime
+	rules = append(rules, types.LifecycleRule{
+		ID:     aws.String(s3LifecycleRulePrefix + "staging"),
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilter{
+			Prefix: aws.String(s3StagingPrefix),
+		},
+		Expiration: &types.LifecycleExpiration{
+			Days: aws.Int32(s3StagingExpiryDays),
+		},
+		AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(s3StagingExpiryDays),
+		},
+	})
+
+	_, err = s.s3.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	return err
+}
+
+// CheckHealth checks that the bucket exists and the credentials grant access to it
+func (s *S3Storage) CheckHealth(ctx context.Context) error {
+	_, err := s.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
 }
 
 func (s *S3Storage) FileNotExists(err error) bool {
@@ -154,8 +787,17 @@ func (s *S3Storage) FileNotExists(err error) bool {
 		return false
 	}
 
-	if awsError, ok := err.(awserr.Error); ok {
-		if awsError.Code() == s3.ErrCodeNoSuchKey {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+
+	// Some S3-compatible services return the error code without a matching type
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) {
+		switch apiError.ErrorCode() {
+		case "NoSuchKey", "NotFound":
 			return true
 		}
 	}
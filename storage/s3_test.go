@@ -0,0 +1,604 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/storage/storagetest"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+const testBucket = "fileigloo-test"
+
+func setupS3Storage(t *testing.T, middleware ...func(http.Handler) http.Handler) (*storage.S3Storage, *s3mem.Backend) {
+	t.Helper()
+
+	backend := s3mem.New()
+	if err := backend.CreateBucket(testBucket); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	faker := gofakes3.New(backend)
+	handler := faker.Server()
+	// Allows tests to intercept APIs that the fake does not implement
+	for _, m := range middleware {
+		handler = m(handler)
+	}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	s, err := storage.NewS3Storage(context.Background(), storage.S3Config{
+		Bucket:       testBucket,
+		Region:       "us-east-1",
+		EndpointURL:  ts.URL,
+		AccessKey:    "access-key",
+		SecretKey:    "secret-key",
+		UsePathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create S3 storage: %v", err)
+	}
+
+	return s, backend
+}
+
+func TestS3Storage_List(t *testing.T) {
+	t.Run("lists files with metadata", func(t *testing.T) {
+		s, _ := setupS3Storage(t)
+		ctx := context.Background()
+
+		metadata := storage.Metadata{
+			Filename:      "original.txt",
+			ContentType:   "text/plain",
+			ContentLength: 13,
+			PasswordHash:  "hash123",
+			ExpiresAt:     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+			Checksum:      helloWorldChecksum,
+		}
+		if err := s.Put(ctx, "file1", bytes.NewBufferString("Hello, World!"), metadata); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		filenames, listedMetadata, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+
+		if len(filenames) != 1 || filenames[0] != "file1" {
+			t.Fatalf("Expected [file1], got %v", filenames)
+		}
+		if !listedMetadata[0].Equal(metadata) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", metadata, listedMetadata[0])
+		}
+	})
+
+	t.Run("lists more than one page", func(t *testing.T) {
+		s, backend := setupS3Storage(t)
+
+		// A single ListObjectsV2 call returns at most 1000 keys
+		count := 1005
+		for i := 0; i < count; i++ {
+			key := fmt.Sprintf("file%04d", i)
+			meta := map[string]string{"X-Amz-Meta-Filename": key}
+			if _, err := backend.PutObject(testBucket, key, meta, bytes.NewReader(nil), 0, nil); err != nil {
+				t.Fatalf("Failed to put object: %v", err)
+			}
+		}
+
+		filenames, metadata, err := s.List(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+
+		if len(filenames) != count {
+			t.Fatalf("Expected %d files, got %d", count, len(filenames))
+		}
+		for i, filename := range filenames {
+			if metadata[i].Filename != filename {
+				t.Fatalf("Metadata misaligned for %s: %+v", filename, metadata[i])
+			}
+		}
+	})
+
+	t.Run("handles objects without metadata", func(t *testing.T) {
+		s, backend := setupS3Storage(t)
+
+		if _, err := backend.PutObject(testBucket, "foreign", map[string]string{}, bytes.NewReader(nil), 0, nil); err != nil {
+			t.Fatalf("Failed to put object: %v", err)
+		}
+
+		_, metadata, err := s.List(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(metadata) != 1 || !metadata[0].Equal(storage.Metadata{}) {
+			t.Errorf("Expected empty metadata, got %+v", metadata)
+		}
+	})
+
+	t.Run("skips objects deleted after listing", func(t *testing.T) {
+		var backend *s3mem.Backend
+		deleteOnHead := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Deleted between ListObjectsV2 and HeadObject, e.g. by a lifecycle rule
+				if r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/deleted") {
+					backend.DeleteObject(testBucket, "deleted") //#nosec
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		s, b := setupS3Storage(t, deleteOnHead)
+		backend = b
+
+		for _, key := range []string{"deleted", "kept"} {
+			if _, err := backend.PutObject(testBucket, key, map[string]string{}, bytes.NewReader(nil), 0, nil); err != nil {
+				t.Fatalf("Failed to put object: %v", err)
+			}
+		}
+
+		filenames, _, err := s.List(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != 1 || filenames[0] != "kept" {
+			t.Errorf("Expected [kept], got %v", filenames)
+		}
+	})
+
+	t.Run("honors context cancellation", func(t *testing.T) {
+		s, backend := setupS3Storage(t)
+
+		if _, err := backend.PutObject(testBucket, "file", map[string]string{}, bytes.NewReader(nil), 0, nil); err != nil {
+			t.Fatalf("Failed to put object: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, _, err := s.List(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestS3Storage_DeleteExpired(t *testing.T) {
+	s, _ := setupS3Storage(t)
+	ctx := context.Background()
+
+	files := map[string]time.Time{
+		"expired":   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"valid":     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+		"no-expiry": {},
+	}
+	for filename, expiresAt := range files {
+		metadata := storage.Metadata{Filename: filename, ContentLength: 7, ExpiresAt: expiresAt}
+		if err := s.Put(ctx, filename, bytes.NewBufferString("content"), metadata); err != nil {
+			t.Fatalf("Failed to put file %s: %v", filename, err)
+		}
+	}
+
+	deletedCount, err := s.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatalf("Failed to delete expired files: %v", err)
+	}
+	if deletedCount != 1 {
+		t.Errorf("Expected 1 deleted file, got %d", deletedCount)
+	}
+
+	if _, err := s.GetOnlyMetadata(ctx, "expired"); err == nil {
+		t.Errorf("Expected expired file to be deleted")
+	}
+	for _, filename := range []string{"valid", "no-expiry"} {
+		if _, err := s.GetOnlyMetadata(ctx, filename); err != nil {
+			t.Errorf("Expected %s to still exist: %v", filename, err)
+		}
+	}
+}
+
+func TestNewS3Storage(t *testing.T) {
+	t.Run("returns error without bucket", func(t *testing.T) {
+		if _, err := storage.NewS3Storage(context.Background(), storage.S3Config{Region: "us-east-1"}); err == nil {
+			t.Error("Expected error for missing bucket, got nil")
+		}
+	})
+}
+
+func TestS3Storage_FileNotExists(t *testing.T) {
+	s, _ := setupS3Storage(t)
+	ctx := context.Background()
+
+	t.Run("returns true for missing object", func(t *testing.T) {
+		_, err := s.Get(ctx, "non-existent")
+		if !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("returns true for missing object metadata", func(t *testing.T) {
+		_, err := s.GetOnlyMetadata(ctx, "non-existent")
+		if !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("returns false for nil error", func(t *testing.T) {
+		if s.FileNotExists(nil) {
+			t.Error("Expected FileNotExists to return false for nil error")
+		}
+	})
+
+	t.Run("returns false for canceled context", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := s.Get(canceledCtx, "non-existent")
+		if s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return false for error: %v", err)
+		}
+	})
+}
+
+func TestS3Storage_PutExpiryTag(t *testing.T) {
+	var mu sync.Mutex
+	tags := make(map[string]string)
+	recordTags := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut {
+				mu.Lock()
+				tags[strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")] = r.Header.Get("X-Amz-Tagging")
+				mu.Unlock()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	s, _ := setupS3Storage(t, recordTags)
+	ctx := context.Background()
+
+	files := map[string]struct {
+		expiresAt time.Time
+		tag       string
+	}{
+		"in-hours":  {time.Now().Add(12 * time.Hour), "fileigloo-expiry-days=1"},
+		"in-3-days": {time.Now().Add(72 * time.Hour), "fileigloo-expiry-days=7"},
+		"in-a-year": {time.Now().Add(365 * 24 * time.Hour), ""},
+		"no-expiry": {time.Time{}, ""},
+	}
+	for filename, f := range files {
+		metadata := storage.Metadata{Filename: filename, ExpiresAt: f.expiresAt}
+		if err := s.Put(ctx, filename, bytes.NewBufferString("content"), metadata); err != nil {
+			t.Fatalf("Failed to put file %s: %v", filename, err)
+		}
+
+		if tag := tags[filename]; tag != f.tag {
+			t.Errorf("Tag mismatch for %s. Expected: %q, Got: %q", filename, f.tag, tag)
+		}
+	}
+}
+
+type testLifecycleConfiguration struct {
+	XMLName xml.Name `xml:"LifecycleConfiguration"`
+	Rules   []struct {
+		ID     string `xml:"ID"`
+		Status string `xml:"Status"`
+		Filter struct {
+			Prefix string `xml:"Prefix"`
+			Tag    struct {
+				Key   string `xml:"Key"`
+				Value string `xml:"Value"`
+			} `xml:"Tag"`
+		} `xml:"Filter"`
+		Expiration struct {
+			Days int `xml:"Days"`
+		} `xml:"Expiration"`
+		AbortIncompleteMultipartUpload struct {
+			DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+		} `xml:"AbortIncompleteMultipartUpload"`
+	} `xml:"Rule"`
+}
+
+func TestS3Storage_SetupLifecycle(t *testing.T) {
+	// Pre-existing configuration with one foreign and one outdated fileigloo rule
+	stored := `<LifecycleConfiguration>
+<Rule><ID>other-rule</ID><Status>Enabled</Status><Filter><Prefix>logs/</Prefix></Filter><Expiration><Days>90</Days></Expiration></Rule>
+<Rule><ID>fileigloo-expiry-3d</ID><Status>Enabled</Status><Filter><Tag><Key>fileigloo-expiry-days</Key><Value>3</Value></Tag></Filter><Expiration><Days>3</Days></Expiration></Rule>
+</LifecycleConfiguration>`
+
+	fakeLifecycle := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := r.URL.Query()["lifecycle"]; !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			switch r.Method {
+			case http.MethodGet:
+				w.Header().Set("Content-Type", "application/xml")
+				io.WriteString(w, stored)
+			case http.MethodPut:
+				body, _ := io.ReadAll(r.Body)
+				stored = string(body)
+			}
+		})
+	}
+	s, _ := setupS3Storage(t, fakeLifecycle)
+
+	if err := s.SetupLifecycle(context.Background()); err != nil {
+		t.Fatalf("Failed to set up lifecycle: %v", err)
+	}
+
+	var config testLifecycleConfiguration
+	if err := xml.Unmarshal([]byte(stored), &config); err != nil {
+		t.Fatalf("Failed to parse lifecycle configuration: %v", err)
+	}
+
+	if len(config.Rules) != len(storage.S3ExpiryDays)+2 {
+		t.Fatalf("Expected %d rules, got %d", len(storage.S3ExpiryDays)+2, len(config.Rules))
+	}
+	if config.Rules[0].ID != "other-rule" {
+		t.Errorf("Expected foreign rule to be preserved, got %s", config.Rules[0].ID)
+	}
+	for i, days := range storage.S3ExpiryDays {
+		rule := config.Rules[i+1]
+		if rule.Filter.Tag.Key != "fileigloo-expiry-days" || rule.Filter.Tag.Value != fmt.Sprint(days) {
+			t.Errorf("Unexpected filter for rule %s: %+v", rule.ID, rule.Filter)
+		}
+		if rule.Expiration.Days != days || rule.Status != "Enabled" {
+			t.Errorf("Unexpected expiration for rule %s: %+v", rule.ID, rule.Expiration)
+		}
+	}
+
+	staging := config.Rules[len(config.Rules)-1]
+	if staging.Filter.Prefix != "fileigloo-staging/" || staging.Expiration.Days != 1 || staging.AbortIncompleteMultipartUpload.DaysAfterInitiation != 1 {
+		t.Errorf("Unexpected rule for uncompleted uploads: %+v", staging)
+	}
+}
+
+func TestS3Storage_PutChecksum(t *testing.T) {
+	s, _ := setupS3Storage(t)
+	ctx := context.Background()
+
+	// Seekable content is hashed before the upload, other content while uploading
+	readers := map[string]func() io.Reader{
+		"seekable":     func() io.Reader { return strings.NewReader("Hello, World!") },
+		"non-seekable": func() io.Reader { return bytes.NewBufferString("Hello, World!") },
+	}
+	for name, newReader := range readers {
+		t.Run("records checksum of "+name+" content", func(t *testing.T) {
+			if err := s.Put(ctx, name, newReader(), storage.Metadata{}); err != nil {
+				t.Fatalf("Failed to put file: %v", err)
+			}
+
+			metadata, err := s.GetOnlyMetadata(ctx, name)
+			if err != nil {
+				t.Fatalf("Failed to get metadata: %v", err)
+			}
+			if metadata.Checksum != helloWorldChecksum {
+				t.Errorf("Checksum mismatch. Expected: %s, Got: %s", helloWorldChecksum, metadata.Checksum)
+			}
+		})
+
+		t.Run("rejects "+name+" content not matching expected checksum", func(t *testing.T) {
+			metadata := storage.Metadata{Checksum: strings.Repeat("0", 64)}
+			if err := s.Put(ctx, name+"-corrupted", newReader(), metadata); !errors.Is(err, storage.ErrChecksumMismatch) {
+				t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+			}
+
+			if _, err := s.GetOnlyMetadata(ctx, name+"-corrupted"); !s.FileNotExists(err) {
+				t.Errorf("Expected corrupted file not to be stored, got %v", err)
+			}
+		})
+	}
+}
+
+func TestS3Storage_CheckHealth(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("healthy with existing bucket", func(t *testing.T) {
+		s, _ := setupS3Storage(t)
+
+		if err := s.CheckHealth(ctx); err != nil {
+			t.Errorf("Expected storage to be healthy, got %v", err)
+		}
+	})
+
+	t.Run("unhealthy when bucket is gone", func(t *testing.T) {
+		s, backend := setupS3Storage(t)
+		if err := backend.DeleteBucket(testBucket); err != nil {
+			t.Fatalf("Failed to delete bucket: %v", err)
+		}
+
+		if err := s.CheckHealth(ctx); err == nil {
+			t.Error("Expected error for missing bucket, got nil")
+		}
+	})
+}
+
+func TestS3Storage_PresignUpload(t *testing.T) {
+	const checksum = "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"
+
+	ctx := context.Background()
+	s, backend := setupS3Storage(t, storagetest.S3Checksums)
+
+	putContent := func(t *testing.T, upload storage.PresignedUpload, content string) int {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodPut, upload.URL, strings.NewReader(content))
+		for name, value := range upload.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	upload, err := s.PresignUpload(ctx, "staged", storage.PresignUploadOptions{Expiry: time.Minute, Size: 13, Checksum: checksum})
+	if err != nil {
+		t.Fatalf("Failed to presign upload: %v", err)
+	}
+	if status := putContent(t, upload, "Hello, World!"); status != http.StatusOK {
+		t.Fatalf("Expected upload status 200, got %d", status)
+	}
+
+	t.Run("hides uploads until they are completed", func(t *testing.T) {
+		if filenames, _, err := s.List(ctx); err != nil || len(filenames) != 0 {
+			t.Errorf("Expected no listed files, got %v: %v", filenames, err)
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "staged"); !s.FileNotExists(err) {
+			t.Errorf("Expected uncompleted upload to be missing, got %v", err)
+		}
+	})
+
+	t.Run("moves completed uploads into place", func(t *testing.T) {
+		if err := s.CompleteUpload(ctx, "staged", upload.UploadID, nil, storage.Metadata{Filename: "staged.txt", ContentLength: 13, Checksum: checksum}); err != nil {
+			t.Fatalf("Failed to complete upload: %v", err)
+		}
+		if metadata, err := s.GetOnlyMetadata(ctx, "staged"); err != nil || metadata.Filename != "staged.txt" || metadata.Checksum != checksum {
+			t.Errorf("Expected completed upload with metadata, got %+v: %v", metadata, err)
+		}
+		if _, err := backend.HeadObject(testBucket, "fileigloo-staging/staged"); err == nil {
+			t.Errorf("Expected staged upload to be removed")
+		}
+	})
+
+	t.Run("requires the checksum with single request uploads", func(t *testing.T) {
+		if upload.Headers["X-Amz-Checksum-Sha256"] != "3/1gIbsr1bCvZ2KQgJ7DpTGR3YHH9wpLKGiKNiGCmG8=" {
+			t.Errorf("Expected checksum header, got %v", upload.Headers)
+		}
+
+		other, err := s.PresignUpload(ctx, "corrupted", storage.PresignUploadOptions{Expiry: time.Minute, Size: 13, Checksum: checksum})
+		if err != nil {
+			t.Fatalf("Failed to presign upload: %v", err)
+		}
+		if status := putContent(t, other, "Hello, World?"); status != http.StatusBadRequest {
+			t.Errorf("Expected content not matching the checksum to be rejected, got %d", status)
+		}
+	})
+
+	t.Run("computes checksums of uploads without one", func(t *testing.T) {
+		for name, expected := range map[string]string{"matching": checksum, "mismatching": strings.Repeat("0", 64)} {
+			upload, err := s.PresignUpload(ctx, name, storage.PresignUploadOptions{Expiry: time.Minute, Size: 13})
+			if err != nil {
+				t.Fatalf("Failed to presign upload: %v", err)
+			}
+			if status := putContent(t, upload, "Hello, World!"); status != http.StatusOK {
+				t.Fatalf("Expected upload status 200, got %d", status)
+			}
+
+			err = s.CompleteUpload(ctx, name, upload.UploadID, nil, storage.Metadata{ContentLength: 13, Checksum: expected})
+			if expected == checksum && err != nil {
+				t.Errorf("Failed to complete upload: %v", err)
+			} else if expected != checksum && !errors.Is(err, storage.ErrChecksumMismatch) {
+				t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+			}
+		}
+
+		if metadata, err := s.GetOnlyMetadata(ctx, "matching"); err != nil || metadata.Checksum != checksum {
+			t.Errorf("Expected computed checksum, got %+v: %v", metadata, err)
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "mismatching"); !s.FileNotExists(err) {
+			t.Errorf("Expected mismatching upload not to be stored, got %v", err)
+		}
+	})
+
+	t.Run("keeps rejected uploads until they are aborted", func(t *testing.T) {
+		upload, err := s.PresignUpload(ctx, "retried", storage.PresignUploadOptions{Expiry: time.Minute, Size: 13})
+		if err != nil {
+			t.Fatalf("Failed to presign upload: %v", err)
+		}
+		if status := putContent(t, upload, "Hello, World!"); status != http.StatusOK {
+			t.Fatalf("Expected upload status 200, got %d", status)
+		}
+
+		err = s.CompleteUpload(ctx, "retried", upload.UploadID, nil, storage.Metadata{ContentLength: 13, Checksum: strings.Repeat("0", 64)})
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+		}
+		if err := s.CompleteUpload(ctx, "retried", upload.UploadID, nil, storage.Metadata{ContentLength: 13, Checksum: checksum}); err != nil {
+			t.Errorf("Failed to retry completing upload: %v", err)
+		}
+
+		upload, err = s.PresignUpload(ctx, "aborted", storage.PresignUploadOptions{Expiry: time.Minute, Size: 13})
+		if err != nil {
+			t.Fatalf("Failed to presign upload: %v", err)
+		}
+		if status := putContent(t, upload, "Hello, World!"); status != http.StatusOK {
+			t.Fatalf("Expected upload status 200, got %d", status)
+		}
+		if err := s.CompleteUpload(ctx, "aborted", upload.UploadID, nil, storage.Metadata{ContentLength: 5}); !errors.Is(err, storage.ErrUploadSizeMismatch) {
+			t.Fatalf("Expected ErrUploadSizeMismatch, got %v", err)
+		}
+		if err := s.AbortUpload(ctx, "aborted", upload.UploadID); err != nil {
+			t.Fatalf("Failed to abort upload: %v", err)
+		}
+		if _, err := backend.HeadObject(testBucket, "fileigloo-staging/aborted"); err == nil {
+			t.Errorf("Expected aborted upload to be removed")
+		}
+	})
+}
+
+func TestS3Storage_PutMetadataSize(t *testing.T) {
+	ctx := context.Background()
+	s, _ := setupS3Storage(t)
+
+	metadata := storage.Metadata{
+		Filename:       "labels.txt",
+		ContentType:    "text/plain",
+		PasswordHash:   "$argon2id$v=19$m=65536,t=1,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g",
+		ExpiresAt:      time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+		CreatedAt:      time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+		UploaderIPHash: strings.Repeat("0", 64),
+	}
+
+	t.Run("stores multibyte labels within the limit", func(t *testing.T) {
+		// As many multibyte labels as the server accepts, 1024 bytes once encoded
+		metadata := metadata
+		metadata.Labels = map[string]string{
+			"a": strings.Repeat("ż", 84),
+			"b": strings.Repeat("ż", 84),
+		}
+		if size := len(storage.EncodeLabels(metadata.Labels)); size > 1024 {
+			t.Fatalf("Expected labels within the server limit, got %d bytes", size)
+		}
+
+		if err := s.Put(ctx, "within", strings.NewReader("Hello, World!"), metadata); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+		stored, err := s.GetOnlyMetadata(ctx, "within")
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if stored.Labels["a"] != metadata.Labels["a"] {
+			t.Errorf("Expected multibyte label to round trip, got %q", stored.Labels["a"])
+		}
+	})
+
+	t.Run("rejects metadata over the limit", func(t *testing.T) {
+		metadata := metadata
+		metadata.Labels = map[string]string{}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			metadata.Labels[key] = strings.Repeat("ż", 125)
+		}
+
+		if err := s.Put(ctx, "over", strings.NewReader("Hello, World!"), metadata); !errors.Is(err, storage.ErrMetadataTooLarge) {
+			t.Fatalf("Expected ErrMetadataTooLarge, got %v", err)
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "over"); !s.FileNotExists(err) {
+			t.Errorf("Expected nothing to be stored, got %v", err)
+		}
+	})
+}
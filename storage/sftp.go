@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPConfig struct {
+	// Address of the SSH server as host:port
+	Address  string
+	Username string
+	// Password, PrivateKey or both can be used to authenticate
+	Password             string
+	PrivateKey           []byte // PEM-encoded private key
+	PrivateKeyPassphrase string
+	// KnownHostsPath is the known_hosts file the host key of the server is verified against
+	KnownHostsPath string
+	// Directory on the server files are stored in, it is created if missing
+	Directory string
+	// PoolSize is the maximum number of open connections, defaults to 4
+	PoolSize int
+}
+
+// SFTPStorage stores files on a server reachable over SSH. Like with LocalStorage, metadata
+// is stored next to each file in a .metadata file, written after the file is complete.
+type SFTPStorage struct {
+	Storage
+	directory string
+	config    *ssh.ClientConfig
+	address   string
+
+	// Requests are spread over up to len(conns) connections, opened when first needed
+	mu    sync.Mutex
+	conns []*sftpConn
+	next  int
+}
+
+type sftpConn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *sftpConn) Close() error {
+	c.sftp.Close()
+	return c.ssh.Close()
+}
+
+const (
+	defaultSFTPPoolSize = 4
+	sftpDialTimeout     = 30 * time.Second
+)
+
+func NewSFTPStorage(ctx context.Context, config SFTPConfig) (*SFTPStorage, error) {
+	if config.Address == "" || config.Username == "" {
+		return nil, errors.New("sftp address and username are required")
+	} else if config.KnownHostsPath == "" {
+		return nil, errors.New("sftp known hosts file is required to verify the server")
+	}
+
+	hostKeyCallback, err := knownhosts.New(config.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if len(config.PrivateKey) > 0 {
+		var signer ssh.Signer
+		if config.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(config.PrivateKey, []byte(config.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(config.PrivateKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp password or private key is required")
+	}
+
+	poolSize := config.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultSFTPPoolSize
+	}
+
+	s := &SFTPStorage{
+		directory: config.Directory,
+		config: &ssh.ClientConfig{
+			User:            config.Username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+		address: config.Address,
+		conns:   make([]*sftpConn, poolSize),
+	}
+	if s.directory == "" {
+		s.directory = "."
+	}
+
+	client, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.MkdirAll(s.directory); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SFTPStorage) Type() string {
+	return "sftp"
+}
+
+// Close closes the open connections
+func (s *SFTPStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, conn := range s.conns {
+		if conn != nil {
+			conn.Close()
+			s.conns[i] = nil
+		}
+	}
+	return nil
+}
+
+func (s *SFTPStorage) dial(ctx context.Context) (*sftpConn, error) {
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, s.address, s.config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, channels, requests)
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpConn{ssh: sshClient, sftp: sftpClient}, nil
+}
+
+// client returns the next connection of the pool, reconnecting if it has been lost.
+// SFTP clients are safe for concurrent use, so connections are shared rather than leased.
+func (s *SFTPStorage) client(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.next
+	s.next = (s.next + 1) % len(s.conns)
+	if conn := s.conns[i]; conn != nil {
+		return conn.sftp, nil
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[i] = conn
+
+	// Forget the connection once it is closed, so that it is replaced on next use
+	go func() {
+		conn.ssh.Wait() //#nosec
+		conn.sftp.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conns[i] == conn {
+			s.conns[i] = nil
+		}
+	}()
+	return conn.sftp, nil
+}
+
+// with calls fn with a connection from the pool
+func (s *SFTPStorage) with(ctx context.Context, fn func(client *sftp.Client) error) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+func (s *SFTPStorage) path(name string) string {
+	return path.Join(s.directory, name)
+}
+
+func sftpReadMetadata(client *sftp.Client, metadataPath string) (metadata Metadata, err error) {
+	f, err := client.Open(metadataPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&metadata)
+	return
+}
+
+func (s *SFTPStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+func (s *SFTPStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		client, err := s.client(ctx)
+		if err != nil {
+			yield(Object{}, err)
+			return
+		}
+
+		infos, err := client.ReadDir(s.directory)
+		if err != nil {
+			yield(Object{}, err)
+			return
+		}
+
+		// Files without metadata are incomplete or being deleted
+		hasMetadata := make(map[string]bool)
+		for _, info := range infos {
+			if name, ok := strings.CutSuffix(info.Name(), ".metadata"); ok {
+				hasMetadata[name] = true
+			}
+		}
+		infos = slices.DeleteFunc(infos, func(info os.FileInfo) bool {
+			return info.IsDir() || isTemp(info.Name()) || !hasMetadata[info.Name()]
+		})
+		slices.SortFunc(infos, func(a, b os.FileInfo) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+
+		for _, info := range infos {
+			if err := ctx.Err(); err != nil {
+				yield(Object{}, err)
+				return
+			}
+
+			filename := info.Name()
+			if !options.matchesStored(filename, info.ModTime()) {
+				continue
+			}
+
+			metadata, err := sftpReadMetadata(client, s.path(filename)+".metadata")
+			if s.FileNotExists(err) {
+				// Deleted since the listing
+				continue
+			} else if err != nil {
+				yield(Object{}, err)
+				return
+			}
+
+			if !options.matchesMetadata(metadata) {
+				continue
+			}
+			if !yield(Object{Filename: filename, Metadata: metadata, ModTime: info.ModTime()}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *SFTPStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(s.path(filename))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *SFTPStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	metadata, err = s.GetOnlyMetadata(ctx, filename)
+	if err != nil {
+		return
+	}
+
+	reader, err = s.Get(ctx, filename)
+	return
+}
+
+func (s *SFTPStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	err = s.with(ctx, func(client *sftp.Client) (err error) {
+		metadata, err = sftpReadMetadata(client, s.path(filename)+".metadata")
+		return
+	})
+	return
+}
+
+func (s *SFTPStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	return s.with(ctx, func(client *sftp.Client) error {
+		filePath := s.path(filename)
+		metadataPath := filePath + ".metadata"
+
+		// Both files are written under temporary names and renamed into place once complete
+		temp := s.path("." + filename + "." + rand.Text() + tempExt)
+		defer client.Remove(temp) //#nosec
+
+		checksum := newChecksumReader(reader)
+		if err := sftpWriteFile(client, temp, checksum); err != nil {
+			return err
+		}
+
+		if metadata.ContentEncoding == "" {
+			if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+				return ErrChecksumMismatch
+			}
+			metadata.Checksum = checksum.Sum()
+		}
+
+		metadataBytes, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		metadataTemp := s.path("." + filename + ".metadata." + rand.Text() + tempExt)
+		defer client.Remove(metadataTemp) //#nosec
+		if err := sftpWriteFile(client, metadataTemp, bytes.NewReader(metadataBytes)); err != nil {
+			return err
+		}
+
+		// The metadata is renamed last, so that a file is never listed without its content.
+		// An existing file keeps being served until both renames replace it.
+		if err := client.PosixRename(temp, filePath); err != nil {
+			return err
+		}
+		return client.PosixRename(metadataTemp, metadataPath)
+	})
+}
+
+func sftpWriteFile(client *sftp.Client, name string, reader io.Reader) error {
+	f, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *SFTPStorage) Delete(ctx context.Context, filename string) error {
+	return s.with(ctx, func(client *sftp.Client) error {
+		if err := client.Remove(s.path(filename) + ".metadata"); err != nil {
+			return err
+		}
+		return client.Remove(s.path(filename))
+	})
+}
+
+// Fsck removes leftovers of interrupted writes and deletes: temporary files, bodies without
+// metadata and metadata without a body. It returns the names of the removed files.
+func (s *SFTPStorage) Fsck(ctx context.Context, options FsckOptions) (removed []string, err error) {
+	err = s.with(ctx, func(client *sftp.Client) error {
+		infos, err := client.ReadDir(s.directory)
+		if err != nil {
+			return err
+		}
+
+		names := make(map[string]bool, len(infos))
+		for _, info := range infos {
+			names[info.Name()] = true
+		}
+
+		cutoff := time.Now().Add(-options.GracePeriod)
+		for _, info := range infos {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			name := info.Name()
+			if info.IsDir() || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			var counterpart string
+			switch {
+			case isTemp(name):
+			case strings.HasSuffix(name, ".metadata"):
+				counterpart = strings.TrimSuffix(name, ".metadata")
+			default:
+				counterpart = name + ".metadata"
+			}
+			if counterpart != "" {
+				if names[counterpart] {
+					continue
+				}
+				// Written since the listing
+				if _, err := client.Stat(s.path(counterpart)); err == nil {
+					continue
+				} else if !s.FileNotExists(err) {
+					return err
+				}
+			}
+
+			if !options.DryRun {
+				if err := client.Remove(s.path(name)); err != nil && !s.FileNotExists(err) {
+					return err
+				}
+			}
+			removed = append(removed, name)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *SFTPStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+// CheckHealth checks that the server can be reached and the directory exists
+func (s *SFTPStorage) CheckHealth(ctx context.Context) error {
+	return s.with(ctx, func(client *sftp.Client) error {
+		_, err := client.Stat(s.directory)
+		return err
+	})
+}
+
+func (s *SFTPStorage) FileNotExists(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
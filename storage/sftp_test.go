@@ -0,0 +1,329 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer is an in-process SSH server serving its root directory over SFTP
+type sftpServer struct {
+	address    string
+	root       string
+	knownHosts string
+	privateKey []byte // PEM-encoded key authorized for "user"
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPublicKey, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey, err := ssh.NewPublicKey(userPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKeyBytes, err := x509.MarshalPKCS8PrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "user" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "user" && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &sftpServer{
+		address:    listener.Addr().String(),
+		root:       t.TempDir(),
+		knownHosts: filepath.Join(t.TempDir(), "known_hosts"),
+		privateKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: userKeyBytes}),
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.address)}, hostSigner.PublicKey())
+	if err := os.WriteFile(server.knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *sftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.root))
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func (s *sftpServer) config() storage.SFTPConfig {
+	return storage.SFTPConfig{
+		Address:        s.address,
+		Username:       "user",
+		Password:       "secret",
+		KnownHostsPath: s.knownHosts,
+		Directory:      "files",
+	}
+}
+
+func setupSFTPStorage(t *testing.T) (*storage.SFTPStorage, *sftpServer) {
+	t.Helper()
+
+	server := newSFTPServer(t)
+	s, err := storage.NewSFTPStorage(context.Background(), server.config())
+	if err != nil {
+		t.Fatalf("Failed to create SFTP storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, server
+}
+
+func TestNewSFTPStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates missing directory", func(t *testing.T) {
+		_, server := setupSFTPStorage(t)
+
+		info, err := os.Stat(filepath.Join(server.root, "files"))
+		if err != nil {
+			t.Fatalf("Expected directory to be created: %v", err)
+		}
+		if !info.IsDir() {
+			t.Error("Expected directory to be a directory")
+		}
+	})
+
+	t.Run("authenticates with private key", func(t *testing.T) {
+		server := newSFTPServer(t)
+		config := server.config()
+		config.Password = ""
+		config.PrivateKey = server.privateKey
+
+		s, err := storage.NewSFTPStorage(ctx, config)
+		if err != nil {
+			t.Fatalf("Failed to create SFTP storage: %v", err)
+		}
+		s.Close()
+	})
+
+	t.Run("returns error for wrong password", func(t *testing.T) {
+		server := newSFTPServer(t)
+		config := server.config()
+		config.Password = "wrong"
+
+		if _, err := storage.NewSFTPStorage(ctx, config); err == nil {
+			t.Error("Expected error for wrong password, got nil")
+		}
+	})
+
+	t.Run("returns error for unknown host key", func(t *testing.T) {
+		server := newSFTPServer(t)
+		config := server.config()
+		config.KnownHostsPath = newSFTPServer(t).knownHosts
+
+		if _, err := storage.NewSFTPStorage(ctx, config); err == nil {
+			t.Error("Expected error for unknown host key, got nil")
+		}
+	})
+
+	t.Run("requires known hosts file", func(t *testing.T) {
+		config := newSFTPServer(t).config()
+		config.KnownHostsPath = ""
+
+		if _, err := storage.NewSFTPStorage(ctx, config); err == nil {
+			t.Error("Expected error without known hosts file, got nil")
+		}
+	})
+}
+
+func TestSFTPStorage_List(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lists only complete files", func(t *testing.T) {
+		s, server := setupSFTPStorage(t)
+		putTestFiles(t, s)
+
+		// Leftovers of an interrupted upload and a file without metadata
+		for _, name := range []string{".valid.abc.tmp", "incomplete"} {
+			if err := os.WriteFile(filepath.Join(server.root, "files", name), []byte("leftover"), 0600); err != nil {
+				t.Fatalf("Failed to create %s: %v", name, err)
+			}
+		}
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		slices.Sort(filenames)
+		if !slices.Equal(filenames, []string{"expired", "valid"}) {
+			t.Errorf("Expected [expired valid], got %v", filenames)
+		}
+	})
+
+	t.Run("does not leave temporary files behind", func(t *testing.T) {
+		s, server := setupSFTPStorage(t)
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		entries, err := os.ReadDir(filepath.Join(server.root, "files"))
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !slices.Equal(names, []string{"file", "file.metadata"}) {
+			t.Errorf("Expected [file file.metadata], got %v", names)
+		}
+	})
+}
+
+func TestSFTPStorage_Fsck(t *testing.T) {
+	ctx := context.Background()
+	s, server := setupSFTPStorage(t)
+	directory := filepath.Join(server.root, "files")
+
+	if err := s.Put(ctx, "complete", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+		t.Fatalf("Failed to put file: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	leftovers := []string{".complete.123456.tmp", "body-only", "metadata-only.metadata"}
+	for _, name := range append(leftovers, "recent-body-only") {
+		path := filepath.Join(directory, name)
+		if err := os.WriteFile(path, []byte("leftover"), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if name != "recent-body-only" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("Failed to change file times: %v", err)
+			}
+		}
+	}
+	// Complete files are kept however old they are
+	for _, name := range []string{"complete", "complete.metadata"} {
+		if err := os.Chtimes(filepath.Join(directory, name), old, old); err != nil {
+			t.Fatalf("Failed to change file times: %v", err)
+		}
+	}
+
+	t.Run("reports leftovers in dry run", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{GracePeriod: time.Hour, DryRun: true})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		slices.Sort(removed)
+		if !slices.Equal(removed, leftovers) {
+			t.Errorf("Expected %v, got %v", leftovers, removed)
+		}
+		for _, name := range leftovers {
+			if _, err := os.Stat(filepath.Join(directory, name)); err != nil {
+				t.Errorf("Expected %s to be kept in dry run: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("removes leftovers older than grace period", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{GracePeriod: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		slices.Sort(removed)
+		if !slices.Equal(removed, leftovers) {
+			t.Errorf("Expected %v, got %v", leftovers, removed)
+		}
+
+		for _, name := range leftovers {
+			if _, err := os.Stat(filepath.Join(directory, name)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed", name)
+			}
+		}
+		for _, name := range []string{"complete", "complete.metadata", "recent-body-only"} {
+			if _, err := os.Stat(filepath.Join(directory, name)); err != nil {
+				t.Errorf("Expected %s to be kept: %v", name, err)
+			}
+		}
+	})
+}
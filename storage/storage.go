@@ -2,47 +2,431 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"iter"
+	"maps"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exler/fileigloo/datetime"
 )
 
+// MetadataVersion is the newest version of the metadata schema read by this version of fileigloo.
+// Version 1 metadata stored ContentLength and ExpiresAt as strings and is still read. Version 3 added
+// the result of virus scans, so that versions which would serve quarantined files refuse to read it.
+// It is only written for scanned files, others keep version 2 so that older versions can read them.
+const MetadataVersion = 3
+
+// version returns the oldest metadata version that can store the metadata
+func (m Metadata) version() int {
+	if m.ScanStatus != "" || m.ScanSignature != "" || !m.ScannedAt.IsZero() {
+		return MetadataVersion
+	}
+	return 2
+}
+
 type Metadata struct {
 	Filename      string // Original filename
 	ContentType   string
-	ContentLength string
-	PasswordHash  string // Argon2id hash of password (empty if no password)
-	ExpiresAt     string // RFC3339 timestamp when file expires (empty if no expiration)
+	ContentLength int64     // Size of the content in bytes (0 if unknown)
+	PasswordHash  string    // Argon2id hash of password (empty if no password)
+	ExpiresAt     time.Time // When the file expires (zero if no expiration)
+	Checksum      string    // Hex-encoded SHA-256 of the content (empty for files stored without one)
+	// Encoding of the stored content, e.g. "zstd" (empty if stored as uploaded). ContentLength and
+	// Checksum describe the decoded content, so Put stores encoded files without computing the checksum.
+	ContentEncoding string
+	CreatedAt       time.Time         // When the file was uploaded (zero for files stored before it was recorded)
+	UploaderIPHash  string            // Keyed hash of the uploader's IP address (empty if not recorded)
+	Labels          map[string]string // Arbitrary key/value pairs attached to the file
+	ScanStatus      ScanStatus        // Result of the antivirus scan (empty if the file was not scanned)
+	ScanSignature   string            // Name of the malware found by the scan (empty if none was found)
+	ScannedAt       time.Time         // When the file was scanned (zero if it was not scanned)
+}
+
+type ScanStatus string
+
+const (
+	ScanClean    ScanStatus = "clean"
+	ScanInfected ScanStatus = "infected"
+)
+
+// IsQuarantined reports whether malware was found in the file, which is kept but never served
+func (m Metadata) IsQuarantined() bool {
+	return m.ScanStatus == ScanInfected
+}
+
+// IsExpired reports whether the file has an expiration time in the past
+func (m Metadata) IsExpired() bool {
+	return datetime.IsExpired(m.ExpiresAt)
+}
+
+// Equal reports whether both describe the same file, comparing times as instants
+// and treating nil and empty labels alike
+func (m Metadata) Equal(other Metadata) bool {
+	return m.Filename == other.Filename &&
+		m.ContentType == other.ContentType &&
+		m.ContentLength == other.ContentLength &&
+		m.PasswordHash == other.PasswordHash &&
+		m.ExpiresAt.Equal(other.ExpiresAt) &&
+		m.Checksum == other.Checksum &&
+		m.ContentEncoding == other.ContentEncoding &&
+		m.CreatedAt.Equal(other.CreatedAt) &&
+		m.UploaderIPHash == other.UploaderIPHash &&
+		maps.Equal(m.Labels, other.Labels) &&
+		m.ScanStatus == other.ScanStatus &&
+		m.ScanSignature == other.ScanSignature &&
+		m.ScannedAt.Equal(other.ScannedAt)
+}
+
+// storedMetadata is how Metadata is encoded as JSON, e.g. in .metadata files
+type storedMetadata struct {
+	// Version is missing from version 1 metadata
+	Version         int `json:",omitempty"`
+	Filename        string
+	ContentType     string
+	ContentLength   legacyInt64
+	PasswordHash    string
+	ExpiresAt       string
+	Checksum        string
+	ContentEncoding string            `json:",omitempty"`
+	CreatedAt       string            `json:",omitempty"`
+	UploaderIPHash  string            `json:",omitempty"`
+	Labels          map[string]string `json:",omitempty"`
+	ScanStatus      string            `json:",omitempty"`
+	ScanSignature   string            `json:",omitempty"`
+	ScannedAt       string            `json:",omitempty"`
+}
+
+// legacyInt64 is encoded as a JSON number, but also decodes from the strings used by version 1
+type legacyInt64 int64
+
+func (n *legacyInt64) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*n = legacyInt64(parseInt64(s))
+		return nil
+	}
+
+	var i int64
+	if err := json.Unmarshal(data, &i); err != nil {
+		return err
+	}
+	*n = legacyInt64(i)
+	return nil
+}
+
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(storedMetadata{
+		Version:         m.version(),
+		Filename:        m.Filename,
+		ContentType:     m.ContentType,
+		ContentLength:   legacyInt64(m.ContentLength),
+		PasswordHash:    m.PasswordHash,
+		ExpiresAt:       formatTime(m.ExpiresAt),
+		Checksum:        m.Checksum,
+		ContentEncoding: m.ContentEncoding,
+		CreatedAt:       formatTime(m.CreatedAt),
+		UploaderIPHash:  m.UploaderIPHash,
+		Labels:          m.Labels,
+		ScanStatus:      string(m.ScanStatus),
+		ScanSignature:   m.ScanSignature,
+		ScannedAt:       formatTime(m.ScannedAt),
+	})
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var stored storedMetadata
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	if stored.Version > MetadataVersion {
+		return fmt.Errorf("metadata version %d is newer than the supported version %d", stored.Version, MetadataVersion)
+	}
+
+	*m = Metadata{
+		Filename:        stored.Filename,
+		ContentType:     stored.ContentType,
+		ContentLength:   int64(stored.ContentLength),
+		PasswordHash:    stored.PasswordHash,
+		ExpiresAt:       parseTime(stored.ExpiresAt),
+		Checksum:        stored.Checksum,
+		ContentEncoding: stored.ContentEncoding,
+		CreatedAt:       parseTime(stored.CreatedAt),
+		UploaderIPHash:  stored.UploaderIPHash,
+		Labels:          stored.Labels,
+		ScanStatus:      ScanStatus(stored.ScanStatus),
+		ScanSignature:   stored.ScanSignature,
+		ScannedAt:       parseTime(stored.ScannedAt),
+	}
+	return nil
+}
+
+// formatTime returns the RFC 3339 representation of t, or an empty string for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
 }
 
-func MetadataToStringMap(metadata Metadata) map[string]*string {
-	m := make(map[string]*string)
+// parseTime parses an RFC 3339 timestamp. Empty and invalid timestamps, which version 1
+// treated as no expiration, are returned as the zero time.
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
 
-	m["Filename"] = &metadata.Filename
-	m["Content-Type"] = &metadata.ContentType
-	m["Content-Length"] = &metadata.ContentLength
-	m["Password-Hash"] = &metadata.PasswordHash
-	m["Expires-At"] = &metadata.ExpiresAt
+// parseInt64 parses a decimal number, returning 0 for empty and invalid strings
+func parseInt64(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
 
+func MetadataToStringMap(metadata Metadata) map[string]string {
+	m := map[string]string{
+		"Metadata-Version": strconv.Itoa(metadata.version()),
+		"Filename":         metadata.Filename,
+		"Content-Type":     metadata.ContentType,
+		"Content-Length":   strconv.FormatInt(metadata.ContentLength, 10),
+		"Password-Hash":    metadata.PasswordHash,
+		"Expires-At":       formatTime(metadata.ExpiresAt),
+		"Checksum":         metadata.Checksum,
+		"Content-Encoding": metadata.ContentEncoding,
+		"Created-At":       formatTime(metadata.CreatedAt),
+		"Uploader-Ip-Hash": metadata.UploaderIPHash,
+		"Scan-Status":      string(metadata.ScanStatus),
+		"Scan-Signature":   metadata.ScanSignature,
+		"Scanned-At":       formatTime(metadata.ScannedAt),
+	}
+	if len(metadata.Labels) > 0 {
+		m["Labels"] = EncodeLabels(metadata.Labels)
+	}
 	return m
 }
 
-func StringMapToMetadata(m map[string]*string) Metadata {
+// EncodeLabels returns the labels as they are stored with MetadataToStringMap. S3 lowercases
+// metadata keys and only allows ASCII values, so labels are stored together as a query string.
+func EncodeLabels(labels map[string]string) string {
+	values := make(url.Values, len(labels))
+	for key, value := range labels {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+func StringMapToMetadata(m map[string]string) (Metadata, error) {
+	// S3 returns metadata keys lowercased, and objects uploaded outside
+	// of fileigloo may lack some (or all) of the keys
+	normalized := make(map[string]string, len(m))
+	for key, value := range m {
+		normalized[strings.ToLower(key)] = value
+	}
+	if version := parseInt64(normalized["metadata-version"]); version > MetadataVersion {
+		return Metadata{}, fmt.Errorf("metadata version %d is newer than the supported version %d", version, MetadataVersion)
+	}
+
 	metadata := Metadata{
-		Filename:      *m["Filename"],
-		ContentType:   *m["Content-Type"],
-		ContentLength: *m["Content-Length"],
-		PasswordHash:  *m["Password-Hash"],
+		Filename:        normalized["filename"],
+		ContentType:     normalized["content-type"],
+		ContentLength:   parseInt64(normalized["content-length"]),
+		PasswordHash:    normalized["password-hash"],
+		ExpiresAt:       parseTime(normalized["expires-at"]),
+		Checksum:        normalized["checksum"],
+		ContentEncoding: normalized["content-encoding"],
+		CreatedAt:       parseTime(normalized["created-at"]),
+		UploaderIPHash:  normalized["uploader-ip-hash"],
+		ScanStatus:      ScanStatus(normalized["scan-status"]),
+		ScanSignature:   normalized["scan-signature"],
+		ScannedAt:       parseTime(normalized["scanned-at"]),
+	}
+	if labels, err := url.ParseQuery(normalized["labels"]); err == nil && len(labels) > 0 {
+		metadata.Labels = make(map[string]string, len(labels))
+		for key := range labels {
+			metadata.Labels[key] = labels.Get(key)
+		}
 	}
+	return metadata, nil
+}
+
+// ErrChecksumMismatch is returned when file content does not match its expected checksum.
+// Put treats a non-empty metadata.Checksum as the expected checksum and stores nothing on mismatch,
+// unless the content is encoded.
+var ErrChecksumMismatch = errors.New("file checksum does not match the expected checksum")
 
-	// Handle backward compatibility for files without expiration
-	if expiresAt, exists := m["Expires-At"]; exists && expiresAt != nil {
-		metadata.ExpiresAt = *expiresAt
+// ErrMetadataTooLarge is returned by Put when the metadata, e.g. its labels, is larger than the storage can store with a file
+var ErrMetadataTooLarge = errors.New("file metadata is too large for the storage")
+
+// checksumReader computes the SHA-256 checksum and size of everything read through it
+type checksumReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	n      int64
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	return &checksumReader{reader: reader, hash: sha256.New()}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *checksumReader) Sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// checksumMatches reports whether actual satisfies the expected checksum, which may be empty
+func checksumMatches(expected, actual string) bool {
+	return expected == "" || strings.EqualFold(expected, actual)
+}
+
+// VerifyChecksum reads the file back and compares its content with the checksum in its metadata.
+// Files stored without a checksum cannot be verified and are reported as valid.
+func VerifyChecksum(ctx context.Context, s Storage, filename string) error {
+	reader, metadata, err := s.GetWithMetadata(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	content, err := newDecoder(reader, metadata.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	checksum := newChecksumReader(content)
+	if _, err := io.Copy(io.Discard, checksum); err != nil {
+		return err
 	}
 
-	return metadata
+	if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Object is a stored file as returned by Storage.Iterate
+type Object struct {
+	Filename string
+	Metadata Metadata
+
+	// ModTime is when the file was stored
+	ModTime time.Time
+}
+
+type ListOptions struct {
+	// Prefix limits the listing to file IDs starting with it
+	Prefix string
+
+	// ExpiredOnly limits the listing to files that have expired
+	ExpiredOnly bool
+
+	// OlderThan, if set, limits the listing to files stored before it
+	OlderThan time.Time
+
+	// Labels limits the listing to files that have all of the labels with the same values
+	Labels map[string]string
+
+	// QuarantinedOnly limits the listing to files in which malware was found
+	QuarantinedOnly bool
+}
+
+// matchesStored reports whether a file passes the filters that do not need its metadata
+func (o ListOptions) matchesStored(filename string, modTime time.Time) bool {
+	return strings.HasPrefix(filename, o.Prefix) && (o.OlderThan.IsZero() || modTime.Before(o.OlderThan))
+}
+
+func (o ListOptions) matchesMetadata(metadata Metadata) bool {
+	if o.ExpiredOnly && !metadata.IsExpired() {
+		return false
+	} else if o.QuarantinedOnly && !metadata.IsQuarantined() {
+		return false
+	}
+	for key, value := range o.Labels {
+		if label, ok := metadata.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Storages writing files under temporary names hide them and give them this extension
+// until they are renamed into place
+const tempExt = ".tmp"
+
+// isTemp reports whether the file name is of a temporary file
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempExt)
+}
+
+// listAll collects an iteration into the parallel slices returned by List
+func listAll(objects iter.Seq2[Object, error]) (filenames []string, metadata []Metadata, err error) {
+	for object, err := range objects {
+		if err != nil {
+			return nil, nil, err
+		}
+
+		filenames = append(filenames, object.Filename)
+		metadata = append(metadata, object.Metadata)
+	}
+	return filenames, metadata, nil
+}
+
+// deleteExpired deletes every expired file found by the storage's iterator
+func deleteExpired(ctx context.Context, s Storage) (deletedCount int, err error) {
+	return DeleteExpiredWith(ctx, s, nil)
+}
+
+// DeleteExpiredWith deletes expired files like Storage.DeleteExpired, calling deleted, if not nil,
+// for every file it deleted. Files that fail to be deleted do not stop the others from being
+// deleted, their errors are returned together at the end.
+func DeleteExpiredWith(ctx context.Context, s Storage, deleted func(Object)) (deletedCount int, err error) {
+	var errs []error
+	for object, err := range s.Iterate(ctx, ListOptions{ExpiredOnly: true}) {
+		if err != nil {
+			return deletedCount, errors.Join(append(errs, err)...)
+		}
+
+		if err := s.Delete(ctx, object.Filename); err != nil {
+			if !s.FileNotExists(err) {
+				errs = append(errs, fmt.Errorf("failed to delete expired file [fileId=%s]: %w", object.Filename, err))
+			}
+			// Files deleted in the meantime, e.g. by bucket lifecycle rules, are not reported
+			continue
+		}
+		if deleted != nil {
+			deleted(object)
+		}
+		deletedCount++
+	}
+
+	return deletedCount, errors.Join(errs...)
 }
 
 type Storage interface {
 	List(ctx context.Context) (filenames []string, metadata []Metadata, err error)
+
+	// Iterate streams stored files matching the options. Iteration stops after the first error.
+	Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error]
+
 	Get(ctx context.Context, filename string) (reader io.ReadCloser, err error)
 	GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error)
 	GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error)
@@ -52,3 +436,115 @@ type Storage interface {
 	FileNotExists(err error) bool
 	Type() string
 }
+
+type PresignDownloadOptions struct {
+	// Expiry is how long the URL stays valid
+	Expiry time.Duration
+
+	// ContentType and ContentDisposition override the response headers sent by the storage
+	ContentType        string
+	ContentDisposition string
+}
+
+// DownloadPresigner is an optional capability of a Storage that can hand out
+// short-lived URLs which let clients download files directly from the storage
+type DownloadPresigner interface {
+	PresignDownload(ctx context.Context, filename string, options PresignDownloadOptions) (url string, err error)
+}
+
+// ErrUploadSizeMismatch is returned when a presigned upload does not match its declared size
+var ErrUploadSizeMismatch = errors.New("uploaded file size does not match the declared size")
+
+type PresignUploadOptions struct {
+	// Expiry is how long the URLs stay valid
+	Expiry time.Duration
+
+	// Size is the exact size of the file in bytes
+	Size int64
+
+	// Checksum is the hex-encoded SHA-256 of the content. Storages verifying uploads
+	// themselves require clients to send it, see PresignedUpload.Headers.
+	Checksum string
+}
+
+// PresignedUpload describes how a client uploads a file directly to the storage.
+// Small files are uploaded with a single request to URL, larger ones in Parts.
+type PresignedUpload struct {
+	// UploadID identifies a multipart upload, empty for single request uploads
+	UploadID string
+
+	URL string
+	// Headers must be sent with the request to URL
+	Headers map[string]string
+
+	Parts []PresignedUploadPart
+}
+
+type PresignedUploadPart struct {
+	// Number starts at 1
+	Number int
+	URL    string
+	Size   int64
+}
+
+// UploadPresigner is an optional capability of a Storage that can hand out
+// short-lived URLs which let clients upload files directly to the storage
+type UploadPresigner interface {
+	PresignUpload(ctx context.Context, filename string, options PresignUploadOptions) (upload PresignedUpload, err error)
+
+	// CompleteUpload finalizes the upload and stores its metadata. ETags are the ETag headers returned
+	// for each part in order and are ignored for single request uploads. If the stored file is not
+	// exactly metadata.ContentLength bytes long, ErrUploadSizeMismatch is returned. Likewise, a file
+	// not matching a non-empty metadata.Checksum is rejected with ErrChecksumMismatch. Uploads that
+	// failed to complete are kept, so that the completion can be retried, until AbortUpload.
+	CompleteUpload(ctx context.Context, filename, uploadID string, etags []string, metadata Metadata) error
+
+	AbortUpload(ctx context.Context, filename, uploadID string) error
+}
+
+// HealthChecker is an optional capability of a Storage that can check it is reachable
+// and usable, e.g. that its credentials have not expired
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckHealth checks the storage if it is a HealthChecker, other storages are reported as healthy
+func CheckHealth(ctx context.Context, s Storage) error {
+	if checker, ok := s.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+type FsckOptions struct {
+	// GracePeriod protects files modified more recently than this, which may belong to writes in progress
+	GracePeriod time.Duration
+
+	// DryRun only reports the files that would be removed
+	DryRun bool
+}
+
+// DefaultFsckGracePeriod is long enough for any write in progress to have completed
+const DefaultFsckGracePeriod = time.Hour
+
+// Fscker is an optional capability of a Storage that can leave leftovers of interrupted
+// writes behind, like temporary files, and remove them
+type Fscker interface {
+	// Fsck removes the leftovers and returns their paths relative to the storage directory
+	Fsck(ctx context.Context, options FsckOptions) (removed []string, err error)
+}
+
+// FreeSpaceReporter is an optional capability of a Storage kept on a local disk
+type FreeSpaceReporter interface {
+	// FreeSpace returns the number of bytes available to the storage
+	FreeSpace() (uint64, error)
+}
+
+// FreeSpace returns the free space of the storage if it is a FreeSpaceReporter,
+// and an error wrapping errors.ErrUnsupported otherwise
+func FreeSpace(s Storage) (uint64, error) {
+	if reporter, ok := s.(FreeSpaceReporter); ok {
+		return reporter.FreeSpace()
+	}
+	return 0, fmt.Errorf("free space of %s storage: %w", s.Type(), errors.ErrUnsupported)
+}
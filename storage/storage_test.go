@@ -0,0 +1,274 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+func TestIterate(t *testing.T) {
+	ctx := context.Background()
+
+	backends := map[string]func(t *testing.T) storage.Storage{
+		"local": func(t *testing.T) storage.Storage {
+			s, err := storage.NewLocalStorage(t.TempDir(), storage.ShardDepth(1))
+			if err != nil {
+				t.Fatalf("Failed to create local storage: %v", err)
+			}
+			return s
+		},
+		"s3": func(t *testing.T) storage.Storage {
+			s, _ := setupS3Storage(t)
+			return s
+		},
+	}
+
+	collect := func(t *testing.T, s storage.Storage, options storage.ListOptions) []string {
+		t.Helper()
+
+		var filenames []string
+		for object, err := range s.Iterate(ctx, options) {
+			if err != nil {
+				t.Fatalf("Failed to iterate files: %v", err)
+			}
+			filenames = append(filenames, object.Filename)
+		}
+		slices.Sort(filenames)
+		return filenames
+	}
+
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage(t)
+			putTestFiles(t, s)
+
+			t.Run("lists all files", func(t *testing.T) {
+				if filenames := collect(t, s, storage.ListOptions{}); !slices.Equal(filenames, []string{"expired", "valid"}) {
+					t.Errorf("Expected [expired valid], got %v", filenames)
+				}
+			})
+
+			t.Run("filters by prefix", func(t *testing.T) {
+				if filenames := collect(t, s, storage.ListOptions{Prefix: "va"}); !slices.Equal(filenames, []string{"valid"}) {
+					t.Errorf("Expected [valid], got %v", filenames)
+				}
+			})
+
+			t.Run("filters expired files", func(t *testing.T) {
+				if filenames := collect(t, s, storage.ListOptions{ExpiredOnly: true}); !slices.Equal(filenames, []string{"expired"}) {
+					t.Errorf("Expected [expired], got %v", filenames)
+				}
+			})
+
+			t.Run("filters by age", func(t *testing.T) {
+				if filenames := collect(t, s, storage.ListOptions{OlderThan: time.Now().Add(-time.Hour)}); len(filenames) != 0 {
+					t.Errorf("Expected no files, got %v", filenames)
+				}
+				if filenames := collect(t, s, storage.ListOptions{OlderThan: time.Now().Add(time.Hour)}); len(filenames) != 2 {
+					t.Errorf("Expected 2 files, got %v", filenames)
+				}
+			})
+
+			t.Run("stops when consumer stops", func(t *testing.T) {
+				var count int
+				for object, err := range s.Iterate(ctx, storage.ListOptions{}) {
+					if err != nil {
+						t.Fatalf("Failed to iterate files: %v", err)
+					}
+					if object.ModTime.IsZero() {
+						t.Errorf("Expected modification time for %s", object.Filename)
+					}
+					count++
+					break
+				}
+				if count != 1 {
+					t.Errorf("Expected 1 file, got %d", count)
+				}
+			})
+		})
+	}
+}
+
+// failingDeleteStorage fails to delete the file named filename
+type failingDeleteStorage struct {
+	*storage.MemoryStorage
+	filename string
+}
+
+func (s failingDeleteStorage) Delete(ctx context.Context, filename string) error {
+	if filename == s.filename {
+		return errors.New("device busy")
+	}
+	return s.MemoryStorage.Delete(ctx, filename)
+}
+
+func TestDeleteExpiredWith(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, _ := storage.NewMemoryStorage(0)
+	s := failingDeleteStorage{MemoryStorage: memoryStorage, filename: "busy"}
+
+	expired := storage.Metadata{ExpiresAt: time.Now().Add(-time.Hour)}
+	for _, filename := range []string{"busy", "expired", "old"} {
+		if err := s.Put(ctx, filename, strings.NewReader("content"), expired); err != nil {
+			t.Fatalf("Failed to put file %s: %v", filename, err)
+		}
+	}
+
+	var deleted []string
+	deletedCount, err := storage.DeleteExpiredWith(ctx, s, func(object storage.Object) {
+		deleted = append(deleted, object.Filename)
+	})
+	if err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Errorf("Expected error about the file that failed to be deleted, got %v", err)
+	}
+	slices.Sort(deleted)
+	if deletedCount != 2 || !slices.Equal(deleted, []string{"expired", "old"}) {
+		t.Errorf("Expected other files to be deleted, got %d: %v", deletedCount, deleted)
+	}
+}
+
+func TestMetadataJSON(t *testing.T) {
+	t.Run("round trips typed fields", func(t *testing.T) {
+		metadata := storage.Metadata{
+			Filename:       "hello.txt",
+			ContentType:    "text/plain",
+			ContentLength:  13,
+			ExpiresAt:      time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+			CreatedAt:      time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+			UploaderIPHash: "0123456789abcdef",
+			Labels:         map[string]string{"project": "fileigloo"},
+			ScanStatus:     storage.ScanInfected,
+			ScanSignature:  "Eicar-Test-Signature",
+			ScannedAt:      time.Date(2024, 5, 1, 12, 30, 1, 0, time.UTC),
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			t.Fatalf("Failed to encode metadata: %v", err)
+		}
+		if !strings.Contains(string(data), `"Version":3`) {
+			t.Errorf("Expected metadata version to be stored, got %s", data)
+		}
+
+		var decoded storage.Metadata
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Failed to decode metadata: %v", err)
+		}
+		if !decoded.Equal(metadata) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", metadata, decoded)
+		}
+	})
+
+	t.Run("stores unscanned files with version 2", func(t *testing.T) {
+		// Readable by versions from before virus scanning
+		data, err := json.Marshal(storage.Metadata{Filename: "hello.txt"})
+		if err != nil {
+			t.Fatalf("Failed to encode metadata: %v", err)
+		}
+		if !strings.Contains(string(data), `"Version":2`) {
+			t.Errorf("Expected metadata version 2, got %s", data)
+		}
+
+		if version := storage.MetadataToStringMap(storage.Metadata{Filename: "hello.txt"})["Metadata-Version"]; version != "2" {
+			t.Errorf("Expected metadata version 2, got %q", version)
+		}
+	})
+
+	t.Run("decodes version 1 metadata", func(t *testing.T) {
+		data := `{"Filename":"hello.txt","ContentType":"text/plain","ContentLength":"13",` +
+			`"PasswordHash":"hash123","ExpiresAt":"2099-01-01T00:00:00Z","Checksum":"abc"}`
+
+		var metadata storage.Metadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			t.Fatalf("Failed to decode metadata: %v", err)
+		}
+
+		expected := storage.Metadata{
+			Filename:      "hello.txt",
+			ContentType:   "text/plain",
+			ContentLength: 13,
+			PasswordHash:  "hash123",
+			ExpiresAt:     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+			Checksum:      "abc",
+		}
+		if !metadata.Equal(expected) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", expected, metadata)
+		}
+	})
+
+	t.Run("treats empty and invalid version 1 values as unset", func(t *testing.T) {
+		data := `{"Filename":"hello.txt","ContentLength":"","ExpiresAt":"invalid-date"}`
+
+		var metadata storage.Metadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			t.Fatalf("Failed to decode metadata: %v", err)
+		}
+		if metadata.ContentLength != 0 || !metadata.ExpiresAt.IsZero() || metadata.IsExpired() {
+			t.Errorf("Expected unset size and expiration, got %+v", metadata)
+		}
+	})
+
+	t.Run("rejects newer versions", func(t *testing.T) {
+		var metadata storage.Metadata
+		if err := json.Unmarshal([]byte(`{"Version":99,"Filename":"hello.txt"}`), &metadata); err == nil {
+			t.Error("Expected error for unsupported metadata version, got nil")
+		}
+	})
+}
+
+func TestMetadataStringMap(t *testing.T) {
+	t.Run("round trips typed fields", func(t *testing.T) {
+		metadata := storage.Metadata{
+			Filename:      "hello.txt",
+			ContentLength: 13,
+			ExpiresAt:     time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+			CreatedAt:     time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+			Labels:        map[string]string{"project": "fileigloo", "Owner": "zażółć & co"},
+		}
+
+		// S3 returns keys lowercased
+		m := make(map[string]string)
+		for key, value := range storage.MetadataToStringMap(metadata) {
+			m[strings.ToLower(key)] = value
+		}
+		for key, value := range m {
+			for _, r := range value {
+				if r > 127 {
+					t.Fatalf("Expected ASCII values only, got %q for %s", value, key)
+				}
+			}
+		}
+
+		decoded, err := storage.StringMapToMetadata(m)
+		if err != nil {
+			t.Fatalf("Failed to decode metadata: %v", err)
+		}
+		if !decoded.Equal(metadata) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", metadata, decoded)
+		}
+	})
+
+	t.Run("rejects newer versions", func(t *testing.T) {
+		if _, err := storage.StringMapToMetadata(map[string]string{"metadata-version": "99", "filename": "hello.txt"}); err == nil {
+			t.Error("Expected error for newer metadata version, got nil")
+		}
+	})
+
+	t.Run("tolerates missing keys", func(t *testing.T) {
+		metadata, err := storage.StringMapToMetadata(map[string]string{"filename": "hello.txt", "content-length": "13"})
+		if err != nil {
+			t.Fatalf("Failed to decode metadata: %v", err)
+		}
+
+		expected := storage.Metadata{Filename: "hello.txt", ContentLength: 13}
+		if !metadata.Equal(expected) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", expected, metadata)
+		}
+	})
+}
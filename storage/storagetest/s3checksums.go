@@ -0,0 +1,94 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// S3Checksums wraps a fake S3 server, like gofakes3, with the SHA-256 checksums it does not implement.
+// Like S3, it rejects objects not matching their x-amz-checksum-sha256 header, computes the checksum of
+// objects copied with the SHA256 checksum algorithm and returns the checksums of objects to HEAD requests
+// enabling the checksum mode. Checksums of parts are not supported.
+func S3Checksums(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	checksums := make(map[string]string)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copied := r.Header.Get("X-Amz-Copy-Source") != ""
+		switch {
+		case r.Method == http.MethodHead && strings.EqualFold(r.Header.Get("X-Amz-Checksum-Mode"), "ENABLED"):
+			mu.Lock()
+			checksum, ok := checksums[r.URL.Path]
+			mu.Unlock()
+			if ok {
+				w.Header().Set("X-Amz-Checksum-Sha256", checksum)
+				w.Header().Set("X-Amz-Checksum-Type", "FULL_OBJECT")
+			}
+			next.ServeHTTP(w, r)
+
+		case r.Method == http.MethodPut && copied && strings.EqualFold(r.Header.Get("X-Amz-Checksum-Algorithm"), "SHA256"):
+			recorder := httptest.NewRecorder()
+			next.ServeHTTP(recorder, r)
+			body := recorder.Body.Bytes()
+			if recorder.Code == http.StatusOK {
+				content := httptest.NewRecorder()
+				next.ServeHTTP(content, httptest.NewRequest(http.MethodGet, r.URL.Path, nil))
+				checksum := sha256Base64(content.Body.Bytes())
+
+				mu.Lock()
+				checksums[r.URL.Path] = checksum
+				mu.Unlock()
+				body = bytes.Replace(body, []byte("</CopyObjectResult>"), []byte("<ChecksumSHA256>"+checksum+"</ChecksumSHA256></CopyObjectResult>"), 1)
+			}
+
+			maps.Copy(w.Header(), recorder.Header())
+			w.Header().Del("Content-Length")
+			w.WriteHeader(recorder.Code)
+			w.Write(body) //#nosec
+
+		case r.Method == http.MethodPut && !copied && r.Header.Get("X-Amz-Checksum-Sha256") != "":
+			content, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			checksum := r.Header.Get("X-Amz-Checksum-Sha256")
+			if sha256Base64(content) != checksum {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "<Error><Code>BadDigest</Code><Message>The SHA256 you specified did not match the calculated checksum.</Message></Error>") //#nosec
+				return
+			}
+
+			if r.URL.Query().Get("uploadId") == "" {
+				mu.Lock()
+				checksums[r.URL.Path] = checksum
+				mu.Unlock()
+			}
+			r.Body = io.NopCloser(bytes.NewReader(content))
+			next.ServeHTTP(w, r)
+
+		default:
+			part := r.Method == http.MethodPut && r.URL.Query().Get("uploadId") != ""
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && !part {
+				// Replaced, e.g. by completing a multipart upload, or deleted
+				mu.Lock()
+				delete(checksums, r.URL.Path)
+				mu.Unlock()
+			}
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func sha256Base64(content []byte) string {
+	sum := sha256.Sum256(content)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,483 @@
+// Package storagetest provides a test suite checking that storage backends behave the same
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+)
+
+// Factory creates an empty storage for a single test
+type Factory func(t *testing.T) storage.Storage
+
+// LargeObjectSize is the size of the file stored by the large objects test. It is larger
+// than the default part size of multipart uploads.
+const LargeObjectSize = 12 * 1024 * 1024
+
+const (
+	content         = "Hello, World!"
+	contentChecksum = "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"
+)
+
+// RunConformance runs the conformance tests against storages created with newStorage
+func RunConformance(t *testing.T, newStorage Factory) {
+	t.Run("Type", func(t *testing.T) { testType(t, newStorage) })
+	t.Run("PutGet", func(t *testing.T) { testPutGet(t, newStorage) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, newStorage) })
+	t.Run("Checksum", func(t *testing.T) { testChecksum(t, newStorage) })
+	t.Run("NotExists", func(t *testing.T) { testNotExists(t, newStorage) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newStorage) })
+	t.Run("DeleteExpired", func(t *testing.T) { testDeleteExpired(t, newStorage) })
+	t.Run("List", func(t *testing.T) { testList(t, newStorage) })
+	t.Run("Iterate", func(t *testing.T) { testIterate(t, newStorage) })
+	t.Run("LargeObject", func(t *testing.T) { testLargeObject(t, newStorage) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStorage) })
+}
+
+var (
+	past   = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	future = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func testMetadata(expiresAt time.Time) storage.Metadata {
+	return storage.Metadata{
+		Filename:       "hello.txt",
+		ContentType:    "text/plain",
+		ContentLength:  int64(len(content)),
+		PasswordHash:   "hash123",
+		ExpiresAt:      expiresAt,
+		CreatedAt:      time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+		UploaderIPHash: "0123456789abcdef0123456789abcdef",
+		Labels:         map[string]string{"project": "fileigloo", "build": "123"},
+		ScanStatus:     storage.ScanClean,
+		ScannedAt:      time.Date(2024, 5, 1, 12, 30, 1, 0, time.UTC),
+	}
+}
+
+func put(t *testing.T, s storage.Storage, filename string, metadata storage.Metadata) storage.Metadata {
+	t.Helper()
+
+	if err := s.Put(context.Background(), filename, bytes.NewBufferString(content), metadata); err != nil {
+		t.Fatalf("Failed to put file %s: %v", filename, err)
+	}
+	metadata.Checksum = contentChecksum
+	return metadata
+}
+
+func readAll(t *testing.T, reader io.ReadCloser) []byte {
+	t.Helper()
+
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	return data
+}
+
+func collect(t *testing.T, s storage.Storage, options storage.ListOptions) []string {
+	t.Helper()
+
+	var filenames []string
+	for object, err := range s.Iterate(context.Background(), options) {
+		if err != nil {
+			t.Fatalf("Failed to iterate files: %v", err)
+		}
+		filenames = append(filenames, object.Filename)
+	}
+	slices.Sort(filenames)
+	return filenames
+}
+
+func testType(t *testing.T, newStorage Factory) {
+	if s := newStorage(t); s.Type() == "" {
+		t.Error("Expected non-empty storage type")
+	}
+}
+
+func testPutGet(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+	expected := put(t, s, "file", testMetadata(future))
+
+	t.Run("Get", func(t *testing.T) {
+		reader, err := s.Get(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		if data := readAll(t, reader); string(data) != content {
+			t.Errorf("Content mismatch: %s", data)
+		}
+	})
+
+	t.Run("GetWithMetadata", func(t *testing.T) {
+		reader, metadata, err := s.GetWithMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+		if data := readAll(t, reader); string(data) != content {
+			t.Errorf("Content mismatch: %s", data)
+		}
+		if !metadata.Equal(expected) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", expected, metadata)
+		}
+	})
+
+	t.Run("GetOnlyMetadata", func(t *testing.T) {
+		metadata, err := s.GetOnlyMetadata(ctx, "file")
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if !metadata.Equal(expected) {
+			t.Errorf("Metadata mismatch. Expected: %+v, Got: %+v", expected, metadata)
+		}
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		if err := s.Put(ctx, "empty", bytes.NewReader(nil), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put empty file: %v", err)
+		}
+		reader, err := s.Get(ctx, "empty")
+		if err != nil {
+			t.Fatalf("Failed to get empty file: %v", err)
+		}
+		if data := readAll(t, reader); len(data) != 0 {
+			t.Errorf("Expected empty file, got %d bytes", len(data))
+		}
+	})
+}
+
+func testOverwrite(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+	put(t, s, "file", testMetadata(time.Time{}))
+
+	metadata := storage.Metadata{Filename: "new.txt", ContentType: "application/octet-stream"}
+	if err := s.Put(ctx, "file", bytes.NewBufferString("new content"), metadata); err != nil {
+		t.Fatalf("Failed to overwrite file: %v", err)
+	}
+
+	reader, stored, err := s.GetWithMetadata(ctx, "file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if data := readAll(t, reader); string(data) != "new content" {
+		t.Errorf("Expected new content, got %s", data)
+	}
+	if stored.Filename != "new.txt" || stored.PasswordHash != "" {
+		t.Errorf("Expected metadata to be replaced, got %+v", stored)
+	}
+	if filenames := collect(t, s, storage.ListOptions{}); !slices.Equal(filenames, []string{"file"}) {
+		t.Errorf("Expected [file], got %v", filenames)
+	}
+}
+
+func testChecksum(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	t.Run("records checksum", func(t *testing.T) {
+		put(t, s, "file", storage.Metadata{})
+		if err := storage.VerifyChecksum(ctx, s, "file"); err != nil {
+			t.Errorf("Failed to verify checksum: %v", err)
+		}
+	})
+
+	t.Run("accepts matching checksum", func(t *testing.T) {
+		metadata := storage.Metadata{Checksum: contentChecksum}
+		if err := s.Put(ctx, "matching", bytes.NewBufferString(content), metadata); err != nil {
+			t.Errorf("Failed to put file: %v", err)
+		}
+	})
+
+	t.Run("rejects mismatching checksum", func(t *testing.T) {
+		sum := sha256.Sum256([]byte("something else"))
+		metadata := storage.Metadata{Checksum: hex.EncodeToString(sum[:])}
+		err := s.Put(ctx, "mismatching", bytes.NewBufferString(content), metadata)
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+		}
+		if _, err := s.GetOnlyMetadata(ctx, "mismatching"); !s.FileNotExists(err) {
+			t.Errorf("Expected rejected file not to be stored, got %v", err)
+		}
+	})
+}
+
+func testNotExists(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	t.Run("Get", func(t *testing.T) {
+		if _, err := s.Get(ctx, "missing"); !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("GetWithMetadata", func(t *testing.T) {
+		if _, _, err := s.GetWithMetadata(ctx, "missing"); !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("GetOnlyMetadata", func(t *testing.T) {
+		if _, err := s.GetOnlyMetadata(ctx, "missing"); !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		// Storages like S3 cannot tell whether a deleted file existed without another request
+		if err := s.Delete(ctx, "missing"); err != nil && !s.FileNotExists(err) {
+			t.Errorf("Expected FileNotExists to return true for error: %v", err)
+		}
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		for _, err := range []error{nil, errors.New("unexpected error"), storage.ErrChecksumMismatch, context.Canceled} {
+			if s.FileNotExists(err) {
+				t.Errorf("Expected FileNotExists to return false for error: %v", err)
+			}
+		}
+	})
+}
+
+func testDelete(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+	put(t, s, "deleted", testMetadata(time.Time{}))
+	put(t, s, "kept", testMetadata(time.Time{}))
+
+	if err := s.Delete(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+
+	if _, err := s.Get(ctx, "deleted"); !s.FileNotExists(err) {
+		t.Errorf("Expected deleted file to be missing, got %v", err)
+	}
+	if filenames := collect(t, s, storage.ListOptions{}); !slices.Equal(filenames, []string{"kept"}) {
+		t.Errorf("Expected [kept], got %v", filenames)
+	}
+}
+
+func testDeleteExpired(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+	put(t, s, "expired", testMetadata(past))
+	put(t, s, "valid", testMetadata(future))
+	put(t, s, "permanent", testMetadata(time.Time{}))
+
+	deletedCount, err := s.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatalf("Failed to delete expired files: %v", err)
+	}
+	if deletedCount != 1 {
+		t.Errorf("Expected 1 deleted file, got %d", deletedCount)
+	}
+	if filenames := collect(t, s, storage.ListOptions{}); !slices.Equal(filenames, []string{"permanent", "valid"}) {
+		t.Errorf("Expected [permanent valid], got %v", filenames)
+	}
+
+	if deletedCount, err := s.DeleteExpired(ctx); err != nil || deletedCount != 0 {
+		t.Errorf("Expected no files to be deleted again, got %d (%v)", deletedCount, err)
+	}
+}
+
+func testList(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	t.Run("empty storage", func(t *testing.T) {
+		filenames, metadata, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != 0 || len(metadata) != 0 {
+			t.Errorf("Expected no files, got %v", filenames)
+		}
+	})
+
+	t.Run("files with metadata", func(t *testing.T) {
+		files := map[string]storage.Metadata{
+			"first":  put(t, s, "first", testMetadata(time.Time{})),
+			"second": put(t, s, "second", testMetadata(future)),
+		}
+
+		filenames, metadata, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(filenames) != len(files) || len(metadata) != len(files) {
+			t.Fatalf("Expected %d files, got %v", len(files), filenames)
+		}
+		for i, filename := range filenames {
+			if !metadata[i].Equal(files[filename]) {
+				t.Errorf("Metadata mismatch for %s. Expected: %+v, Got: %+v", filename, files[filename], metadata[i])
+			}
+		}
+	})
+}
+
+func testIterate(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+	put(t, s, "valid", testMetadata(future))
+	put(t, s, "expired", testMetadata(past))
+
+	t.Run("filters by prefix", func(t *testing.T) {
+		if filenames := collect(t, s, storage.ListOptions{Prefix: "va"}); !slices.Equal(filenames, []string{"valid"}) {
+			t.Errorf("Expected [valid], got %v", filenames)
+		}
+	})
+
+	t.Run("filters expired files", func(t *testing.T) {
+		if filenames := collect(t, s, storage.ListOptions{ExpiredOnly: true}); !slices.Equal(filenames, []string{"expired"}) {
+			t.Errorf("Expected [expired], got %v", filenames)
+		}
+	})
+
+	t.Run("filters by age", func(t *testing.T) {
+		if filenames := collect(t, s, storage.ListOptions{OlderThan: time.Now().Add(-time.Hour)}); len(filenames) != 0 {
+			t.Errorf("Expected no files, got %v", filenames)
+		}
+		if filenames := collect(t, s, storage.ListOptions{OlderThan: time.Now().Add(time.Hour)}); len(filenames) != 2 {
+			t.Errorf("Expected 2 files, got %v", filenames)
+		}
+	})
+
+	t.Run("filters by labels", func(t *testing.T) {
+		unlabeled := testMetadata(future)
+		unlabeled.Labels = nil
+		put(t, s, "unlabeled", unlabeled)
+		defer s.Delete(ctx, "unlabeled") //#nosec
+
+		if filenames := collect(t, s, storage.ListOptions{Labels: map[string]string{"project": "fileigloo"}}); !slices.Equal(filenames, []string{"expired", "valid"}) {
+			t.Errorf("Expected [expired valid], got %v", filenames)
+		}
+		if filenames := collect(t, s, storage.ListOptions{Labels: map[string]string{"project": "fileigloo", "build": "124"}}); len(filenames) != 0 {
+			t.Errorf("Expected no files, got %v", filenames)
+		}
+		if filenames := collect(t, s, storage.ListOptions{Labels: map[string]string{"build": "123"}, ExpiredOnly: true}); !slices.Equal(filenames, []string{"expired"}) {
+			t.Errorf("Expected [expired], got %v", filenames)
+		}
+	})
+
+	t.Run("filters quarantined files", func(t *testing.T) {
+		infected := testMetadata(future)
+		infected.ScanStatus = storage.ScanInfected
+		infected.ScanSignature = "Eicar-Test-Signature"
+		put(t, s, "infected", infected)
+		defer s.Delete(ctx, "infected") //#nosec
+
+		if filenames := collect(t, s, storage.ListOptions{QuarantinedOnly: true}); !slices.Equal(filenames, []string{"infected"}) {
+			t.Errorf("Expected [infected], got %v", filenames)
+		}
+	})
+
+	t.Run("stops when consumer stops", func(t *testing.T) {
+		var count int
+		for object, err := range s.Iterate(ctx, storage.ListOptions{}) {
+			if err != nil {
+				t.Fatalf("Failed to iterate files: %v", err)
+			}
+			if object.ModTime.IsZero() {
+				t.Errorf("Expected modification time for %s", object.Filename)
+			}
+			count++
+			break
+		}
+		if count != 1 {
+			t.Errorf("Expected 1 file, got %d", count)
+		}
+	})
+}
+
+func testLargeObject(t *testing.T, newStorage Factory) {
+	if testing.Short() {
+		t.Skip("Skipping large object test in short mode")
+	}
+
+	ctx := context.Background()
+	s := newStorage(t)
+
+	data := make([]byte, LargeObjectSize)
+	random := rand.NewChaCha8([32]byte{})
+	random.Read(data) //#nosec
+	sum := sha256.Sum256(data)
+
+	// Wrapped, so that backends cannot rely on the reader being seekable
+	reader := io.MultiReader(bytes.NewReader(data))
+	metadata := storage.Metadata{ContentLength: int64(len(data))}
+	if err := s.Put(ctx, "large", reader, metadata); err != nil {
+		t.Fatalf("Failed to put large file: %v", err)
+	}
+
+	stored, err := s.Get(ctx, "large")
+	if err != nil {
+		t.Fatalf("Failed to get large file: %v", err)
+	}
+	if !bytes.Equal(readAll(t, stored), data) {
+		t.Error("Large file content mismatch")
+	}
+
+	storedMetadata, err := s.GetOnlyMetadata(ctx, "large")
+	if err != nil {
+		t.Fatalf("Failed to get metadata: %v", err)
+	}
+	if storedMetadata.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("Checksum mismatch: %s", storedMetadata.Checksum)
+	}
+}
+
+func testConcurrency(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	const workers = 10
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			filename := fmt.Sprintf("file%d", i)
+			data := fmt.Sprintf("content of file %d", i)
+			if err := s.Put(ctx, filename, bytes.NewBufferString(data), storage.Metadata{}); err != nil {
+				t.Errorf("Failed to put file %s: %v", filename, err)
+				return
+			}
+
+			reader, err := s.Get(ctx, filename)
+			if err != nil {
+				t.Errorf("Failed to get file %s: %v", filename, err)
+				return
+			}
+			defer reader.Close()
+			if stored, _ := io.ReadAll(reader); string(stored) != data {
+				t.Errorf("Content mismatch for %s: %s", filename, stored)
+			}
+
+			for _, err := range s.Iterate(ctx, storage.ListOptions{}) {
+				if err != nil {
+					t.Errorf("Failed to iterate files: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if filenames := collect(t, s, storage.ListOptions{}); len(filenames) != workers {
+		t.Errorf("Expected %d files, got %v", workers, filenames)
+	}
+}
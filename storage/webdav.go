@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+type WebDAVConfig struct {
+	// URL of the collection files are stored in, it is created if missing
+	URL      string
+	Username string
+	Password string
+}
+
+// WebDAVStorage stores files on a WebDAV server, e.g. a Nextcloud share. Like with LocalStorage,
+// metadata is stored next to each file in a .metadata file, written after the file is complete.
+type WebDAVStorage struct {
+	Storage
+	baseURL  *url.URL
+	username string
+	password string
+	client   *http.Client
+}
+
+func NewWebDAVStorage(ctx context.Context, config WebDAVConfig) (*WebDAVStorage, error) {
+	baseURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	} else if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, errors.New("webdav url must use http or https")
+	}
+	// Collections are addressed with a trailing slash
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/") + "/"
+
+	s := &WebDAVStorage{
+		baseURL:  baseURL,
+		username: config.Username,
+		password: config.Password,
+		client:   &http.Client{},
+	}
+
+	resp, err := s.do(ctx, "PROPFIND", "", nil, map[string]string{"Depth": "0"})
+	if s.FileNotExists(err) {
+		resp, err = s.do(ctx, "MKCOL", "", nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return s, nil
+}
+
+func (s *WebDAVStorage) Type() string {
+	return "webdav"
+}
+
+func (s *WebDAVStorage) url(name string) string {
+	if name == "" {
+		return s.baseURL.String()
+	}
+	return s.baseURL.JoinPath(name).String()
+}
+
+// do sends a request for the named file, or the collection if name is empty. Responses with
+// a status other than 2xx are returned as errors, missing files as errors wrapping fs.ErrNotExist.
+func (s *WebDAVStorage) do(ctx context.Context, method, name string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req) //#nosec
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("webdav %s %s: %w", method, name, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("webdav %s %s: %s", method, name, resp.Status)
+	}
+	return resp, nil
+}
+
+// request sends a request and discards the response body
+func (s *WebDAVStorage) request(ctx context.Context, method, name string, body io.Reader, header map[string]string) error {
+	resp, err := s.do(ctx, method, name, body, header)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body) //#nosec
+	return resp.Body.Close()
+}
+
+func (s *WebDAVStorage) readMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	resp, err := s.do(ctx, http.MethodGet, filename+".metadata", nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	return
+}
+
+func (s *WebDAVStorage) List(ctx context.Context) (filenames []string, metadata []Metadata, err error) {
+	return listAll(s.Iterate(ctx, ListOptions{}))
+}
+
+// webdavResponse is a response element of a PROPFIND multistatus response
+type webdavResponse struct {
+	Href     string `xml:"DAV: href"`
+	Propstat []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			LastModified string `xml:"DAV: getlastmodified"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: propstat"`
+}
+
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getlastmodified/></D:prop></D:propfind>`
+
+// listNames returns the modification times of the files in the collection by name
+func (s *WebDAVStorage) listNames(ctx context.Context) (map[string]time.Time, error) {
+	resp, err := s.do(ctx, "PROPFIND", "", strings.NewReader(webdavPropfindBody), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	names := make(map[string]time.Time)
+	decoder := xml.NewDecoder(resp.Body)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != "DAV:" || start.Name.Local != "response" {
+			continue
+		}
+
+		var response webdavResponse
+		if err := decoder.DecodeElement(&response, &start); err != nil {
+			return nil, err
+		}
+
+		var modTime time.Time
+		collection := false
+		for _, propstat := range response.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				collection = true
+			}
+			if t, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				modTime = t
+			}
+		}
+		if collection {
+			continue
+		}
+
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		names[path.Base(href.Path)] = modTime
+	}
+}
+
+func (s *WebDAVStorage) Iterate(ctx context.Context, options ListOptions) iter.Seq2[Object, error] {
+	return func(yield func(Object, error) bool) {
+		names, err := s.listNames(ctx)
+		if err != nil {
+			yield(Object{}, err)
+			return
+		}
+
+		// Files without metadata are incomplete or being deleted
+		var filenames []string
+		for name := range names {
+			if _, ok := names[name+".metadata"]; ok && !isTemp(name) {
+				filenames = append(filenames, name)
+			}
+		}
+		slices.Sort(filenames)
+
+		for _, filename := range filenames {
+			modTime := names[filename]
+			if !options.matchesStored(filename, modTime) {
+				continue
+			}
+
+			metadata, err := s.readMetadata(ctx, filename)
+			if s.FileNotExists(err) {
+				// Deleted since the listing
+				continue
+			} else if err != nil {
+				yield(Object{}, err)
+				return
+			}
+
+			if !options.matchesMetadata(metadata) {
+				continue
+			}
+			if !yield(Object{Filename: filename, Metadata: metadata, ModTime: modTime}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *WebDAVStorage) Get(ctx context.Context, filename string) (reader io.ReadCloser, err error) {
+	resp, err := s.do(ctx, http.MethodGet, filename, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *WebDAVStorage) GetWithMetadata(ctx context.Context, filename string) (reader io.ReadCloser, metadata Metadata, err error) {
+	metadata, err = s.readMetadata(ctx, filename)
+	if err != nil {
+		return
+	}
+
+	reader, err = s.Get(ctx, filename)
+	return
+}
+
+func (s *WebDAVStorage) GetOnlyMetadata(ctx context.Context, filename string) (metadata Metadata, err error) {
+	return s.readMetadata(ctx, filename)
+}
+
+func (s *WebDAVStorage) Put(ctx context.Context, filename string, reader io.Reader, metadata Metadata) error {
+	// The file is uploaded under a temporary name and moved into place once complete,
+	// so that a failed upload does not replace an existing file
+	temp := "." + filename + "." + rand.Text() + tempExt
+	checksum := newChecksumReader(reader)
+	if err := s.request(ctx, http.MethodPut, temp, checksum, nil); err != nil {
+		s.request(context.WithoutCancel(ctx), http.MethodDelete, temp, nil, nil) //#nosec
+		return err
+	}
+
+	if metadata.ContentEncoding == "" {
+		if !checksumMatches(metadata.Checksum, checksum.Sum()) {
+			s.request(ctx, http.MethodDelete, temp, nil, nil) //#nosec
+			return ErrChecksumMismatch
+		}
+		metadata.Checksum = checksum.Sum()
+	}
+
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	// Without metadata the old file is not listed nor served while it is replaced
+	if err := s.request(ctx, http.MethodDelete, filename+".metadata", nil, nil); err != nil && !s.FileNotExists(err) {
+		return err
+	}
+	if err := s.request(ctx, "MOVE", temp, nil, map[string]string{
+		"Destination": s.url(filename),
+		"Overwrite":   "T",
+	}); err != nil {
+		return err
+	}
+	return s.request(ctx, http.MethodPut, filename+".metadata", bytes.NewReader(metadataBytes), map[string]string{
+		"Content-Type": "application/json",
+	})
+}
+
+func (s *WebDAVStorage) Delete(ctx context.Context, filename string) error {
+	if err := s.request(ctx, http.MethodDelete, filename+".metadata", nil, nil); err != nil {
+		return err
+	}
+	return s.request(ctx, http.MethodDelete, filename, nil, nil)
+}
+
+// Fsck removes leftovers of interrupted writes and deletes: temporary files, bodies without
+// metadata and metadata without a body. Files the server reports no modification time for are kept.
+// It returns the names of the removed files.
+func (s *WebDAVStorage) Fsck(ctx context.Context, options FsckOptions) (removed []string, err error) {
+	names, err := s.listNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-options.GracePeriod)
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		modTime := names[name]
+		if modTime.IsZero() || modTime.After(cutoff) {
+			continue
+		}
+
+		var counterpart string
+		switch {
+		case isTemp(name):
+		case strings.HasSuffix(name, ".metadata"):
+			counterpart = strings.TrimSuffix(name, ".metadata")
+		default:
+			counterpart = name + ".metadata"
+		}
+		if counterpart != "" {
+			if _, ok := names[counterpart]; ok {
+				continue
+			}
+			// Written since the listing
+			if err := s.request(ctx, http.MethodHead, counterpart, nil, nil); err == nil {
+				continue
+			} else if !s.FileNotExists(err) {
+				return removed, err
+			}
+		}
+
+		if !options.DryRun {
+			if err := s.request(ctx, http.MethodDelete, name, nil, nil); err != nil && !s.FileNotExists(err) {
+				return removed, err
+			}
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+func (s *WebDAVStorage) DeleteExpired(ctx context.Context) (deletedCount int, err error) {
+	return deleteExpired(ctx, s)
+}
+
+// CheckHealth checks that the collection exists and the credentials grant access to it
+func (s *WebDAVStorage) CheckHealth(ctx context.Context) error {
+	return s.request(ctx, "PROPFIND", "", nil, map[string]string{"Depth": "0"})
+}
+
+func (s *WebDAVStorage) FileNotExists(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
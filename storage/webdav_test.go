@@ -0,0 +1,177 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+	"golang.org/x/net/webdav"
+)
+
+func setupWebDAVStorage(t *testing.T) (*storage.WebDAVStorage, webdav.FileSystem) {
+	t.Helper()
+
+	fs := webdav.NewMemFS()
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	s, err := storage.NewWebDAVStorage(context.Background(), storage.WebDAVConfig{
+		URL:      ts.URL + "/dav/files",
+		Username: "user",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create WebDAV storage: %v", err)
+	}
+	return s, fs
+}
+
+func TestNewWebDAVStorage(t *testing.T) {
+	t.Run("creates missing collection", func(t *testing.T) {
+		_, fs := setupWebDAVStorage(t)
+
+		info, err := fs.Stat(context.Background(), "/files")
+		if err != nil {
+			t.Fatalf("Expected collection to be created: %v", err)
+		}
+		if !info.IsDir() {
+			t.Error("Expected collection to be a directory")
+		}
+	})
+
+	t.Run("returns error for wrong credentials", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer ts.Close()
+
+		_, err := storage.NewWebDAVStorage(context.Background(), storage.WebDAVConfig{URL: ts.URL})
+		if err == nil {
+			t.Error("Expected error for unauthorized request, got nil")
+		}
+	})
+
+	t.Run("returns error for unsupported scheme", func(t *testing.T) {
+		if _, err := storage.NewWebDAVStorage(context.Background(), storage.WebDAVConfig{URL: "ftp://example.com"}); err == nil {
+			t.Error("Expected error for unsupported scheme, got nil")
+		}
+	})
+}
+
+func TestWebDAVStorage_List(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lists only complete files", func(t *testing.T) {
+		s, fs := setupWebDAVStorage(t)
+		putTestFiles(t, s)
+
+		// Leftovers of an interrupted upload and a file without metadata
+		for _, name := range []string{"/files/.valid.abc.tmp", "/files/incomplete"} {
+			f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE, 0600)
+			if err != nil {
+				t.Fatalf("Failed to create %s: %v", name, err)
+			}
+			f.Write([]byte("leftover"))
+			f.Close()
+		}
+
+		filenames, _, err := s.List(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		slices.Sort(filenames)
+		if !slices.Equal(filenames, []string{"expired", "valid"}) {
+			t.Errorf("Expected [expired valid], got %v", filenames)
+		}
+	})
+
+	t.Run("does not leave temporary files behind", func(t *testing.T) {
+		s, fs := setupWebDAVStorage(t)
+		if err := s.Put(ctx, "file", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+			t.Fatalf("Failed to put file: %v", err)
+		}
+
+		dir, err := fs.OpenFile(ctx, "/files", 0, 0)
+		if err != nil {
+			t.Fatalf("Failed to open collection: %v", err)
+		}
+		defer dir.Close()
+		infos, err := dir.Readdir(-1)
+		if err != nil {
+			t.Fatalf("Failed to read collection: %v", err)
+		}
+
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, []string{"file", "file.metadata"}) {
+			t.Errorf("Expected [file file.metadata], got %v", names)
+		}
+	})
+}
+
+func TestWebDAVStorage_Fsck(t *testing.T) {
+	ctx := context.Background()
+	s, fs := setupWebDAVStorage(t)
+
+	if err := s.Put(ctx, "complete", bytes.NewBufferString("Hello, World!"), storage.Metadata{}); err != nil {
+		t.Fatalf("Failed to put file: %v", err)
+	}
+	leftovers := []string{".complete.123456.tmp", "body-only", "metadata-only.metadata"}
+	for _, name := range leftovers {
+		f, err := fs.OpenFile(ctx, "/files/"+name, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		f.Write([]byte("leftover"))
+		f.Close()
+	}
+
+	t.Run("keeps leftovers within grace period", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{GracePeriod: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		if len(removed) != 0 {
+			t.Errorf("Expected recent leftovers to be kept, got %v", removed)
+		}
+	})
+
+	t.Run("removes leftovers", func(t *testing.T) {
+		removed, err := s.Fsck(ctx, storage.FsckOptions{})
+		if err != nil {
+			t.Fatalf("Failed to run fsck: %v", err)
+		}
+		if !slices.Equal(removed, leftovers) {
+			t.Errorf("Expected %v, got %v", leftovers, removed)
+		}
+
+		for _, name := range leftovers {
+			if _, err := fs.Stat(ctx, "/files/"+name); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed", name)
+			}
+		}
+		if err := storage.VerifyChecksum(ctx, s, "complete"); err != nil {
+			t.Errorf("Expected complete file to be kept: %v", err)
+		}
+	})
+}
@@ -0,0 +1,440 @@
+// Package webhooks sends events about files to webhook URLs
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exler/fileigloo/logger"
+	"github.com/exler/fileigloo/storage"
+)
+
+type EventType string
+
+const (
+	EventFileUploaded   EventType = "file.uploaded"
+	EventFileDownloaded EventType = "file.downloaded"
+	EventFileDeleted    EventType = "file.deleted"
+	EventFileExpired    EventType = "file.expired"
+)
+
+var eventTypes = []EventType{EventFileUploaded, EventFileDownloaded, EventFileDeleted, EventFileExpired}
+
+// Event is sent as the JSON body of webhook requests
+type Event struct {
+	Id   string    `json:"id"`
+	Type EventType `json:"type"`
+	Time string    `json:"time"`
+	File EventFile `json:"file"`
+}
+
+// EventFile describes the file an event is about. Passwords and uploader details are never sent.
+type EventFile struct {
+	FileId        string            `json:"fileId"`
+	FileUrl       string            `json:"fileUrl,omitempty"`
+	Filename      string            `json:"filename"`
+	ContentType   string            `json:"contentType"`
+	ContentLength int64             `json:"contentLength,omitempty"`
+	Checksum      string            `json:"checksum,omitempty"`
+	ExpiresAt     string            `json:"expiresAt,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// NewEvent creates an event about the stored file, fileUrl may be empty if it is not known
+func NewEvent(eventType EventType, fileId, fileUrl string, metadata storage.Metadata) Event {
+	event := Event{
+		Id:   rand.Text(),
+		Type: eventType,
+		Time: time.Now().UTC().Format(time.RFC3339),
+		File: EventFile{
+			FileId:        fileId,
+			FileUrl:       fileUrl,
+			Filename:      metadata.Filename,
+			ContentType:   metadata.ContentType,
+			ContentLength: metadata.ContentLength,
+			Checksum:      metadata.Checksum,
+			Labels:        metadata.Labels,
+		},
+	}
+	if !metadata.ExpiresAt.IsZero() {
+		event.File.ExpiresAt = metadata.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return event
+}
+
+type Config struct {
+	// URLs every event is sent to with a POST request
+	URLs []string
+	// Secret, if set, signs the requests with an X-Fileigloo-Signature header (sha256=<hex HMAC of the body>)
+	Secret string
+	// Events limits the events that are sent, all are sent if empty
+	Events []EventType
+	// OutboxDirectory keeps events until they are delivered, so that they survive restarts
+	OutboxDirectory string
+	// MaxAttempts is how many times a delivery is attempted before it is dropped, defaults to 10
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubled for every following one. Defaults to 10 seconds.
+	RetryBackoff time.Duration
+}
+
+// Webhooks delivers events to webhook URLs. Events are written to the outbox first and removed once
+// delivered, failed deliveries are retried with exponential backoff. Every URL is delivered to
+// separately, so that one that is slow or down does not hold up the others. Deliveries are at least
+// once, receivers can recognize repeated ones by the X-Fileigloo-Delivery header.
+type Webhooks struct {
+	logger *logger.Logger
+	client *http.Client
+
+	urls         []string
+	secret       []byte
+	events       []EventType
+	outbox       string
+	maxAttempts  int
+	retryBackoff time.Duration
+
+	mu sync.Mutex
+	// delivering holds the URLs a worker is delivering to, failing the URLs whose last delivery failed
+	// until their retry is due. Both are guarded by mu.
+	delivering map[string]bool
+	failing    map[string]time.Time
+	workers    sync.WaitGroup
+	wake       chan struct{}
+}
+
+// delivery of an event to a URL, stored as a file in the outbox
+type delivery struct {
+	URL         string          `json:"url"`
+	EventId     string          `json:"eventId"`
+	EventType   EventType       `json:"eventType"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+
+	// name of the file in the outbox
+	name string
+}
+
+const (
+	defaultWebhookMaxAttempts  = 10
+	defaultWebhookRetryBackoff = 10 * time.Second
+	maxWebhookRetryBackoff     = time.Hour
+	webhookTimeout             = 10 * time.Second
+
+	// Deliveries written by other processes sharing the outbox, e.g. the CLI, are picked up this often
+	webhookPollInterval = time.Minute
+
+	outboxExt = ".json"
+)
+
+func NewWebhooks(config Config) (*Webhooks, error) {
+	if len(config.URLs) == 0 {
+		return nil, errors.New("at least one webhook url is required")
+	} else if config.OutboxDirectory == "" {
+		return nil, errors.New("webhook outbox directory is required")
+	}
+
+	for _, webhookURL := range config.URLs {
+		u, err := url.Parse(webhookURL)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("webhook url %s must use http or https", webhookURL)
+		}
+	}
+	for _, eventType := range config.Events {
+		if !slices.Contains(eventTypes, eventType) {
+			return nil, fmt.Errorf("unknown webhook event %s", eventType)
+		}
+	}
+
+	if err := os.MkdirAll(config.OutboxDirectory, 0o700); err != nil {
+		return nil, err
+	}
+
+	w := &Webhooks{
+		logger:       logger.NewLogger(),
+		client:       &http.Client{Timeout: webhookTimeout},
+		urls:         config.URLs,
+		secret:       []byte(config.Secret),
+		events:       config.Events,
+		outbox:       config.OutboxDirectory,
+		maxAttempts:  config.MaxAttempts,
+		retryBackoff: config.RetryBackoff,
+		delivering:   make(map[string]bool),
+		failing:      make(map[string]time.Time),
+		wake:         make(chan struct{}, 1),
+	}
+	if w.maxAttempts <= 0 {
+		w.maxAttempts = defaultWebhookMaxAttempts
+	}
+	if w.retryBackoff <= 0 {
+		w.retryBackoff = defaultWebhookRetryBackoff
+	}
+	return w, nil
+}
+
+// Emit adds the event to the outbox, to be delivered to every URL. Errors are logged, so that
+// failing webhooks never fail the action the event is about.
+func (w *Webhooks) Emit(event Event) {
+	if len(w.events) > 0 && !slices.Contains(w.events, event.Type) {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Error(err)
+		return
+	}
+
+	now := time.Now()
+	for i, webhookURL := range w.urls {
+		d := delivery{
+			URL:         webhookURL,
+			EventId:     event.Id,
+			EventType:   event.Type,
+			Body:        body,
+			NextAttempt: now,
+		}
+		// Named after the time, so that deliveries are attempted in the order of events
+		name := fmt.Sprintf("%020d-%s-%d%s", now.UnixNano(), event.Id, i, outboxExt)
+		if err := w.save(name, d); err != nil {
+			w.logger.Error(fmt.Errorf("failed to add event to webhook outbox [eventId=%s]: %w", event.Id, err))
+		}
+	}
+
+	w.notify()
+}
+
+// notify wakes Run up to look at the outbox again
+func (w *Webhooks) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the delivery to the outbox under a temporary name first, so that it is never read half-written
+func (w *Webhooks) save(name string, d delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(w.outbox, ".delivery-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //#nosec
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(w.outbox, name))
+}
+
+// Run delivers events until the context is cancelled
+func (w *Webhooks) Run(ctx context.Context) {
+	defer w.workers.Wait()
+
+	for {
+		next := w.deliverDue(ctx)
+
+		wait := webhookPollInterval
+		if !next.IsZero() {
+			wait = min(wait, time.Until(next))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Flush attempts the deliveries that are due and waits for them. Failed deliveries stay in the outbox,
+// to be retried by Run, possibly in another process sharing the outbox.
+func (w *Webhooks) Flush(ctx context.Context) {
+	w.deliverDue(ctx)
+	w.workers.Wait()
+}
+
+// deliverDue starts a worker for every URL with deliveries that are due, unless one is already delivering
+// to it, and returns when the next delivery will be due, zero if none is pending. Workers wake Run up
+// once they are done, so that it looks at the outbox again.
+func (w *Webhooks) deliverDue(ctx context.Context) (next time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entries, err := os.ReadDir(w.outbox)
+	if err != nil {
+		w.logger.Error(err)
+		return time.Now().Add(w.retryBackoff)
+	}
+
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	// Due deliveries by URL, in the order of events
+	due := make(map[string][]delivery)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, outboxExt) {
+			continue
+		}
+
+		path := filepath.Join(w.outbox, name)
+		d, err := readDelivery(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Delivered by another process in the meantime
+			continue
+		} else if err != nil {
+			w.logger.Error(fmt.Errorf("dropping unreadable webhook delivery [file=%s]: %w", name, err))
+			os.Remove(path) //#nosec
+			continue
+		}
+		d.name = name
+
+		if w.delivering[d.URL] {
+			continue
+		} else if retry, ok := w.failing[d.URL]; ok && time.Now().Before(retry) {
+			earliest(retry)
+		} else if time.Now().Before(d.NextAttempt) {
+			earliest(d.NextAttempt)
+		} else {
+			due[d.URL] = append(due[d.URL], d)
+		}
+	}
+
+	for webhookURL, deliveries := range due {
+		w.delivering[webhookURL] = true
+		w.workers.Add(1)
+		go func() {
+			defer w.workers.Done()
+			retry := w.deliverInOrder(ctx, deliveries)
+
+			w.mu.Lock()
+			delete(w.delivering, webhookURL)
+			if retry.IsZero() {
+				delete(w.failing, webhookURL)
+			} else {
+				w.failing[webhookURL] = retry
+			}
+			w.mu.Unlock()
+			w.notify()
+		}()
+	}
+	return
+}
+
+// deliverInOrder attempts the deliveries to a single URL. After a failed one, the remaining ones are left
+// until the retry, which is returned, rather than being attempted in vain. Zero is returned if none failed.
+func (w *Webhooks) deliverInOrder(ctx context.Context, deliveries []delivery) (retry time.Time) {
+	for _, d := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		path := filepath.Join(w.outbox, d.name)
+		err := w.deliver(ctx, d)
+		if err == nil {
+			os.Remove(path) //#nosec
+			continue
+		} else if ctx.Err() != nil {
+			// Interrupted by shutdown, the attempt does not count
+			return
+		}
+
+		d.Attempts++
+		if d.Attempts >= w.maxAttempts {
+			w.logger.Error(fmt.Errorf("dropping webhook delivery after %d attempts [eventId=%s, url=%s]: %w", d.Attempts, d.EventId, d.URL, err))
+			os.Remove(path) //#nosec
+			return time.Now().Add(w.retryBackoff)
+		}
+
+		d.NextAttempt = time.Now().Add(w.backoff(d.Attempts))
+		w.logger.Debug(fmt.Sprintf("Webhook delivery failed, retrying at %s [eventId=%s, url=%s]: %s", d.NextAttempt.Format(time.RFC3339), d.EventId, d.URL, err))
+		if err := w.save(d.name, d); err != nil {
+			w.logger.Error(err)
+		}
+		return d.NextAttempt
+	}
+	return
+}
+
+// backoff returns the delay before the next attempt after the given number of failed ones
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	backoff := w.retryBackoff
+	for i := 1; i < attempts && backoff < maxWebhookRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxWebhookRetryBackoff)
+}
+
+func readDelivery(path string) (d delivery, err error) {
+	data, err := os.ReadFile(path) //#nosec
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &d)
+	return
+}
+
+func (w *Webhooks) deliver(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fileigloo-webhooks")
+	req.Header.Set("X-Fileigloo-Event", string(d.EventType))
+	req.Header.Set("X-Fileigloo-Delivery", d.EventId)
+	if len(w.secret) > 0 {
+		req.Header.Set("X-Fileigloo-Signature", Sign(d.Body, w.secret))
+	}
+
+	resp, err := w.client.Do(req) //#nosec
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body) //#nosec
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the X-Fileigloo-Signature header value of a webhook request body
+func Sign(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,262 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/exler/fileigloo/storage"
+	"github.com/exler/fileigloo/webhooks"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	event  webhooks.Event
+}
+
+// webhookReceiver records the webhook requests it receives, failing the first failures of them
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []webhookRequest
+	failures int
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	t.Helper()
+
+	receiver := &webhookReceiver{failures: failures, received: make(chan struct{}, 100)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event webhooks.Event
+		json.Unmarshal(body, &event)
+
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, webhookRequest{header: r.Header, body: body, event: event})
+		fail := len(receiver.requests) <= receiver.failures
+		receiver.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		receiver.received <- struct{}{}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) wait(t *testing.T, count int) []webhookRequest {
+	t.Helper()
+
+	for range count {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for webhook requests")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookRequest(nil), r.requests...)
+}
+
+func newWebhooks(t *testing.T, config webhooks.Config) *webhooks.Webhooks {
+	t.Helper()
+
+	if config.OutboxDirectory == "" {
+		config.OutboxDirectory = t.TempDir()
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 10 * time.Millisecond
+	}
+	hooks, err := webhooks.NewWebhooks(config)
+	if err != nil {
+		t.Fatalf("Failed to create webhooks: %v", err)
+	}
+	return hooks
+}
+
+func runWebhooks(t *testing.T, hooks *webhooks.Webhooks) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hooks.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func outboxFiles(t *testing.T, directory string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("Failed to read outbox: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Run("retries failed deliveries", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 2)
+		outbox := t.TempDir()
+		hooks := newWebhooks(t, webhooks.Config{URLs: []string{receiver.URL}, OutboxDirectory: outbox})
+		runWebhooks(t, hooks)
+
+		hooks.Emit(webhooks.NewEvent(webhooks.EventFileDeleted, "abc", "", storage.Metadata{Filename: "test.txt"}))
+
+		requests := receiver.wait(t, 3)
+		for _, request := range requests[1:] {
+			if request.event.Id != requests[0].event.Id {
+				t.Errorf("Expected retries of event %s, got %s", requests[0].event.Id, request.event.Id)
+			}
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(outboxFiles(t, outbox)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if files := outboxFiles(t, outbox); len(files) != 0 {
+			t.Errorf("Expected delivered event to be removed from outbox, got %v", files)
+		}
+	})
+
+	t.Run("delivers to other urls while one is failing", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 0)
+
+		// Hangs until the test ends, like a webhook that is down without refusing connections
+		var slowRequests atomic.Int32
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			slowRequests.Add(1)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(slow.Close)
+		t.Cleanup(func() { close(release) })
+
+		hooks := newWebhooks(t, webhooks.Config{URLs: []string{slow.URL, receiver.URL}})
+		runWebhooks(t, hooks)
+
+		for _, fileId := range []string{"first", "second", "third"} {
+			hooks.Emit(webhooks.NewEvent(webhooks.EventFileUploaded, fileId, "", storage.Metadata{}))
+			if request := receiver.wait(t, 1); request[len(request)-1].event.File.FileId != fileId {
+				t.Errorf("Expected event about %s, got %+v", fileId, request[len(request)-1].event.File)
+			}
+		}
+		if count := slowRequests.Load(); count != 1 {
+			t.Errorf("Expected events to the failing url to wait for the first one, got %d requests", count)
+		}
+	})
+
+	t.Run("skips the rest of the events to a failing url", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 100)
+		outbox := t.TempDir()
+		hooks := newWebhooks(t, webhooks.Config{URLs: []string{receiver.URL}, OutboxDirectory: outbox})
+		for _, fileId := range []string{"first", "second", "third"} {
+			hooks.Emit(webhooks.NewEvent(webhooks.EventFileUploaded, fileId, "", storage.Metadata{}))
+		}
+		hooks.Flush(context.Background())
+
+		if requests := receiver.wait(t, 1); len(requests) != 1 || requests[0].event.File.FileId != "first" {
+			t.Errorf("Expected only the first event to be attempted, got %d requests", len(requests))
+		}
+		if files := outboxFiles(t, outbox); len(files) != 3 {
+			t.Errorf("Expected all events to stay in the outbox, got %v", files)
+		}
+	})
+
+	t.Run("keeps undelivered events in the outbox", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 1)
+		outbox := t.TempDir()
+		hooks := newWebhooks(t, webhooks.Config{URLs: []string{receiver.URL}, OutboxDirectory: outbox})
+		hooks.Emit(webhooks.NewEvent(webhooks.EventFileUploaded, "abc", "", storage.Metadata{Filename: "test.txt"}))
+		hooks.Flush(context.Background())
+
+		receiver.wait(t, 1)
+		if files := outboxFiles(t, outbox); len(files) != 1 {
+			t.Fatalf("Expected undelivered event in outbox, got %v", files)
+		}
+
+		// After a restart, the event is delivered from the outbox
+		restarted := newWebhooks(t, webhooks.Config{URLs: []string{receiver.URL}, OutboxDirectory: outbox})
+		runWebhooks(t, restarted)
+
+		if delivered := receiver.wait(t, 1)[1]; delivered.event.File.FileId != "abc" {
+			t.Errorf("Expected event about abc, got %+v", delivered.event.File)
+		}
+	})
+
+	t.Run("drops deliveries after max attempts", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 100)
+		outbox := t.TempDir()
+		hooks := newWebhooks(t, webhooks.Config{URLs: []string{receiver.URL}, OutboxDirectory: outbox, MaxAttempts: 3})
+		runWebhooks(t, hooks)
+
+		hooks.Emit(webhooks.NewEvent(webhooks.EventFileUploaded, "abc", "", storage.Metadata{}))
+		receiver.wait(t, 3)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(outboxFiles(t, outbox)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if files := outboxFiles(t, outbox); len(files) != 0 {
+			t.Errorf("Expected dropped event to be removed from outbox, got %v", files)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if requests := receiver.wait(t, 0); len(requests) != 3 {
+			t.Errorf("Expected 3 attempts, got %d", len(requests))
+		}
+	})
+
+	t.Run("sends only configured events", func(t *testing.T) {
+		outbox := t.TempDir()
+		hooks := newWebhooks(t, webhooks.Config{
+			URLs:            []string{"http://localhost/hook"},
+			OutboxDirectory: outbox,
+			Events:          []webhooks.EventType{webhooks.EventFileUploaded},
+		})
+
+		hooks.Emit(webhooks.NewEvent(webhooks.EventFileDownloaded, "abc", "", storage.Metadata{}))
+		if files := outboxFiles(t, outbox); len(files) != 0 {
+			t.Errorf("Expected filtered event not to be added to outbox, got %v", files)
+		}
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		for name, config := range map[string]webhooks.Config{
+			"no urls":       {OutboxDirectory: t.TempDir()},
+			"no outbox":     {URLs: []string{"http://localhost/hook"}},
+			"invalid url":   {URLs: []string{"ftp://localhost/hook"}, OutboxDirectory: t.TempDir()},
+			"unknown event": {URLs: []string{"http://localhost/hook"}, OutboxDirectory: t.TempDir(), Events: []webhooks.EventType{"file.renamed"}},
+		} {
+			if _, err := webhooks.NewWebhooks(config); err == nil {
+				t.Errorf("Expected error for %s", name)
+			}
+		}
+	})
+}